@@ -0,0 +1,79 @@
+package config
+
+import "time"
+
+// ExecutionConfig holds the sandbox limits applied to code executions and
+// the size of the queue that runs them
+type ExecutionConfig struct {
+	WallTime            time.Duration // real time a program may run
+	InteractiveWallTime time.Duration // real time an interactive program may run
+	CPUTime             time.Duration // CPU time a program may use
+	CompileTime         time.Duration // real time a build may take
+	MemoryBytes         int64         // heap and data segment of a program
+	MaxProcesses        int           // processes and threads of a program
+	MaxOutputBytes      int64         // stdout and stderr kept per run
+	MaxFileBytes        int64         // largest file a program may write
+	MaxProjectFiles     int           // files in a folder run as a project
+	MaxProjectBytes     int64         // source size of a folder run as a project
+	MaxTestCases        int           // test cases run by one test run
+	MaxTestTime         time.Duration // largest time limit a test case may set
+
+	Workers          int           // executions run at once by this instance
+	MaxQueued        int           // executions waiting across all users
+	MaxQueuedPerUser int           // executions one user may have waiting
+	MaxPerUser       int           // executions of one user running at once
+	MaxPerSession    int           // executions of one session running at once
+	PollInterval     time.Duration // how often idle workers look for jobs
+	LeaseTimeout     time.Duration // how long a silent worker keeps its job
+	MaxAttempts      int           // tries before a repeatedly abandoned job fails
+
+	UserQuota ExecutionQuota // what one user may start
+	HostQuota ExecutionQuota // what may run in the sessions one user hosts
+}
+
+// ExecutionQuota limits the compute one account may use. A test run counts
+// as a single run however many cases it has.
+type ExecutionQuota struct {
+	RunsPerMinute int           // runs started in any minute
+	CPUPerDay     time.Duration // CPU time used since midnight UTC
+	MaxConcurrent int           // runs queued or running at once
+}
+
+// LoadExecutionConfig reads the execution limits from the environment,
+// falling back to defaults for anything unset or invalid
+func LoadExecutionConfig() ExecutionConfig {
+	return ExecutionConfig{
+		WallTime:            envDuration("EXEC_WALL_TIME", 10*time.Second),
+		InteractiveWallTime: envDuration("EXEC_INTERACTIVE_WALL_TIME", 5*time.Minute),
+		CPUTime:             envDuration("EXEC_CPU_TIME", 5*time.Second),
+		CompileTime:         envDuration("EXEC_COMPILE_TIME", 30*time.Second),
+		MemoryBytes:         int64(envInt("EXEC_MEMORY_MB", 256)) << 20,
+		MaxProcesses:        envInt("EXEC_MAX_PROCESSES", 64),
+		MaxOutputBytes:      int64(envInt("EXEC_MAX_OUTPUT_BYTES", 64<<10)),
+		MaxFileBytes:        int64(envInt("EXEC_MAX_FILE_MB", 16)) << 20,
+		MaxProjectFiles:     envInt("EXEC_MAX_PROJECT_FILES", 200),
+		MaxProjectBytes:     int64(envInt("EXEC_MAX_PROJECT_MB", 4)) << 20,
+		MaxTestCases:        envInt("EXEC_MAX_TEST_CASES", 50),
+		MaxTestTime:         envDuration("EXEC_MAX_TEST_TIME", 30*time.Second),
+
+		Workers:          envInt("EXEC_WORKERS", 4),
+		MaxQueued:        envInt("EXEC_MAX_QUEUED", 200),
+		MaxQueuedPerUser: envInt("EXEC_MAX_QUEUED_PER_USER", 5),
+		MaxPerUser:       envInt("EXEC_MAX_PER_USER", 1),
+		MaxPerSession:    envInt("EXEC_MAX_PER_SESSION", 2),
+		PollInterval:     envDuration("EXEC_POLL_INTERVAL", time.Second),
+		LeaseTimeout:     envDuration("EXEC_LEASE_TIMEOUT", 2*time.Minute),
+		MaxAttempts:      envInt("EXEC_MAX_ATTEMPTS", 3),
+
+		UserQuota: ExecutionQuota{
+			RunsPerMinute: envInt("EXEC_USER_RUNS_PER_MINUTE", 10),
+			CPUPerDay:     envDuration("EXEC_USER_CPU_PER_DAY", 15*time.Minute),
+			MaxConcurrent: envInt("EXEC_USER_MAX_CONCURRENT", 3),
+		},
+		HostQuota: ExecutionQuota{
+			RunsPerMinute: envInt("EXEC_HOST_RUNS_PER_MINUTE", 60),
+			CPUPerDay:     envDuration("EXEC_HOST_CPU_PER_DAY", 2*time.Hour),
+			MaxConcurrent: envInt("EXEC_HOST_MAX_CONCURRENT", 10),
+		},
+	}
+}
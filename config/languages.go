@@ -0,0 +1,118 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Languages shipped with the server, used unless LANGUAGES_CONFIG names
+// another file
+//
+//go:embed languages.json
+var defaultLanguages []byte
+
+// LanguageConfig describes how code in one language is built and run.
+//
+// Commands may use these placeholders, each standing for one argument:
+// {entry} the entrypoint path, {entry_dir} the entrypoint's directory as
+// "." or "./dir", {entry_module} the entrypoint path without its extension
+// and with dots for slashes, {binary} the name builds should write, and
+// {package_name} the name declared in the [package] section of a project's
+// marker file. {sources} expands to every file with one of the language's
+// extensions.
+//
+// Environment values may use {workdir}, {home} and {cache} for the work
+// directory, the server's home directory and a cache directory the builds of
+// one user share; programs do not see the cache. Programs and builds run as
+// unprivileged accounts, so toolchains must be readable by anyone. With a
+// rootfs, programs see it read-only, with the work directory at /workspace
+// and an empty /tmp, and nothing of the server's filesystem; without one,
+// they see the server's filesystem read-only.
+type LanguageConfig struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Version     string   `json:"version"`
+	Extensions  []string `json:"extensions"`
+	// Files that start a program, in order of preference; the first is the
+	// name a single file runs under
+	Entrypoints []string `json:"entrypoints"`
+
+	Compile []string `json:"compile,omitempty"`
+	Run     []string `json:"run"`
+	// Alternative commands for projects holding a marker file
+	Projects []ProjectConfig `json:"projects,omitempty"`
+	// Files written into projects that lack them
+	SetupFiles map[string]string `json:"setup_files,omitempty"`
+
+	// Root filesystem programs run in instead of the server's
+	Rootfs     string            `json:"rootfs,omitempty"`
+	CompileEnv map[string]string `json:"compile_env,omitempty"`
+	RunEnv     map[string]string `json:"run_env,omitempty"`
+	// Variables passed through to the build from the server's environment
+	// when set there, overriding CompileEnv
+	InheritEnv []string `json:"inherit_env,omitempty"`
+
+	// Format of compiler and runtime errors: go, gcc, java, rust, python or
+	// javascript
+	Diagnostics string         `json:"diagnostics,omitempty"`
+	Limits      LanguageLimits `json:"limits,omitempty"`
+}
+
+// ProjectConfig replaces a language's commands for projects with a marker
+// file, such as a Cargo.toml
+type ProjectConfig struct {
+	Marker  string   `json:"marker"`
+	Compile []string `json:"compile,omitempty"`
+	Run     []string `json:"run"`
+}
+
+// LanguageLimits override the server's execution limits for one language;
+// zero keeps the server's
+type LanguageLimits struct {
+	WallTime     Duration `json:"wall_time,omitempty"`
+	CPUTime      Duration `json:"cpu_time,omitempty"`
+	CompileTime  Duration `json:"compile_time,omitempty"`
+	MemoryMB     int      `json:"memory_mb,omitempty"`
+	MaxProcesses int      `json:"max_processes,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "10s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadLanguages reads the language registry from the file named by
+// LANGUAGES_CONFIG, or the built-in one
+func LoadLanguages() ([]LanguageConfig, error) {
+	data := defaultLanguages
+	if path := os.Getenv("LANGUAGES_CONFIG"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var languages []LanguageConfig
+	if err := json.Unmarshal(data, &languages); err != nil {
+		return nil, fmt.Errorf("parsing language registry: %w", err)
+	}
+	return languages, nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WebSocketConfig holds the timing and size limits applied to socket connections
+type WebSocketConfig struct {
+	PingInterval  time.Duration // how often the server pings each connection
+	PongTimeout   time.Duration // how long to wait for a pong before dropping the peer
+	WriteTimeout  time.Duration // how long a single frame may take to write
+	IdleTimeout   time.Duration // disconnect after this long without client frames
+	MaxFrameSize  int64         // largest frame accepted from a client, in bytes
+	SendQueueSize int           // frames buffered per connection before it is evicted
+
+	ReplayBufferSize int           // broadcasts kept per room for reconnecting clients
+	RoomRetention    time.Duration // how long an empty room keeps its replay buffer
+
+	Broker string // backplane shared by server instances: memory or mongo
+
+	YjsTextName string // root Y.Text y-websocket clients keep a file's content in
+}
+
+// LoadWebSocketConfig reads the socket limits from the environment, falling
+// back to defaults for anything unset or invalid
+func LoadWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		PingInterval:  envDuration("WS_PING_INTERVAL", 25*time.Second),
+		PongTimeout:   envDuration("WS_PONG_TIMEOUT", 10*time.Second),
+		WriteTimeout:  envDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		IdleTimeout:   envDuration("WS_IDLE_TIMEOUT", 30*time.Minute),
+		MaxFrameSize:  int64(envInt("WS_MAX_FRAME_BYTES", 1<<20)),
+		SendQueueSize: envInt("WS_SEND_QUEUE", 256),
+
+		ReplayBufferSize: envInt("WS_REPLAY_BUFFER", 1000),
+		RoomRetention:    envDuration("WS_ROOM_RETENTION", 5*time.Minute),
+
+		Broker: envString("WS_BROKER", "memory"),
+
+		YjsTextName: envString("YJS_TEXT_NAME", "content"),
+	}
+}
+
+// envString reads a setting from the environment
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envDuration parses a positive duration such as "30s" from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s=%q", key, value)
+		return fallback
+	}
+	return d
+}
+
+// envInt parses a positive integer from the environment
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring invalid %s=%q", key, value)
+		return fallback
+	}
+	return n
+}
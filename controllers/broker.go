@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Broker backends selectable with WS_BROKER
+const (
+	BrokerMemory = "memory"
+	BrokerMongo  = "mongo"
+)
+
+// How long published messages stay in the events collection
+const brokerEventTTL = time.Minute
+
+// Kinds of broker messages other than room broadcasts
+const (
+	brokerKindExecInput = "exec_input" // input for an execution running somewhere
+)
+
+// BrokerMessage is a room broadcast, or a message of another kind, on its
+// way to every server instance
+type BrokerMessage struct {
+	Kind      string    `bson:"kind,omitempty"` // empty for room broadcasts
+	SessionID string    `bson:"session_id"`
+	SenderID  string    `bson:"sender_id,omitempty"` // connection the message is not delivered to
+	Data      []byte    `bson:"data"`                // the encoded envelope, or the kind's own payload
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Broker carries room broadcasts between server instances. Every published
+// message is handed to the subscriber of every instance, the publisher's
+// included, and all instances see messages in the same order.
+//
+// Live documents are kept by one instance per session. Claim makes this
+// instance that owner, or renews its claim, for ttl; it reports false while
+// another instance owns the session, and whether the session was owned by
+// another instance or by none before.
+type Broker interface {
+	Publish(ctx context.Context, msg BrokerMessage) error
+	// Subscribe registers the handler for incoming messages, and lost, which
+	// is called when messages may have been missed; it is called once
+	Subscribe(handler func(BrokerMessage), lost func())
+	Claim(ctx context.Context, sessionID string, ttl time.Duration) (owned, acquired bool, err error)
+	Close() error
+}
+
+// NewBroker creates the broker backend with the given name
+func NewBroker(name string, db *mongo.Database) (Broker, error) {
+	switch name {
+	case "", BrokerMemory:
+		return NewMemoryBroker(), nil
+	case BrokerMongo:
+		return NewMongoBroker(db)
+	default:
+		return nil, fmt.Errorf("unknown broker %q", name)
+	}
+}
+
+// MemoryBroker delivers messages within the process; it is enough when a
+// single instance is running
+type MemoryBroker struct {
+	sync.RWMutex
+	handler func(BrokerMessage)
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish hands the message straight to the subscriber
+func (b *MemoryBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	b.RLock()
+	handler := b.handler
+	b.RUnlock()
+
+	if handler != nil {
+		handler(msg)
+	}
+	return nil
+}
+
+// Subscribe registers the handler for published messages; none are ever
+// missed
+func (b *MemoryBroker) Subscribe(handler func(BrokerMessage), lost func()) {
+	b.Lock()
+	b.handler = handler
+	b.Unlock()
+}
+
+// Claim always succeeds, as this is the only instance
+func (b *MemoryBroker) Claim(ctx context.Context, sessionID string, ttl time.Duration) (bool, bool, error) {
+	return true, false, nil
+}
+
+// Close is a no-op for the in-process broker
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+// MongoBroker shares messages through a collection that every instance
+// watches with a change stream. Change streams need a replica set; a local
+// single-node one (mongod --replSet rs0) is enough for testing.
+//
+// Room broadcasts are shared; live documents and Yjs documents are kept by
+// the instance that owns the session, recorded in the ws_owners collection.
+// Other instances refuse edits to the session until the owner's claim runs
+// out, so the load balancer should still keep each session on one instance
+// (for example by hashing session_id) for clients to be able to edit.
+type MongoBroker struct {
+	events   *mongo.Collection
+	owners   *mongo.Collection
+	instance string
+	cancel   context.CancelFunc
+	ctx      context.Context
+}
+
+// NewMongoBroker creates a broker on the ws_events collection, which expires
+// messages once every instance has had time to see them
+func NewMongoBroker(db *mongo.Database) (*MongoBroker, error) {
+	events := db.Collection("ws_events")
+	owners := db.Collection("ws_owners")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"created_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(brokerEventTTL.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Claims that ran out are taken over anyway; this only clears them away
+	_, err = owners.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &MongoBroker{events: events, owners: owners, instance: primitive.NewObjectID().Hex()}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b, nil
+}
+
+// Publish stores the message for the watching instances
+func (b *MongoBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	_, err := b.events.InsertOne(ctx, msg)
+	return err
+}
+
+// Subscribe starts watching for new messages in the background
+func (b *MongoBroker) Subscribe(handler func(BrokerMessage), lost func()) {
+	go b.watch(handler, lost)
+}
+
+// Claim takes a session over when its owner's claim has run out, or renews
+// this instance's own
+func (b *MongoBroker) Claim(ctx context.Context, sessionID string, ttl time.Duration) (bool, bool, error) {
+	now := time.Now()
+	var previous struct {
+		Instance string `bson:"instance"`
+	}
+	err := b.owners.FindOneAndUpdate(ctx,
+		bson.M{"_id": sessionID, "$or": []bson.M{
+			{"instance": b.instance},
+			{"expires_at": bson.M{"$lte": now}},
+		}},
+		bson.M{"$set": bson.M{"instance": b.instance, "expires_at": now.Add(ttl)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(&previous)
+	if mongo.IsDuplicateKeyError(err) {
+		// The upsert ran into a live claim of another instance
+		return false, false, nil
+	}
+	if err == mongo.ErrNoDocuments {
+		return true, true, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, previous.Instance != b.instance, nil
+}
+
+// Close stops watching
+func (b *MongoBroker) Close() error {
+	b.cancel()
+	return nil
+}
+
+// watch follows inserts into the events collection, reopening the change
+// stream where it left off when it breaks. When it cannot, the messages in
+// between are lost and the subscriber is told.
+func (b *MongoBroker) watch(handler func(BrokerMessage), lost func()) {
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	var resumeToken bson.Raw
+	backoff := time.Second
+
+	for b.ctx.Err() == nil {
+		opts := options.ChangeStream()
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+
+		stream, err := b.events.Watch(b.ctx, pipeline, opts)
+		if err != nil {
+			log.Println("Error watching broker events:", err)
+			// The token may have fallen off the oplog; start from now instead
+			if resumeToken != nil {
+				resumeToken = nil
+				lost()
+			}
+			b.wait(backoff)
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		for stream.Next(b.ctx) {
+			var change struct {
+				FullDocument BrokerMessage `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Println("Error decoding broker event:", err)
+			} else {
+				handler(change.FullDocument)
+			}
+			resumeToken = stream.ResumeToken()
+		}
+		if err := stream.Err(); err != nil && b.ctx.Err() == nil {
+			log.Println("Broker change stream ended:", err)
+		}
+		stream.Close(context.Background())
+	}
+}
+
+// wait sleeps unless the broker is closed first
+func (b *MongoBroker) wait(d time.Duration) {
+	select {
+	case <-b.ctx.Done():
+	case <-time.After(d):
+	}
+}
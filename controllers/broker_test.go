@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	ctx := context.Background()
+
+	// Nothing is delivered before there is a subscriber
+	if err := b.Publish(ctx, BrokerMessage{SessionID: "s", Data: []byte("early")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	b.Subscribe(func(msg BrokerMessage) { got = append(got, string(msg.Data)) }, func() {
+		t.Error("the in-process broker lost messages")
+	})
+	for _, data := range []string{"a", "b"} {
+		if err := b.Publish(ctx, BrokerMessage{SessionID: "s", Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("got %q, want [a b]", got)
+	}
+
+	owned, acquired, err := b.Claim(ctx, "s", time.Minute)
+	if !owned || acquired || err != nil {
+		t.Errorf("claim got %v, %v, %v, want owned and not taken over", owned, acquired, err)
+	}
+}
+
+func TestMongoBrokerPublish(t *testing.T) {
+	db := testDatabase(t)
+	sessionID := primitive.NewObjectID().Hex()
+
+	// Two instances on the same database each get every message
+	var received []chan string
+	for i := 0; i < 2; i++ {
+		b, err := NewMongoBroker(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+
+		ch := make(chan string, 100)
+		received = append(received, ch)
+		b.Subscribe(func(msg BrokerMessage) {
+			if msg.SessionID == sessionID {
+				ch <- string(msg.Data)
+			}
+		}, func() {})
+	}
+
+	publisher, err := NewMongoBroker(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The change streams open in the background; ping until both see it
+	for _, ch := range received {
+		for seen := false; !seen; {
+			if err := publisher.Publish(ctx, BrokerMessage{SessionID: sessionID, Data: []byte("ping")}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-ch:
+				seen = true
+			case <-time.After(200 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatal("broker never started watching")
+			}
+		}
+	}
+
+	for _, data := range []string{"first", "second"} {
+		if err := publisher.Publish(ctx, BrokerMessage{SessionID: sessionID, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, ch := range received {
+		var got []string
+		for len(got) < 2 {
+			select {
+			case data := <-ch:
+				if data != "ping" {
+					got = append(got, data)
+				}
+			case <-ctx.Done():
+				t.Fatalf("instance %d got %q before timing out", i, got)
+			}
+		}
+		if got[0] != "first" || got[1] != "second" {
+			t.Errorf("instance %d got %q, want [first second]", i, got)
+		}
+	}
+}
+
+func TestMongoBrokerClaim(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	sessionID := primitive.NewObjectID().Hex()
+	const ttl = 500 * time.Millisecond
+
+	a, err := NewMongoBroker(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewMongoBroker(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	claim := func(name string, broker *MongoBroker, wantOwned, wantAcquired bool) {
+		t.Helper()
+		owned, acquired, err := broker.Claim(ctx, sessionID, ttl)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if owned != wantOwned || acquired != wantAcquired {
+			t.Errorf("%s: got owned %v and acquired %v, want %v and %v", name, owned, acquired, wantOwned, wantAcquired)
+		}
+	}
+
+	claim("first claim", a, true, true)
+	claim("renewal", a, true, false)
+	// The upsert of the second instance runs into the live claim
+	claim("claim owned elsewhere", b, false, false)
+
+	time.Sleep(ttl + 100*time.Millisecond)
+	claim("claim after it ran out", b, true, true)
+	claim("former owner", a, false, false)
+}
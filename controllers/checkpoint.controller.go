@@ -0,0 +1,511 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// errTreeChanged is returned when a file is saved while a checkpoint is
+// being restored over it
+var errTreeChanged = errors.New("files changed during the restore")
+
+// How a file differs between two checkpoints
+const (
+	checkpointFileAdded    = "added"
+	checkpointFileRemoved  = "removed"
+	checkpointFileModified = "modified"
+)
+
+type CheckpointController struct {
+	checkpointCollection   *mongo.Collection
+	fileCollection         *mongo.Collection
+	fileVersionCollection  *mongo.Collection
+	folderCollection       *mongo.Collection
+	sessionCollection      *mongo.Collection
+	collaboratorCollection *mongo.Collection
+	documents              *DocumentManager
+	yjs                    *YjsManager
+}
+
+// Constructor for CheckpointController
+func NewCheckpointController(db *mongo.Database, documents *DocumentManager, yjs *YjsManager) *CheckpointController {
+	return &CheckpointController{
+		checkpointCollection:   db.Collection("checkpoints"),
+		fileCollection:         db.Collection("files"),
+		fileVersionCollection:  db.Collection("file_versions"),
+		folderCollection:       db.Collection("folders"),
+		sessionCollection:      db.Collection("sessions"),
+		collaboratorCollection: db.Collection("collaborators"),
+		documents:              documents,
+		yjs:                    yjs,
+	}
+}
+
+// CreateCheckpoint records the current version of every file in a session,
+// or in one folder of it, under a name
+func (cc *CheckpointController) CreateCheckpoint(c *gin.Context) {
+	var request struct {
+		SessionID   primitive.ObjectID `json:"session_id" binding:"required"`
+		FolderID    primitive.ObjectID `json:"folder_id"`
+		Name        string             `json:"name" binding:"required"`
+		Description string             `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if !requireSessionMember(c, cc.sessionCollection, cc.collaboratorCollection, request.SessionID, userID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	checkpoint := models.Checkpoint{
+		ID:          primitive.NewObjectID(),
+		SessionID:   request.SessionID,
+		FolderID:    request.FolderID,
+		Name:        request.Name,
+		Description: request.Description,
+		CreatedBy:   userID,
+		CreatedAt:   time.Now(),
+	}
+	files, ok := cc.treeFiles(c, ctx, checkpoint)
+	if !ok {
+		return
+	}
+	checkpoint.Files = make([]models.CheckpointFile, 0, len(files))
+	for _, file := range files {
+		checkpoint.Files = append(checkpoint.Files, models.CheckpointFile{
+			FileID:   file.ID,
+			FolderID: file.FolderID,
+			Name:     file.Name,
+			Version:  file.Version,
+		})
+	}
+
+	if _, err := cc.checkpointCollection.InsertOne(ctx, checkpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkpoint"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Checkpoint created", "checkpoint": checkpoint})
+}
+
+// GetCheckpoints lists the checkpoints of a session, newest first, optionally
+// only those of one folder. GetCheckpoint has their files.
+func (cc *CheckpointController) GetCheckpoints(c *gin.Context) {
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if !requireSessionMember(c, cc.sessionCollection, cc.collaboratorCollection, sessionID, userID) {
+		return
+	}
+
+	filter := bson.M{"session_id": sessionID}
+	if folderID := c.Query("folder_id"); folderID != "" {
+		objectID, err := primitive.ObjectIDFromHex(folderID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+			return
+		}
+		filter["folder_id"] = objectID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := cc.checkpointCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetProjection(bson.M{"files": 0}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve checkpoints"})
+		return
+	}
+	checkpoints := []models.Checkpoint{}
+	if err := cursor.All(ctx, &checkpoints); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode checkpoints"})
+		return
+	}
+	c.JSON(http.StatusOK, checkpoints)
+}
+
+// GetCheckpoint returns a checkpoint with the version of each of its files
+func (cc *CheckpointController) GetCheckpoint(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	checkpoint, ok := cc.requireCheckpoint(c, ctx, c.Param("id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, checkpoint)
+}
+
+// checkpointFileDiff is how one file differs between two checkpoints
+type checkpointFileDiff struct {
+	FileID      primitive.ObjectID `json:"file_id"`
+	Name        string             `json:"name"`
+	Status      string             `json:"status"`
+	FromVersion int                `json:"from_version,omitempty"`
+	ToVersion   int                `json:"to_version,omitempty"`
+	Hunks       []utils.DiffHunk   `json:"hunks,omitempty"`
+	Diff        string             `json:"diff,omitempty"`
+}
+
+// DiffCheckpoints compares a checkpoint with the checkpoint given as to, or
+// with the files as they are now when to is left out. Only files that
+// differ are listed. With format=unified each diff comes as diff -u text,
+// otherwise as hunks of lines.
+func (cc *CheckpointController) DiffCheckpoints(c *gin.Context) {
+	format := c.DefaultQuery("format", "lines")
+	if format != "lines" && format != "unified" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be lines or unified"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	from, ok := cc.requireCheckpoint(c, ctx, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	// Content of each side, read lazily from the version history unless
+	// already known
+	var to models.Checkpoint
+	current := map[primitive.ObjectID]string{}
+	if toID := c.Query("to"); toID != "" {
+		if to, ok = cc.requireCheckpoint(c, ctx, toID); !ok {
+			return
+		}
+		if to.SessionID != from.SessionID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Checkpoints belong to different sessions"})
+			return
+		}
+	} else {
+		to = models.Checkpoint{SessionID: from.SessionID, FolderID: from.FolderID}
+		files, ok := cc.treeFiles(c, ctx, to)
+		if !ok {
+			return
+		}
+		for _, file := range files {
+			to.Files = append(to.Files, models.CheckpointFile{FileID: file.ID, FolderID: file.FolderID, Name: file.Name, Version: file.Version})
+			current[file.ID] = file.Content
+		}
+	}
+	content := func(file models.CheckpointFile, latest bool) (string, error) {
+		if text, ok := current[file.FileID]; ok && latest {
+			return text, nil
+		}
+		version, err := loadFileVersion(ctx, cc.fileVersionCollection, file.FileID, file.Version)
+		return version.Content, err
+	}
+
+	fromFiles := make(map[primitive.ObjectID]models.CheckpointFile, len(from.Files))
+	for _, file := range from.Files {
+		fromFiles[file.FileID] = file
+	}
+	toFiles := make(map[primitive.ObjectID]models.CheckpointFile, len(to.Files))
+	for _, file := range to.Files {
+		toFiles[file.FileID] = file
+	}
+
+	diffs := []checkpointFileDiff{}
+	diff := func(fileDiff checkpointFileDiff, oldText, newText string) {
+		hunks := utils.DiffHunks(utils.DiffLines(utils.SplitLines(oldText), utils.SplitLines(newText)), versionDiffContext)
+		if format == "unified" {
+			fileDiff.Diff = utils.UnifiedDiff(
+				fmt.Sprintf("%s@%d", fileDiff.Name, fileDiff.FromVersion),
+				fmt.Sprintf("%s@%d", fileDiff.Name, fileDiff.ToVersion),
+				hunks,
+			)
+		} else {
+			fileDiff.Hunks = hunks
+		}
+		diffs = append(diffs, fileDiff)
+	}
+
+	for _, file := range from.Files {
+		other, ok := toFiles[file.FileID]
+		if ok && other.Version == file.Version {
+			continue
+		}
+		fileDiff := checkpointFileDiff{FileID: file.FileID, Name: file.Name, FromVersion: file.Version}
+		oldText, err := content(file, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read %s at version %d", file.Name, file.Version)})
+			return
+		}
+		if !ok {
+			fileDiff.Status = checkpointFileRemoved
+			diff(fileDiff, oldText, "")
+			continue
+		}
+		fileDiff.Status = checkpointFileModified
+		fileDiff.ToVersion = other.Version
+		newText, err := content(other, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read %s at version %d", other.Name, other.Version)})
+			return
+		}
+		diff(fileDiff, oldText, newText)
+	}
+	for _, file := range to.Files {
+		if _, ok := fromFiles[file.FileID]; ok {
+			continue
+		}
+		newText, err := content(file, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read %s at version %d", file.Name, file.Version)})
+			return
+		}
+		diff(checkpointFileDiff{FileID: file.FileID, Name: file.Name, Status: checkpointFileAdded, ToVersion: file.Version}, "", newText)
+	}
+
+	response := gin.H{"from": from.ID, "to": to.ID, "files": diffs}
+	if to.ID.IsZero() {
+		response["to"] = nil
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RestoreCheckpoint brings every file of a checkpoint back to the version it
+// had then, in one transaction; each changed file gets a new head version.
+// Files added since are left alone and files deleted since cannot come back;
+// both are listed. Live edits of restored files that were not saved yet are
+// dropped. Only the host may restore a checkpoint.
+func (cc *CheckpointController) RestoreCheckpoint(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	checkpoint, ok := cc.requireCheckpoint(c, ctx, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !requireSessionHost(c, cc.sessionCollection, checkpoint.SessionID, userID) {
+		return
+	}
+
+	files, ok := cc.treeFiles(c, ctx, checkpoint)
+	if !ok {
+		return
+	}
+	existing := make(map[primitive.ObjectID]bool, len(files))
+	for _, file := range files {
+		existing[file.ID] = true
+	}
+
+	// History does not change, so the contents to restore are read up front
+	contents := make(map[primitive.ObjectID]string, len(checkpoint.Files))
+	missing := []models.CheckpointFile{}
+	for _, file := range checkpoint.Files {
+		if !existing[file.FileID] {
+			missing = append(missing, file)
+			continue
+		}
+		version, err := loadFileVersion(ctx, cc.fileVersionCollection, file.FileID, file.Version)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read %s at version %d", file.Name, file.Version)})
+			return
+		}
+		contents[file.FileID] = version.Content
+		delete(existing, file.FileID)
+	}
+	added := []models.CheckpointFile{}
+	for _, file := range files {
+		if existing[file.ID] {
+			added = append(added, models.CheckpointFile{FileID: file.ID, FolderID: file.FolderID, Name: file.Name, Version: file.Version})
+		}
+	}
+
+	// Restore every file or none
+	var restored []models.CheckpointFile
+	err = runTransaction(ctx, cc.fileCollection.Database().Client(), func(sc mongo.SessionContext) error {
+		restored = []models.CheckpointFile{}
+		now := time.Now()
+		for _, file := range checkpoint.Files {
+			content, ok := contents[file.FileID]
+			if !ok {
+				continue
+			}
+			var current models.File
+			if err := cc.fileCollection.FindOne(sc, bson.M{"_id": file.FileID}).Decode(&current); err != nil {
+				return err
+			}
+			if current.Content == content {
+				continue
+			}
+
+			result, err := cc.fileCollection.UpdateOne(sc,
+				bson.M{"_id": file.FileID, "version": current.Version},
+				bson.M{"$set": bson.M{
+					"content":        content,
+					"version":        current.Version + 1,
+					"updated_at":     now,
+					"last_edited_by": userID,
+				}},
+			)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errTreeChanged
+			}
+
+			version := models.FileVersion{
+				ID:           primitive.NewObjectID(),
+				FileID:       file.FileID,
+				Content:      content,
+				Version:      current.Version + 1,
+				EditedBy:     userID,
+				EditedAt:     now,
+				RestoredFrom: file.Version,
+				CheckpointID: checkpoint.ID,
+			}
+			if err := recordFileVersion(sc, cc.fileVersionCollection, version, current.Content); err != nil {
+				return err
+			}
+			file.Version = version.Version
+			restored = append(restored, file)
+		}
+		return nil
+	})
+
+	if err == errTreeChanged || isTransientTransactionError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Files were saved during the restore, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction failed"})
+		return
+	}
+
+	// Editors with a restored file open live get the restored content
+	for _, file := range restored {
+		if err := cc.documents.Reset(ctx, file.FileID); err != nil {
+			log.Println("Error resetting live document:", err)
+		}
+		if err := cc.yjs.Reset(ctx, file.FileID); err != nil {
+			log.Println("Error resetting Yjs document:", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Checkpoint restored",
+		"restored": restored,
+		"added":    added,
+		"missing":  missing,
+	})
+}
+
+// treeFiles loads the files a checkpoint covers as they are now: those of
+// its folder, or of every folder of its session. It writes the error
+// response itself and returns false when they cannot be read.
+func (cc *CheckpointController) treeFiles(c *gin.Context, ctx context.Context, checkpoint models.Checkpoint) ([]models.File, bool) {
+	folderFilter := bson.M{"session_id": checkpoint.SessionID}
+	if !checkpoint.FolderID.IsZero() {
+		folderFilter["_id"] = checkpoint.FolderID
+	}
+	cursor, err := cc.folderCollection.Find(ctx, folderFilter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folders"})
+		return nil, false
+	}
+	var folders []models.Folder
+	if err := cursor.All(ctx, &folders); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode folders"})
+		return nil, false
+	}
+	if !checkpoint.FolderID.IsZero() && len(folders) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found in this session"})
+		return nil, false
+	}
+
+	// Files point at their folder, and folders may also list their files
+	folderIDs := make([]primitive.ObjectID, 0, len(folders))
+	var fileIDs []primitive.ObjectID
+	for _, folder := range folders {
+		folderIDs = append(folderIDs, folder.ID)
+		fileIDs = append(fileIDs, folder.FileIDs...)
+	}
+	cursor, err = cc.fileCollection.Find(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"folder_id": bson.M{"$in": folderIDs}},
+			bson.M{"_id": bson.M{"$in": fileIDs}},
+		}},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}).SetProjection(bson.M{"yjs_updates": 0}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+		return nil, false
+	}
+	var files []models.File
+	if err := cursor.All(ctx, &files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode files"})
+		return nil, false
+	}
+	return files, true
+}
+
+// requireCheckpoint loads a checkpoint and checks the user belongs to its
+// session, writing the error response when not
+func (cc *CheckpointController) requireCheckpoint(c *gin.Context, ctx context.Context, id string) (models.Checkpoint, bool) {
+	checkpointID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checkpoint ID"})
+		return models.Checkpoint{}, false
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return models.Checkpoint{}, false
+	}
+
+	var checkpoint models.Checkpoint
+	err = cc.checkpointCollection.FindOne(ctx, bson.M{"_id": checkpointID}).Decode(&checkpoint)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkpoint not found"})
+		return models.Checkpoint{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve checkpoint"})
+		return models.Checkpoint{}, false
+	}
+	if !requireSessionMember(c, cc.sessionCollection, cc.collaboratorCollection, checkpoint.SessionID, userID) {
+		return models.Checkpoint{}, false
+	}
+	return checkpoint, true
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/models"
+)
+
+func TestRestoreCheckpoint(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	hub := testHub(NewMemoryBroker())
+	cc := NewCheckpointController(db, NewDocumentManager(db, hub), NewYjsManager(db, hub, "content"))
+	host, collaborator := primitive.NewObjectID(), primitive.NewObjectID()
+
+	// Four files of one folder: changed, unchanged, deleted after the
+	// checkpoint, and added after it
+	changed := testFile(t, db, host, "one\n")
+	sessionID, err := fileSessionID(ctx, db.Collection("files"), db.Collection("folders"), changed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sibling := func(name, content string) models.File {
+		file := models.File{ID: primitive.NewObjectID(), UserID: host, FolderID: changed.FolderID, Name: name, Content: content, Language: "go", Version: 1}
+		if _, err := db.Collection("files").InsertOne(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+		version := models.FileVersion{ID: primitive.NewObjectID(), FileID: file.ID, Content: content, Version: 1, EditedBy: host, EditedAt: time.Now()}
+		if err := recordFileVersion(ctx, db.Collection("file_versions"), version, ""); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	unchanged := sibling("util.go", "util\n")
+	deleted := sibling("old.go", "old\n")
+	membership := models.Collaborator{ID: primitive.NewObjectID(), SessionID: sessionID, UserID: collaborator, AddedBy: host}
+	if _, err := db.Collection("collaborators").InsertOne(ctx, membership); err != nil {
+		t.Fatal(err)
+	}
+
+	body := fmt.Sprintf(`{"session_id": %q, "name": "before"}`, sessionID.Hex())
+	w := serveTest(cc.CreateCheckpoint, http.MethodPost, nil, host, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the checkpoint answered %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		Checkpoint models.Checkpoint `json:"checkpoint"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := created.Checkpoint
+
+	saveTestVersion(t, db, &changed, collaborator, "one\ntwo\n")
+	if _, err := db.Collection("files").DeleteOne(ctx, bson.M{"_id": deleted.ID}); err != nil {
+		t.Fatal(err)
+	}
+	added := sibling("new.go", "new\n")
+
+	params := gin.Params{{Key: "id", Value: checkpoint.ID.Hex()}}
+	if code := serveTest(cc.RestoreCheckpoint, http.MethodPost, params, collaborator, "").Code; code != http.StatusForbidden {
+		t.Errorf("restore by a collaborator answered %d, want 403", code)
+	}
+	if head := fileAt(t, db, changed.ID); head.Version != 2 {
+		t.Fatalf("refused restore moved the file to version %d", head.Version)
+	}
+
+	var response struct {
+		Restored []models.CheckpointFile `json:"restored"`
+		Added    []models.CheckpointFile `json:"added"`
+		Missing  []models.CheckpointFile `json:"missing"`
+	}
+	restore := func() {
+		t.Helper()
+		w := serveTest(cc.RestoreCheckpoint, http.MethodPost, params, host, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("restore answered %d: %s", w.Code, w.Body)
+		}
+		response.Restored, response.Added, response.Missing = nil, nil, nil
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore()
+
+	if len(response.Restored) != 1 || response.Restored[0].FileID != changed.ID || response.Restored[0].Version != 3 {
+		t.Errorf("restored %+v, want %s at version 3", response.Restored, changed.ID.Hex())
+	}
+	if len(response.Added) != 1 || response.Added[0].FileID != added.ID {
+		t.Errorf("added %+v, want %s", response.Added, added.ID.Hex())
+	}
+	if len(response.Missing) != 1 || response.Missing[0].FileID != deleted.ID {
+		t.Errorf("missing %+v, want %s", response.Missing, deleted.ID.Hex())
+	}
+
+	head := fileAt(t, db, changed.ID)
+	if head.Version != 3 || head.Content != "one\n" || head.LastEditedBy != host {
+		t.Errorf("changed file is at version %d with %q by %s", head.Version, head.Content, head.LastEditedBy.Hex())
+	}
+	version, err := loadFileVersion(ctx, cc.fileVersionCollection, changed.ID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Content != "one\n" || version.RestoredFrom != 1 || version.CheckpointID != checkpoint.ID {
+		t.Errorf("version 3 holds %q restored from %d by checkpoint %s", version.Content, version.RestoredFrom, version.CheckpointID.Hex())
+	}
+	for _, file := range []models.File{unchanged, added} {
+		if head := fileAt(t, db, file.ID); head.Version != 1 || head.Content != file.Content {
+			t.Errorf("%s is at version %d with %q, want it untouched", file.Name, head.Version, head.Content)
+		}
+	}
+
+	// Restoring again finds nothing to change
+	restore()
+	if len(response.Restored) != 0 {
+		t.Errorf("second restore changed %+v", response.Restored)
+	}
+	if head := fileAt(t, db, changed.ID); head.Version != 3 {
+		t.Errorf("second restore moved the file to version %d", head.Version)
+	}
+}
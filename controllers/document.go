@@ -0,0 +1,427 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+const (
+	// How long a document waits after the last edit before it is saved
+	documentFlushDelay = 2 * time.Second
+	// How long an untouched document stays in memory after it was saved
+	documentIdleTimeout = 10 * time.Minute
+	// How many applied operations are kept to transform late edits against
+	documentHistoryLimit = 500
+)
+
+// Errors returned while applying collaborative edits
+var (
+	errRevisionTooOld    = errors.New("revision is no longer available, resync the document")
+	errRevisionAhead     = errors.New("revision is ahead of the server")
+	errDocumentReloaded  = errors.New("document was reloaded since it was opened, resync the document")
+	errFileNotInSession  = errors.New("file does not belong to this session")
+	errFileKeepsChanging = errors.New("file keeps changing while the document is saved")
+)
+
+// Document is the server-authoritative state of a file being edited live.
+// Every accepted operation bumps the revision by one. Revisions count from
+// zero again whenever the file is loaded, so each load has its own epoch.
+type Document struct {
+	sync.Mutex
+	fileID       primitive.ObjectID
+	sessionID    primitive.ObjectID
+	epoch        string
+	content      string
+	revision     int
+	history      []utils.TextOperation // history[0] turned historyStart into historyStart+1
+	historyStart int
+
+	// The saved version the content was last merged with, and its content
+	baseVersion int
+	baseContent string
+
+	dirty        bool
+	closed       bool
+	lastEditor   primitive.ObjectID
+	lastActivity time.Time
+	flushTimer   *time.Timer
+}
+
+// DocumentManager loads files into live documents, applies operations to
+// them and writes the merged content back to the files collection. Changes
+// saved to a file from elsewhere are merged in and sent to the session room
+// as operations of the server's own.
+type DocumentManager struct {
+	sync.Mutex
+	docs                  map[primitive.ObjectID]*Document
+	fileCollection        *mongo.Collection
+	fileVersionCollection *mongo.Collection
+	folderCollection      *mongo.Collection
+	hub                   *Hub
+	saved                 func(ctx context.Context, fileID primitive.ObjectID) error
+}
+
+// NewDocumentManager creates a manager backed by the given database that
+// relays server-made edits through the hub
+func NewDocumentManager(db *mongo.Database, hub *Hub) *DocumentManager {
+	return &DocumentManager{
+		docs:                  make(map[primitive.ObjectID]*Document),
+		fileCollection:        db.Collection("files"),
+		fileVersionCollection: db.Collection("file_versions"),
+		folderCollection:      db.Collection("folders"),
+		hub:                   hub,
+	}
+}
+
+// OnSave sets a function called with every file the manager saves a new
+// version of, so other editors of the file can merge it in
+func (dm *DocumentManager) OnSave(saved func(ctx context.Context, fileID primitive.ObjectID) error) {
+	dm.saved = saved
+}
+
+// Open returns the live document for a file, loading it on first use. The
+// file must live in a folder of the given session.
+func (dm *DocumentManager) Open(ctx context.Context, fileID, sessionID primitive.ObjectID) (*Document, error) {
+	dm.Lock()
+	doc, ok := dm.docs[fileID]
+	dm.Unlock()
+	if ok {
+		if doc.sessionID != sessionID {
+			return nil, errFileNotInSession
+		}
+		return doc, nil
+	}
+
+	var file models.File
+	if err := dm.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	var folder models.Folder
+	if err := dm.folderCollection.FindOne(ctx, bson.M{"_id": file.FolderID}).Decode(&folder); err != nil {
+		return nil, err
+	}
+	if folder.SessionID != sessionID {
+		return nil, errFileNotInSession
+	}
+
+	dm.Lock()
+	defer dm.Unlock()
+
+	// Another connection may have loaded it while we were reading
+	if doc, ok := dm.docs[fileID]; ok {
+		if doc.sessionID != sessionID {
+			return nil, errFileNotInSession
+		}
+		return doc, nil
+	}
+	doc = &Document{
+		fileID:       fileID,
+		sessionID:    sessionID,
+		epoch:        primitive.NewObjectID().Hex(),
+		content:      file.Content,
+		baseVersion:  file.Version,
+		baseContent:  file.Content,
+		lastActivity: time.Now(),
+	}
+	dm.docs[fileID] = doc
+	return doc, nil
+}
+
+// Snapshot returns the current content together with its epoch and revision
+func (d *Document) Snapshot() (string, string, int) {
+	d.Lock()
+	defer d.Unlock()
+	return d.content, d.epoch, d.revision
+}
+
+// Apply transforms an operation made against the given epoch and revision
+// over every operation accepted since, applies it and hands the result to
+// publish while the document is still locked so peers see operations in
+// revision order.
+func (dm *DocumentManager) Apply(doc *Document, epoch string, revision int, op utils.TextOperation, editor primitive.ObjectID, publish func(op utils.TextOperation, revision int)) error {
+	doc.Lock()
+	defer doc.Unlock()
+
+	if doc.closed {
+		return errRevisionTooOld
+	}
+	if epoch != doc.epoch {
+		return errDocumentReloaded
+	}
+	if revision > doc.revision {
+		return errRevisionAhead
+	}
+	if revision < doc.historyStart {
+		return errRevisionTooOld
+	}
+
+	for _, concurrent := range doc.history[revision-doc.historyStart:] {
+		transformed, _, err := utils.Transform(op, concurrent)
+		if err != nil {
+			return err
+		}
+		op = transformed
+	}
+
+	content, err := op.Apply(doc.content)
+	if err != nil {
+		return err
+	}
+
+	doc.push(op, content)
+	doc.dirty = true
+	doc.lastEditor = editor
+	dm.scheduleFlush(doc)
+
+	publish(op, doc.revision)
+	return nil
+}
+
+// push records an applied operation and the content it led to; the
+// document lock must be held
+func (d *Document) push(op utils.TextOperation, content string) {
+	d.content = content
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > documentHistoryLimit {
+		drop := len(d.history) - documentHistoryLimit
+		d.history = d.history[drop:]
+		d.historyStart += drop
+	}
+	d.lastActivity = time.Now()
+}
+
+// replace changes the content by an operation of the server's own and sends
+// it to the session room, where clients apply it like a peer's edit; the
+// document lock must be held
+func (dm *DocumentManager) replace(doc *Document, content string) {
+	op := utils.DiffOperation(doc.content, content)
+	if op.IsNoop() {
+		return
+	}
+	doc.push(op, content)
+	dm.hub.Broadcast(newEnvelope(MessageOp, doc.sessionID.Hex(), "", OpPayload{
+		FileID:    doc.fileID.Hex(),
+		Epoch:     doc.epoch,
+		Revision:  doc.revision,
+		Operation: &op,
+	}))
+}
+
+// rebase merges a version of the file saved from elsewhere into the
+// document; the document lock must be held. Where both changed the same
+// lines the live edits are kept, as they are what everyone is looking at;
+// the session is told about the clash and the other version stays in the
+// history.
+func (dm *DocumentManager) rebase(doc *Document, file models.File) {
+	if file.Version <= doc.baseVersion {
+		return
+	}
+	merged, conflicts := utils.MergeText(doc.baseContent, doc.content, file.Content)
+	if len(conflicts) > 0 {
+		dm.hub.Broadcast(newEnvelope(MessageConflict, doc.sessionID.Hex(), "", ConflictPayload{
+			FileID:    doc.fileID.Hex(),
+			Version:   file.Version,
+			Conflicts: conflicts,
+		}))
+		merged = doc.content
+	}
+	doc.baseVersion, doc.baseContent = file.Version, file.Content
+	dm.replace(doc, merged)
+	doc.dirty = doc.content != doc.baseContent
+}
+
+// Refresh merges the saved content of a file into its live document, if
+// it is open, after the file was saved from elsewhere
+func (dm *DocumentManager) Refresh(ctx context.Context, fileID primitive.ObjectID) error {
+	dm.Lock()
+	doc, ok := dm.docs[fileID]
+	dm.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var file models.File
+	if err := dm.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return err
+	}
+
+	doc.Lock()
+	defer doc.Unlock()
+	if doc.closed {
+		return nil
+	}
+	dm.rebase(doc, file)
+	if doc.dirty {
+		dm.scheduleFlush(doc)
+	}
+	return nil
+}
+
+// RefreshSession brings every open document of a session up to date with
+// its file, after another server instance may have edited the session
+func (dm *DocumentManager) RefreshSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	dm.Lock()
+	var fileIDs []primitive.ObjectID
+	for fileID, doc := range dm.docs {
+		if doc.sessionID == sessionID {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	dm.Unlock()
+
+	for _, fileID := range fileIDs {
+		if err := dm.Refresh(ctx, fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset replaces the content of a file's live document, if it is open, with
+// the content saved to the file. Unsaved live edits are dropped rather than
+// merged, as the file was rolled back to an old version on purpose.
+func (dm *DocumentManager) Reset(ctx context.Context, fileID primitive.ObjectID) error {
+	dm.Lock()
+	doc, ok := dm.docs[fileID]
+	dm.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var file models.File
+	if err := dm.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return err
+	}
+
+	doc.Lock()
+	defer doc.Unlock()
+	if doc.closed || file.Version <= doc.baseVersion {
+		return nil
+	}
+	doc.baseVersion, doc.baseContent = file.Version, file.Content
+	dm.replace(doc, file.Content)
+	doc.dirty = false
+	return nil
+}
+
+// scheduleFlush (re)arms the save timer; the document lock must be held
+func (dm *DocumentManager) scheduleFlush(doc *Document) {
+	if doc.flushTimer != nil {
+		doc.flushTimer.Stop()
+	}
+	doc.flushTimer = time.AfterFunc(documentFlushDelay, func() {
+		dm.flush(doc)
+	})
+}
+
+// flush saves a dirty document as a new file version and unloads documents
+// that have been idle for a while
+func (dm *DocumentManager) flush(doc *Document) {
+	doc.Lock()
+	defer doc.Unlock()
+
+	if doc.dirty {
+		if err := dm.save(doc); err != nil {
+			log.Println("Error saving document:", err)
+			dm.scheduleFlush(doc)
+			return
+		}
+		doc.dirty = false
+	}
+
+	if time.Since(doc.lastActivity) < documentIdleTimeout {
+		doc.flushTimer = time.AfterFunc(documentIdleTimeout, func() {
+			dm.flush(doc)
+		})
+		return
+	}
+
+	doc.closed = true
+	dm.Lock()
+	delete(dm.docs, doc.fileID)
+	dm.Unlock()
+}
+
+// save writes the document content to the files collection and records the
+// new version, in one transaction; the document lock must be held. The write only succeeds
+// against the version the content was based on; a newer one saved from
+// elsewhere is merged in first.
+func (dm *DocumentManager) save(doc *Document) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		now := time.Now()
+		version := models.FileVersion{
+			ID:       primitive.NewObjectID(),
+			FileID:   doc.fileID,
+			Content:  doc.content,
+			Version:  doc.baseVersion + 1,
+			EditedBy: doc.lastEditor,
+			EditedAt: now,
+		}
+		err := runTransaction(ctx, dm.fileCollection.Database().Client(), func(sc mongo.SessionContext) error {
+			result, err := dm.fileCollection.UpdateOne(sc,
+				bson.M{"_id": doc.fileID, "version": doc.baseVersion},
+				bson.M{"$set": bson.M{
+					"content":        doc.content,
+					"version":        version.Version,
+					"updated_at":     now,
+					"last_edited_by": doc.lastEditor,
+				}},
+			)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errFileChanged
+			}
+			return recordFileVersion(sc, dm.fileVersionCollection, version, doc.baseContent)
+		})
+		if err == nil {
+			doc.baseVersion, doc.baseContent = version.Version, doc.content
+			notifySaved(dm.saved, doc.fileID)
+			return nil
+		}
+		if err != errFileChanged && !isTransientTransactionError(err) {
+			return err
+		}
+
+		var file models.File
+		if err := dm.fileCollection.FindOne(ctx, bson.M{"_id": doc.fileID}).Decode(&file); err != nil {
+			return err
+		}
+		dm.rebase(doc, file)
+		if !doc.dirty {
+			return nil
+		}
+	}
+	return errFileKeepsChanging
+}
+
+// notifySaved runs a manager's save hook for a file in the background, as
+// the hook locks documents of another manager
+func notifySaved(saved func(ctx context.Context, fileID primitive.ObjectID) error, fileID primitive.ObjectID) {
+	if saved == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := saved(ctx, fileID); err != nil {
+			log.Printf("Error merging saved file %s into other editors: %v", fileID.Hex(), err)
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// recordingBroker is an in-process broker that keeps what is published
+type recordingBroker struct {
+	*MemoryBroker
+	mu        sync.Mutex
+	published []Envelope
+}
+
+func (b *recordingBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	var env Envelope
+	if err := json.Unmarshal(msg.Data, &env); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.published = append(b.published, env)
+	b.mu.Unlock()
+	return b.MemoryBroker.Publish(ctx, msg)
+}
+
+// sent returns the published frames of one type
+func (b *recordingBroker) sent(msgType string) []Envelope {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var envs []Envelope
+	for _, env := range b.published {
+		if env.Type == msgType {
+			envs = append(envs, env)
+		}
+	}
+	return envs
+}
+
+// testDocument is a loaded document that is never saved; the flush timers
+// Apply arms are stopped when the test ends. What the manager broadcasts is
+// kept by the returned broker.
+func testDocument(t *testing.T, content string) (*DocumentManager, *Document, *recordingBroker) {
+	doc := &Document{
+		fileID:      primitive.NewObjectID(),
+		sessionID:   primitive.NewObjectID(),
+		epoch:       primitive.NewObjectID().Hex(),
+		content:     content,
+		baseContent: content,
+	}
+	t.Cleanup(func() {
+		doc.Lock()
+		defer doc.Unlock()
+		if doc.flushTimer != nil {
+			doc.flushTimer.Stop()
+		}
+	})
+	broker := &recordingBroker{MemoryBroker: NewMemoryBroker()}
+	dm := &DocumentManager{
+		docs: map[primitive.ObjectID]*Document{doc.fileID: doc},
+		hub:  NewHub(config.WebSocketConfig{}, broker),
+	}
+	return dm, doc, broker
+}
+
+func TestApplyTransformsLateOperations(t *testing.T) {
+	dm, doc, _ := testDocument(t, "hello world")
+	editor := primitive.NewObjectID()
+
+	var published []int
+	publish := func(op utils.TextOperation, revision int) { published = append(published, revision) }
+
+	// Both edits are made against revision 0; the second is transformed over
+	// the first
+	first := utils.DiffOperation("hello world", "hello, world")
+	if err := dm.Apply(doc, doc.epoch, 0, first, editor, publish); err != nil {
+		t.Fatalf("first edit: %v", err)
+	}
+	second := utils.DiffOperation("hello world", "hello world!")
+	if err := dm.Apply(doc, doc.epoch, 0, second, editor, publish); err != nil {
+		t.Fatalf("second edit: %v", err)
+	}
+
+	content, _, revision := doc.Snapshot()
+	if content != "hello, world!" {
+		t.Errorf("got content %q, want %q", content, "hello, world!")
+	}
+	if revision != 2 || len(published) != 2 || published[0] != 1 || published[1] != 2 {
+		t.Errorf("got revision %d and published %v, want 2 and [1 2]", revision, published)
+	}
+	if !doc.dirty || doc.lastEditor != editor {
+		t.Error("document is not marked for saving by the editor")
+	}
+}
+
+func TestApplyRejectsStaleEdits(t *testing.T) {
+	tests := []struct {
+		name     string
+		epoch    func(doc *Document) string
+		revision int
+		want     error
+	}{
+		{
+			name:     "epoch of an earlier load",
+			epoch:    func(doc *Document) string { return primitive.NewObjectID().Hex() },
+			revision: 0,
+			want:     errDocumentReloaded,
+		},
+		{
+			name:     "revision ahead",
+			epoch:    func(doc *Document) string { return doc.epoch },
+			revision: 5,
+			want:     errRevisionAhead,
+		},
+		{
+			name:     "revision dropped from the history",
+			epoch:    func(doc *Document) string { return doc.epoch },
+			revision: 0,
+			want:     errRevisionTooOld,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm, doc, _ := testDocument(t, "abc")
+			// The history starts after revision 1 as if older entries had
+			// been dropped
+			doc.revision, doc.historyStart = 1, 1
+
+			op := utils.DiffOperation("abc", "abcd")
+			err := dm.Apply(doc, tt.epoch(doc), tt.revision, op, primitive.NewObjectID(), func(utils.TextOperation, int) {
+				t.Error("a rejected edit was published")
+			})
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if content, _, _ := doc.Snapshot(); content != "abc" {
+				t.Errorf("a rejected edit changed the content to %q", content)
+			}
+		})
+	}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		name      string
+		live      string
+		saved     string
+		want      string
+		conflicts int
+	}{
+		{name: "changes apart", live: "A\nb\nc\n", saved: "a\nb\nC\n", want: "A\nb\nC\n"},
+		{name: "same line changed", live: "a\nB\nc\n", saved: "a\nX\nc\n", want: "a\nB\nc\n", conflicts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm, doc, broker := testDocument(t, "a\nb\nc\n")
+			doc.content = tt.live
+
+			dm.rebase(doc, models.File{Content: tt.saved, Version: 1})
+
+			if doc.content != tt.want {
+				t.Errorf("got content %q, want %q", doc.content, tt.want)
+			}
+			if doc.baseVersion != 1 || doc.baseContent != tt.saved {
+				t.Errorf("based on version %d with %q, want version 1 with %q", doc.baseVersion, doc.baseContent, tt.saved)
+			}
+
+			sent := broker.sent(MessageConflict)
+			if len(sent) != min(tt.conflicts, 1) {
+				t.Fatalf("got %d conflict frames, want %d", len(sent), min(tt.conflicts, 1))
+			}
+			if tt.conflicts == 0 {
+				return
+			}
+			var payload ConflictPayload
+			if err := json.Unmarshal(sent[0].Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.FileID != doc.fileID.Hex() || payload.Version != 1 || len(payload.Conflicts) != tt.conflicts {
+				t.Errorf("got conflict %+v for file %s version 1", payload, doc.fileID.Hex())
+			}
+		})
+	}
+}
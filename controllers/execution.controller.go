@@ -0,0 +1,778 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// Largest stdin payload accepted with an execution
+const maxStdinBytes = 1 << 20
+
+// Page sizes for execution history
+const (
+	defaultExecutionPage = 20
+	maxExecutionPage     = 100
+)
+
+type ExecutionController struct {
+	executionCollection    *mongo.Collection
+	fileCollection         *mongo.Collection
+	folderCollection       *mongo.Collection
+	sessionCollection      *mongo.Collection
+	collaboratorCollection *mongo.Collection
+	testCaseCollection     *mongo.Collection
+	testRunCollection      *mongo.Collection
+	queue                  *ExecutionQueue
+}
+
+// Constructor for ExecutionController
+func NewExecutionController(db *mongo.Database, queue *ExecutionQueue) *ExecutionController {
+	return &ExecutionController{
+		executionCollection:    db.Collection("code_executions"),
+		fileCollection:         db.Collection("files"),
+		folderCollection:       db.Collection("folders"),
+		sessionCollection:      db.Collection("sessions"),
+		collaboratorCollection: db.Collection("collaborators"),
+		testCaseCollection:     db.Collection("test_cases"),
+		testRunCollection:      db.Collection("test_runs"),
+		queue:                  queue,
+	}
+}
+
+// executionTarget is the code a run request points at: a file, or a folder
+// run as a project with an optional entrypoint
+type executionTarget struct {
+	FileID     primitive.ObjectID `json:"file_id"`
+	FolderID   primitive.ObjectID `json:"folder_id"`
+	Entrypoint string             `json:"entrypoint"`
+	SessionID  primitive.ObjectID `json:"session_id" binding:"required"`
+}
+
+// CreateExecution queues a run of a file's current content, or of a whole
+// folder as a multi-file project
+func (ec *ExecutionController) CreateExecution(c *gin.Context) {
+	var request struct {
+		executionTarget
+		Stdin       string `json:"stdin"`
+		Interactive bool   `json:"interactive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Stdin) > maxStdinBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stdin is too large"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	execution, ok := ec.prepareExecution(c, ctx, userID, request.executionTarget)
+	if !ok {
+		return
+	}
+	execution.Stdin = request.Stdin
+	execution.Interactive = request.Interactive
+
+	if !ec.enqueue(c, ctx, execution) {
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Execution queued", "execution": execution})
+}
+
+// prepareExecution checks the user may run the target and snapshots its
+// code into a new execution. It writes the error response itself and returns
+// false when the target cannot be run.
+func (ec *ExecutionController) prepareExecution(c *gin.Context, ctx context.Context, userID primitive.ObjectID, target executionTarget) (models.CodeExecution, bool) {
+	if target.FileID.IsZero() && target.FolderID.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_id or folder_id is required"})
+		return models.CodeExecution{}, false
+	}
+	if !requireSessionMember(c, ec.sessionCollection, ec.collaboratorCollection, target.SessionID, userID) {
+		return models.CodeExecution{}, false
+	}
+	hostID, err := sessionHost(ctx, ec.sessionCollection, target.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve session"})
+		return models.CodeExecution{}, false
+	}
+
+	execution := models.CodeExecution{
+		ID:         primitive.NewObjectID(),
+		UserID:     userID,
+		SessionID:  target.SessionID,
+		FileID:     target.FileID,
+		HostUserID: hostID,
+		Status:     models.StatusQueued,
+		CreatedAt:  time.Now(),
+	}
+
+	var file models.File
+	if target.FolderID.IsZero() {
+		if err := ec.fileCollection.FindOne(ctx, bson.M{"_id": target.FileID}).Decode(&file); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return models.CodeExecution{}, false
+		}
+		sessionID, err := fileSessionID(ctx, ec.fileCollection, ec.folderCollection, target.FileID)
+		if err != nil || sessionID != target.SessionID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File does not belong to this session"})
+			return models.CodeExecution{}, false
+		}
+		execution.SourceCode = file.Content
+		execution.FileVersion = file.Version
+	} else {
+		var ok bool
+		if file, ok = ec.prepareProject(c, ctx, &execution, target.FolderID, target.Entrypoint); !ok {
+			return models.CodeExecution{}, false
+		}
+	}
+
+	language, err := ec.executionLanguage(ctx, file, target.SessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return models.CodeExecution{}, false
+	}
+	execution.Language = models.SessionLanguage(language.Name)
+	execution.LanguageVersion = language.Version
+	return execution, true
+}
+
+// enqueue hands executions to the queue, writing the error response when it
+// turns them away
+func (ec *ExecutionController) enqueue(c *gin.Context, ctx context.Context, executions ...models.CodeExecution) bool {
+	err := ec.queue.Enqueue(ctx, executions...)
+	if err == errQueueFull {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Execution queue is full, try again shortly"})
+		return false
+	}
+	if err == errUserQueueFull {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many executions waiting, wait for one to finish"})
+		return false
+	}
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		retryAfter := max(int(math.Ceil(time.Until(quota.ResetAt).Seconds())), 1)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":    quota.Error(),
+			"scope":    quota.Scope,
+			"quota":    quota.Quota,
+			"limit":    quota.Limit,
+			"reset_at": quota.ResetAt,
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue execution"})
+		return false
+	}
+	return true
+}
+
+// prepareProject snapshots every file of a folder into the execution. The
+// entrypoint is execution.FileID if set, else the file at the entrypoint
+// path, else whichever file the language runs by default; the entry file is
+// returned when known. It writes the error response itself and returns false
+// when the folder cannot be run.
+func (ec *ExecutionController) prepareProject(c *gin.Context, ctx context.Context, execution *models.CodeExecution, folderID primitive.ObjectID, entrypoint string) (models.File, bool) {
+	var folder models.Folder
+	if err := ec.folderCollection.FindOne(ctx, bson.M{"_id": folderID}).Decode(&folder); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return models.File{}, false
+	}
+	if folder.SessionID != execution.SessionID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder does not belong to this session"})
+		return models.File{}, false
+	}
+
+	filter := bson.M{"folder_id": folderID}
+	if len(folder.FileIDs) > 0 {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"_id": bson.M{"$in": folder.FileIDs}}}}
+	}
+	cursor, err := ec.fileCollection.Find(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+		return models.File{}, false
+	}
+	var files []models.File
+	if err := cursor.All(ctx, &files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode files"})
+		return models.File{}, false
+	}
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder has no files"})
+		return models.File{}, false
+	}
+	if len(files) > ec.queue.config.MaxProjectFiles {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Folder has too many files to run"})
+		return models.File{}, false
+	}
+
+	if entrypoint != "" {
+		cleaned, err := utils.CleanProjectPath(entrypoint)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return models.File{}, false
+		}
+		entrypoint = cleaned
+	}
+
+	var entry models.File
+	var size int64
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		path, err := utils.CleanProjectPath(file.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return models.File{}, false
+		}
+		if seen[path] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Folder has two files named " + path})
+			return models.File{}, false
+		}
+		seen[path] = true
+
+		size += int64(len(file.Content))
+		if size > ec.queue.config.MaxProjectBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Folder is too large to run"})
+			return models.File{}, false
+		}
+
+		if file.ID == execution.FileID || (execution.FileID.IsZero() && path == entrypoint) {
+			entry = file
+			execution.Entrypoint = path
+		}
+		execution.Sources = append(execution.Sources, models.SourceFile{FileID: file.ID, Path: path, Content: file.Content, Version: file.Version})
+	}
+
+	if !execution.FileID.IsZero() && entry.ID.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entrypoint file is not in this folder"})
+		return models.File{}, false
+	}
+	if entrypoint != "" && entry.ID.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file named " + entrypoint + " in this folder"})
+		return models.File{}, false
+	}
+
+	execution.FolderID = folderID
+	execution.FileID = entry.ID
+	execution.SourceCode = entry.Content
+	execution.FileVersion = entry.Version
+	return entry, true
+}
+
+// GetExecution reports the status and output of an execution
+func (ec *ExecutionController) GetExecution(c *gin.Context) {
+	executionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid execution ID"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var execution models.CodeExecution
+	err = ec.executionCollection.FindOne(context.Background(), bson.M{"_id": executionID}).Decode(&execution)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Execution not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve execution"})
+		return
+	}
+
+	if !requireSessionMember(c, ec.sessionCollection, ec.collaboratorCollection, execution.SessionID, userID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	executions := []models.CodeExecution{execution}
+	ec.redactExecutions(ctx, userID, executions)
+	c.JSON(http.StatusOK, executions[0])
+}
+
+// ListExecutions pages through past executions, newest first. It filters
+// by file_id, session_id and user_id, and by status as a comma separated
+// list. Without a file or session only the caller's own executions are
+// listed. Output and code are left out; GetExecution has them.
+func (ec *ExecutionController) ListExecutions(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultExecutionPage)))
+	if err != nil || limit < 1 || limit > maxExecutionPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxExecutionPage)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	ids := map[string]primitive.ObjectID{}
+	for _, key := range []string{"file_id", "session_id", "user_id"} {
+		value := c.Query(key)
+		if value == "" {
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + key})
+			return
+		}
+		ids[key] = id
+		filter[key] = id
+	}
+
+	// Access follows the session the executions belong to
+	sessionID, scoped := ids["session_id"]
+	if fileID, ok := ids["file_id"]; ok && !scoped {
+		sessionID, err = fileSessionID(ctx, ec.fileCollection, ec.folderCollection, fileID)
+		if err != nil {
+			// The file may be gone; its executions still name their session
+			var execution models.CodeExecution
+			if err := ec.executionCollection.FindOne(ctx, bson.M{"file_id": fileID}).Decode(&execution); err != nil {
+				c.JSON(http.StatusOK, gin.H{"executions": []models.CodeExecution{}, "total": 0, "page": page, "limit": limit})
+				return
+			}
+			sessionID = execution.SessionID
+		}
+		filter["session_id"] = sessionID
+		scoped = true
+	}
+	if scoped {
+		if !requireSessionMember(c, ec.sessionCollection, ec.collaboratorCollection, sessionID, userID) {
+			return
+		}
+	} else if other, ok := ids["user_id"]; ok && other != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Other users' executions are listed per session"})
+		return
+	} else {
+		filter["user_id"] = userID
+	}
+
+	if statuses := c.Query("status"); statuses != "" {
+		var in bson.A
+		for _, status := range strings.Split(statuses, ",") {
+			switch models.CodeExecutionStatus(status) {
+			case models.StatusQueued, models.StatusRunning, models.StatusCompleted, models.StatusFailed, models.StatusTimedOut:
+				in = append(in, status)
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status " + status})
+				return
+			}
+		}
+		filter["status"] = bson.M{"$in": in}
+	}
+
+	total, err := ec.executionCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count executions"})
+		return
+	}
+	cursor, err := ec.executionCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64((page-1)*limit)).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"source_code": 0, "sources": 0, "stdin": 0, "output": 0, "transcript": 0}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve executions"})
+		return
+	}
+	executions := []models.CodeExecution{}
+	if err := cursor.All(ctx, &executions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode executions"})
+		return
+	}
+	ec.redactExecutions(ctx, userID, executions)
+
+	c.JSON(http.StatusOK, gin.H{"executions": executions, "total": total, "page": page, "limit": limit})
+}
+
+// RerunExecution queues a past execution again with the code and input it
+// ran with, whatever has happened to the files since. The body may give new
+// stdin or ask for an interactive run.
+func (ec *ExecutionController) RerunExecution(c *gin.Context) {
+	executionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid execution ID"})
+		return
+	}
+
+	var request struct {
+		Stdin       *string `json:"stdin"`
+		Interactive bool    `json:"interactive"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Stdin != nil && len(*request.Stdin) > maxStdinBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stdin is too large"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var past models.CodeExecution
+	err = ec.executionCollection.FindOne(ctx, bson.M{"_id": executionID}).Decode(&past)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Execution not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve execution"})
+		return
+	}
+	if !requireSessionMember(c, ec.sessionCollection, ec.collaboratorCollection, past.SessionID, userID) {
+		return
+	}
+	// Its output would give away a hidden case's input
+	if !past.TestCaseID.IsZero() && !requireSessionHost(c, ec.sessionCollection, past.SessionID, userID) {
+		return
+	}
+
+	hostID, err := sessionHost(ctx, ec.sessionCollection, past.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve session"})
+		return
+	}
+
+	execution := models.CodeExecution{
+		ID:             primitive.NewObjectID(),
+		UserID:         userID,
+		SessionID:      past.SessionID,
+		FileID:         past.FileID,
+		FolderID:       past.FolderID,
+		HostUserID:     hostID,
+		Language:       past.Language,
+		SourceCode:     past.SourceCode,
+		FileVersion:    past.FileVersion,
+		Entrypoint:     past.Entrypoint,
+		Sources:        past.Sources,
+		Stdin:          past.Stdin,
+		Interactive:    request.Interactive,
+		TestCaseID:     past.TestCaseID,
+		HiddenTestCase: past.HiddenTestCase,
+		TimeLimit:      past.TimeLimit,
+		RerunOf:        past.ID,
+		Status:         models.StatusQueued,
+		CreatedAt:      time.Now(),
+	}
+	if request.Stdin != nil {
+		execution.Stdin = *request.Stdin
+	}
+	// The case may have been hidden since it last ran
+	if !past.TestCaseID.IsZero() && !past.HiddenTestCase {
+		var testCase models.TestCase
+		err := ec.testCaseCollection.FindOne(ctx, bson.M{"_id": past.TestCaseID}).Decode(&testCase)
+		execution.HiddenTestCase = err != nil || testCase.Hidden
+	}
+	// The toolchain may have changed since; record the one that will run
+	language, ok := ec.queue.languages.Lookup(string(past.Language))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: %q", utils.ErrUnsupportedLanguage, past.Language)})
+		return
+	}
+	execution.LanguageVersion = language.Version
+
+	if !ec.enqueue(c, ctx, execution) {
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Execution queued", "execution": execution})
+}
+
+// executionLanguage picks the file's language, or the one its extension
+// says, falling back to the session's
+func (ec *ExecutionController) executionLanguage(ctx context.Context, file models.File, sessionID primitive.ObjectID) (config.LanguageConfig, error) {
+	name := file.Language
+	if name == "" {
+		if detected, ok := ec.queue.languages.Detect(file.Name); ok {
+			return detected, nil
+		}
+		var session models.Session
+		if err := ec.sessionCollection.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session); err != nil {
+			return config.LanguageConfig{}, err
+		}
+		name = string(session.Language)
+	}
+
+	language, ok := ec.queue.languages.Lookup(name)
+	if !ok {
+		return config.LanguageConfig{}, fmt.Errorf("%w: %q", utils.ErrUnsupportedLanguage, name)
+	}
+	return language, nil
+}
+
+// GetUsage reports how much of their execution quota the user has used, and
+// how much the sessions they host have
+func (ec *ExecutionController) GetUsage(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, host, err := ec.queue.Usage(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "host": host})
+}
+
+// GetQueueStats reports the depth of the execution queue and wait times
+func (ec *ExecutionController) GetQueueStats(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats, err := ec.queue.Stats(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve queue stats"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// RunTests runs a file or folder against every test case of its session
+// that applies to it. Each case is queued as an execution of its own and
+// graded as it finishes; progress is reported to the session room and the
+// test run can be fetched for the verdicts.
+func (ec *ExecutionController) RunTests(c *gin.Context) {
+	var target executionTarget
+	if err := c.ShouldBindJSON(&target); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	base, ok := ec.prepareExecution(c, ctx, userID, target)
+	if !ok {
+		return
+	}
+
+	// Cases of the whole session and of the file being run
+	cursor, err := ec.testCaseCollection.Find(ctx,
+		bson.M{"session_id": target.SessionID, "file_id": bson.M{"$in": bson.A{base.FileID, nil}}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve test cases"})
+		return
+	}
+	var testCases []models.TestCase
+	if err := cursor.All(ctx, &testCases); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode test cases"})
+		return
+	}
+	if len(testCases) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No test cases apply to this code"})
+		return
+	}
+	if len(testCases) > ec.queue.config.MaxTestCases {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many test cases to run at once"})
+		return
+	}
+
+	run := models.TestRun{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		SessionID: target.SessionID,
+		FileID:    base.FileID,
+		FolderID:  base.FolderID,
+		Status:    models.StatusRunning,
+		CreatedAt: time.Now(),
+	}
+	executions := make([]models.CodeExecution, len(testCases))
+	for i, testCase := range testCases {
+		execution := base
+		execution.ID = primitive.NewObjectID()
+		execution.Stdin = testCase.Stdin
+		execution.TestRunID = run.ID
+		execution.TestCaseID = testCase.ID
+		execution.HiddenTestCase = testCase.Hidden
+		execution.TimeLimit = testCase.TimeLimit
+		executions[i] = execution
+
+		run.Results = append(run.Results, models.TestResult{
+			TestCaseID:     testCase.ID,
+			ExecutionID:    execution.ID,
+			Name:           testCase.Name,
+			Hidden:         testCase.Hidden,
+			Status:         models.TestPending,
+			Points:         testCase.Points,
+			ExpectedOutput: testCase.ExpectedOutput,
+		})
+		run.MaxScore += testCase.Points
+	}
+
+	// The run must exist before any of its executions can finish
+	if _, err := ec.testRunCollection.InsertOne(ctx, run); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create test run"})
+		return
+	}
+	if !ec.enqueue(c, ctx, executions...) {
+		ec.testRunCollection.DeleteOne(ctx, bson.M{"_id": run.ID})
+		return
+	}
+
+	ec.redactTestRun(ctx, &run, userID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Test run queued", "test_run": run})
+}
+
+// GetTestRun reports the verdicts and score of a test run
+func (ec *ExecutionController) GetTestRun(c *gin.Context) {
+	runID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid test run ID"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var run models.TestRun
+	err = ec.testRunCollection.FindOne(ctx, bson.M{"_id": runID}).Decode(&run)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Test run not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve test run"})
+		return
+	}
+	if !requireSessionMember(c, ec.sessionCollection, ec.collaboratorCollection, run.SessionID, userID) {
+		return
+	}
+
+	ec.redactTestRun(ctx, &run, userID)
+	c.JSON(http.StatusOK, run)
+}
+
+// redactExecutions strips the input and output of runs of hidden test cases,
+// or of cases that are gone, unless the user hosts their session
+func (ec *ExecutionController) redactExecutions(ctx context.Context, userID primitive.ObjectID, executions []models.CodeExecution) {
+	var caseIDs []primitive.ObjectID
+	for _, execution := range executions {
+		if !execution.TestCaseID.IsZero() {
+			caseIDs = append(caseIDs, execution.TestCaseID)
+		}
+	}
+	if len(caseIDs) == 0 {
+		return
+	}
+
+	// Cases may have been hidden after the run, so look at how they are now
+	visible := make(map[primitive.ObjectID]bool)
+	cursor, err := ec.testCaseCollection.Find(ctx,
+		bson.M{"_id": bson.M{"$in": caseIDs}, "hidden": false},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err == nil {
+		var testCases []models.TestCase
+		if cursor.All(ctx, &testCases) == nil {
+			for _, testCase := range testCases {
+				visible[testCase.ID] = true
+			}
+		}
+	}
+
+	hosts := make(map[primitive.ObjectID]bool)
+	for i := range executions {
+		execution := &executions[i]
+		if execution.TestCaseID.IsZero() || (visible[execution.TestCaseID] && !execution.HiddenTestCase) {
+			continue
+		}
+		host, ok := hosts[execution.SessionID]
+		if !ok {
+			host, err = isSessionHost(ctx, ec.sessionCollection, execution.SessionID, userID)
+			host = err == nil && host
+			hosts[execution.SessionID] = host
+		}
+		if host {
+			continue
+		}
+		execution.Stdin = ""
+		execution.Output = ""
+		execution.ErrorMessage = ""
+		execution.Transcript = nil
+		execution.Diagnostics = nil
+	}
+}
+
+// redactTestRun strips the expected output and diff of hidden cases unless
+// the user hosts the session
+func (ec *ExecutionController) redactTestRun(ctx context.Context, run *models.TestRun, userID primitive.ObjectID) {
+	if host, err := isSessionHost(ctx, ec.sessionCollection, run.SessionID, userID); err == nil && host {
+		return
+	}
+	for i := range run.Results {
+		if run.Results[i].Hidden {
+			run.Results[i].ExpectedOutput = ""
+			run.Results[i].Diff = ""
+		}
+	}
+}
@@ -0,0 +1,734 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// Errors returned by Enqueue when a job is turned away
+var (
+	errQueueFull     = errors.New("execution queue is full")
+	errUserQueueFull = errors.New("too many queued executions")
+)
+
+// Errors returned by SendInput
+var (
+	errExecutionNotRunning = errors.New("execution is not running")
+	errNotExecutionOwner   = errors.New("only the user who started the execution can send it input")
+	errInputBacklog        = errors.New("program is not reading its input")
+)
+
+// Input frames buffered for an interactive program that is not reading
+const interactiveInputBacklog = 64
+
+// ExecutionQueueStats describes the backlog of the execution queue
+type ExecutionQueueStats struct {
+	Queued      int64         `json:"queued"`
+	Running     int64         `json:"running"`
+	Workers     int           `json:"workers"`
+	OldestWait  time.Duration `json:"oldest_wait"`
+	AverageWait time.Duration `json:"average_wait"`
+}
+
+// ExecutionQueue runs code executions stored in the code_executions
+// collection. Workers claim queued jobs atomically, so several server
+// instances can share the queue; a job whose worker stops renewing its lease
+// is put back in the queue.
+type ExecutionQueue struct {
+	executionCollection *mongo.Collection
+	quotaCollection     *mongo.Collection
+	testRunCollection   *mongo.Collection
+	config              config.ExecutionConfig
+	limits              utils.SandboxLimits
+	workerID            string
+	wake                chan struct{}
+	hub                 *Hub
+	languages           *utils.LanguageRegistry
+
+	// Interactive executions running on this instance
+	inputsMu sync.Mutex
+	inputs   map[primitive.ObjectID]*interactiveInput
+}
+
+// NewExecutionQueue creates the queue and starts its workers, which run code
+// with the toolchains of the registry and report progress to the session
+// rooms of the hub
+func NewExecutionQueue(db *mongo.Database, cfg config.ExecutionConfig, hub *Hub, languages *utils.LanguageRegistry) *ExecutionQueue {
+	eq := &ExecutionQueue{
+		executionCollection: db.Collection("code_executions"),
+		quotaCollection:     db.Collection("execution_quotas"),
+		testRunCollection:   db.Collection("test_runs"),
+		config:              cfg,
+		limits: utils.SandboxLimits{
+			WallTime:       cfg.WallTime,
+			CPUTime:        cfg.CPUTime,
+			CompileTime:    cfg.CompileTime,
+			MemoryBytes:    cfg.MemoryBytes,
+			MaxProcesses:   cfg.MaxProcesses,
+			MaxOutputBytes: cfg.MaxOutputBytes,
+			MaxFileBytes:   cfg.MaxFileBytes,
+		},
+		workerID:  primitive.NewObjectID().Hex(),
+		wake:      make(chan struct{}, cfg.Workers),
+		hub:       hub,
+		languages: languages,
+		inputs:    make(map[primitive.ObjectID]*interactiveInput),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := eq.executionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "lease_expires_at", Value: 1}}},
+		// Execution history
+		{Keys: bson.D{{Key: "session_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		// Quotas of session hosts
+		{Keys: bson.D{{Key: "host_user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Println("Error creating execution indexes:", err)
+	}
+
+	hub.Handle(brokerKindExecInput, eq.deliverInput)
+
+	for i := 0; i < cfg.Workers; i++ {
+		go eq.work()
+	}
+	go eq.recoverAbandoned()
+	return eq
+}
+
+// Enqueue stores queued jobs unless the queue or the user's share of it is
+// full, or the user or session host is over quota. Several jobs of one
+// user, such as the cases of a test run, are admitted together and count as
+// one against the user's share and quotas.
+func (eq *ExecutionQueue) Enqueue(ctx context.Context, executions ...models.CodeExecution) error {
+	if len(executions) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, len(executions))
+	for i := range executions {
+		executions[i].Status = models.StatusQueued
+		documents[i] = executions[i]
+	}
+	// The queue's room and the quotas are checked and the jobs stored in one
+	// transaction, so that requests racing each other cannot both take the
+	// last place or run left
+	err := runTransaction(ctx, eq.executionCollection.Database().Client(), func(sc mongo.SessionContext) error {
+		if err := eq.checkQueue(sc, executions); err != nil {
+			return err
+		}
+		if err := eq.checkQuotas(sc, executions[0]); err != nil {
+			return err
+		}
+		_, err := eq.executionCollection.InsertMany(sc, documents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, execution := range executions {
+		broadcastExecStatus(eq.hub, execution)
+	}
+
+	// Nudge an idle worker instead of waiting for its next poll
+	select {
+	case eq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// checkQueue turns away executions the queue has no room for. Like
+// checkQuotas, it must run in the transaction that stores the executions; it
+// first writes the queue's record, so that transactions admitting runs
+// conflict and are started over one at a time.
+func (eq *ExecutionQueue) checkQueue(sc mongo.SessionContext, executions []models.CodeExecution) error {
+	_, err := eq.quotaCollection.UpdateOne(sc,
+		bson.M{"_id": "queue"},
+		bson.M{"$inc": bson.M{"admitted": len(executions)}, "$set": bson.M{"updated_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	queued, err := eq.executionCollection.CountDocuments(sc, bson.M{"status": models.StatusQueued})
+	if err != nil {
+		return err
+	}
+	if queued+int64(len(executions)) > int64(eq.config.MaxQueued) {
+		return errQueueFull
+	}
+
+	mine, err := eq.executionCollection.CountDocuments(sc, bson.M{"status": models.StatusQueued, "user_id": executions[0].UserID})
+	if err != nil {
+		return err
+	}
+	if mine >= int64(eq.config.MaxQueuedPerUser) {
+		return errUserQueueFull
+	}
+	return nil
+}
+
+// Stats reports queue depth and how long jobs wait before they start
+func (eq *ExecutionQueue) Stats(ctx context.Context) (ExecutionQueueStats, error) {
+	stats := ExecutionQueueStats{Workers: eq.config.Workers}
+
+	var err error
+	if stats.Queued, err = eq.executionCollection.CountDocuments(ctx, bson.M{"status": models.StatusQueued}); err != nil {
+		return stats, err
+	}
+	if stats.Running, err = eq.executionCollection.CountDocuments(ctx, bson.M{"status": models.StatusRunning}); err != nil {
+		return stats, err
+	}
+
+	var oldest models.CodeExecution
+	err = eq.executionCollection.FindOne(ctx,
+		bson.M{"status": models.StatusQueued},
+		options.FindOne().SetSort(bson.M{"created_at": 1}),
+	).Decode(&oldest)
+	if err == nil {
+		stats.OldestWait = time.Since(oldest.CreatedAt)
+	} else if err != mongo.ErrNoDocuments {
+		return stats, err
+	}
+
+	// Average wait of the jobs started in the last 15 minutes
+	cursor, err := eq.executionCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"started_at": bson.M{"$gte": time.Now().Add(-15 * time.Minute)}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  nil,
+			"wait": bson.M{"$avg": bson.M{"$subtract": bson.A{"$started_at", "$created_at"}}},
+		}}},
+	})
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	var waits []struct {
+		Wait float64 `bson:"wait"`
+	}
+	if err := cursor.All(ctx, &waits); err != nil {
+		return stats, err
+	}
+	if len(waits) > 0 {
+		stats.AverageWait = time.Duration(waits[0].Wait) * time.Millisecond
+	}
+	return stats, nil
+}
+
+// work claims and runs jobs until the process exits
+func (eq *ExecutionQueue) work() {
+	ticker := time.NewTicker(eq.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		execution, err := eq.claim()
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println("Error claiming execution:", err)
+		}
+		if err == nil {
+			eq.run(execution)
+			continue
+		}
+
+		select {
+		case <-eq.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim takes the oldest queued job whose user and session are below their
+// concurrency limits, so one user's backlog cannot hold up everyone else
+func (eq *ExecutionQueue) claim() (models.CodeExecution, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	busyUsers, err := eq.busy(ctx, "$user_id", eq.config.MaxPerUser)
+	if err != nil {
+		return models.CodeExecution{}, err
+	}
+	busySessions, err := eq.busy(ctx, "$session_id", eq.config.MaxPerSession)
+	if err != nil {
+		return models.CodeExecution{}, err
+	}
+
+	now := time.Now()
+	var execution models.CodeExecution
+	err = eq.executionCollection.FindOneAndUpdate(ctx,
+		bson.M{
+			"status":     models.StatusQueued,
+			"user_id":    bson.M{"$nin": busyUsers},
+			"session_id": bson.M{"$nin": busySessions},
+		},
+		bson.M{
+			"$set": bson.M{
+				"status":           models.StatusRunning,
+				"started_at":       now,
+				"worker_id":        eq.workerID,
+				"lease_expires_at": now.Add(eq.config.LeaseTimeout),
+			},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After),
+	).Decode(&execution)
+	if err != nil {
+		return execution, err
+	}
+
+	// Another worker may have claimed for the same user at the same moment;
+	// hand the job back rather than go over the limit
+	over, err := eq.overLimit(ctx, execution)
+	if err != nil {
+		// The job is ours either way; run it rather than strand it
+		log.Println("Error checking execution limits:", err)
+		return execution, nil
+	}
+	if over {
+		_, err = eq.executionCollection.UpdateOne(ctx,
+			bson.M{"_id": execution.ID, "worker_id": eq.workerID},
+			bson.M{
+				"$set":   bson.M{"status": models.StatusQueued},
+				"$unset": bson.M{"started_at": "", "worker_id": "", "lease_expires_at": ""},
+				"$inc":   bson.M{"attempts": -1},
+			},
+		)
+		if err == nil {
+			err = mongo.ErrNoDocuments
+		}
+	}
+	return execution, err
+}
+
+// busy lists the users or sessions that already have limit jobs running
+func (eq *ExecutionQueue) busy(ctx context.Context, field string, limit int) ([]primitive.ObjectID, error) {
+	cursor, err := eq.executionCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": models.StatusRunning}}},
+		{{Key: "$group", Value: bson.M{"_id": field, "running": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"running": bson.M{"$gte": limit}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(groups))
+	for _, group := range groups {
+		ids = append(ids, group.ID)
+	}
+	return ids, nil
+}
+
+// overLimit reports whether a claimed job pushed its user or session past
+// their concurrency limit
+func (eq *ExecutionQueue) overLimit(ctx context.Context, execution models.CodeExecution) (bool, error) {
+	byUser, err := eq.executionCollection.CountDocuments(ctx, bson.M{"status": models.StatusRunning, "user_id": execution.UserID})
+	if err != nil {
+		return false, err
+	}
+	bySession, err := eq.executionCollection.CountDocuments(ctx, bson.M{"status": models.StatusRunning, "session_id": execution.SessionID})
+	if err != nil {
+		return false, err
+	}
+	return byUser > int64(eq.config.MaxPerUser) || bySession > int64(eq.config.MaxPerSession), nil
+}
+
+// run executes a claimed job, renewing its lease and streaming its output
+// to the session room until it finishes, and stores what it produced
+func (eq *ExecutionQueue) run(execution models.CodeExecution) {
+	done := make(chan struct{})
+	go eq.renewLease(execution.ID, done)
+	broadcastExecStatus(eq.hub, execution)
+
+	stream := newExecutionStream(eq.hub, execution)
+	// Builds keep their cache per user, so no one can plant build output
+	// for someone else's
+	opts := utils.RunOptions{CacheKey: execution.UserID.Hex()}
+	language, known := eq.languages.Lookup(string(execution.Language))
+	limits := utils.LanguageLimits(eq.limits, language)
+	if execution.TestRunID.IsZero() {
+		opts.OnOutput = stream.write
+	} else if execution.TimeLimit > 0 {
+		// Test cases report a verdict instead of their output, and may be
+		// held to a tighter limit
+		limits.WallTime = execution.TimeLimit
+		limits.CPUTime = min(limits.CPUTime, execution.TimeLimit)
+	}
+	if execution.Stdin != "" {
+		opts.Stdin = strings.NewReader(execution.Stdin)
+	}
+	if execution.Interactive {
+		input := eq.openInput(execution.ID, stream)
+		opts.Stdin = io.MultiReader(strings.NewReader(execution.Stdin), input)
+		limits.WallTime = eq.config.InteractiveWallTime
+	}
+
+	var result utils.RunResult
+	var err error
+	if !known {
+		// Removed from the registry since the job was queued
+		err = fmt.Errorf("%w: %s", utils.ErrUnsupportedLanguage, execution.Language)
+	} else if len(execution.Sources) > 0 {
+		files := make([]utils.ProjectFile, len(execution.Sources))
+		for i, source := range execution.Sources {
+			files[i] = utils.ProjectFile{Path: source.Path, Content: source.Content}
+		}
+		result, err = utils.RunProject(context.Background(), language, files, execution.Entrypoint, limits, opts)
+	} else {
+		result, err = utils.RunCode(context.Background(), language, execution.SourceCode, limits, opts)
+	}
+	eq.closeInput(execution.ID)
+	execution.Transcript = stream.close()
+	close(done)
+
+	execution.Output = result.Stdout
+	execution.ErrorMessage = result.Stderr
+	execution.ExitCode = result.ExitCode
+	// Quotas count the build's CPU time as well as the program's
+	execution.ExecutionTime = result.CPUTime + result.CompileCPUTime
+	execution.MemoryUsed = result.MemoryUsed
+	execution.Diagnostics = executionDiagnostics(execution, result.Diagnostics)
+	execution.CompletedAt = time.Now()
+	switch {
+	case err != nil:
+		execution.Status = models.StatusFailed
+		execution.ErrorMessage = err.Error()
+	case result.TimedOut:
+		execution.Status = models.StatusTimedOut
+	case result.OutputTruncated:
+		execution.Status = models.StatusFailed
+		execution.ErrorMessage = result.Stderr + "\nOutput limit exceeded"
+	case result.ExitCode != 0:
+		execution.Status = models.StatusFailed
+	default:
+		execution.Status = models.StatusCompleted
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only the worker holding the job may finish it
+	saved, err := eq.executionCollection.UpdateOne(ctx,
+		bson.M{"_id": execution.ID, "worker_id": eq.workerID, "status": models.StatusRunning},
+		bson.M{
+			"$set": bson.M{
+				"status":         execution.Status,
+				"output":         execution.Output,
+				"error_message":  execution.ErrorMessage,
+				"exit_code":      execution.ExitCode,
+				"transcript":     execution.Transcript,
+				"diagnostics":    execution.Diagnostics,
+				"execution_time": execution.ExecutionTime,
+				"memory_used":    execution.MemoryUsed,
+				"completed_at":   execution.CompletedAt,
+			},
+			"$unset": bson.M{"lease_expires_at": ""},
+		},
+	)
+	if err != nil {
+		log.Println("Error saving execution result:", err)
+		return
+	}
+	if saved.MatchedCount == 0 {
+		return
+	}
+	broadcastExecStatus(eq.hub, execution)
+	if !execution.TestRunID.IsZero() {
+		if err := gradeExecution(ctx, eq.testRunCollection, eq.hub, execution); err != nil {
+			log.Println("Error grading test case:", err)
+		}
+	}
+}
+
+// executionDiagnostics ties diagnostics to the files they point at. A
+// single-file run has one file, so every diagnostic belongs to it.
+func executionDiagnostics(execution models.CodeExecution, diagnostics []utils.Diagnostic) []models.ExecutionDiagnostic {
+	fileIDs := make(map[string]primitive.ObjectID, len(execution.Sources))
+	for _, source := range execution.Sources {
+		fileIDs[source.Path] = source.FileID
+	}
+
+	var mapped []models.ExecutionDiagnostic
+	for _, diagnostic := range diagnostics {
+		fileID, ok := fileIDs[diagnostic.Path]
+		if !ok && len(execution.Sources) == 0 {
+			fileID = execution.FileID
+		}
+		mapped = append(mapped, models.ExecutionDiagnostic{
+			FileID:   fileID,
+			Path:     diagnostic.Path,
+			Line:     diagnostic.Line,
+			Column:   diagnostic.Column,
+			Severity: diagnostic.Severity,
+			Message:  diagnostic.Message,
+		})
+	}
+	return mapped
+}
+
+// renewLease keeps a running job's lease fresh until done is closed
+func (eq *ExecutionQueue) renewLease(executionID primitive.ObjectID, done chan struct{}) {
+	ticker := time.NewTicker(eq.config.LeaseTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, err := eq.executionCollection.UpdateOne(ctx,
+				bson.M{"_id": executionID, "worker_id": eq.workerID},
+				bson.M{"$set": bson.M{"lease_expires_at": time.Now().Add(eq.config.LeaseTimeout)}},
+			)
+			cancel()
+			if err != nil {
+				log.Println("Error renewing execution lease:", err)
+			}
+		}
+	}
+}
+
+// recoverAbandoned puts jobs back in the queue when their worker crashed or
+// lost its connection, and fails the ones that keep getting abandoned
+func (eq *ExecutionQueue) recoverAbandoned() {
+	ticker := time.NewTicker(eq.config.LeaseTimeout / 2)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		expired := bson.M{"status": models.StatusRunning, "lease_expires_at": bson.M{"$lt": time.Now()}}
+
+		eq.failAbandoned(ctx, expired)
+
+		result, err := eq.executionCollection.UpdateMany(ctx,
+			expired,
+			bson.M{
+				"$set":   bson.M{"status": models.StatusQueued},
+				"$unset": bson.M{"started_at": "", "worker_id": "", "lease_expires_at": ""},
+			},
+		)
+		if err != nil {
+			log.Println("Error requeueing abandoned executions:", err)
+		} else if result.ModifiedCount > 0 {
+			log.Printf("Requeued %d abandoned executions", result.ModifiedCount)
+		}
+		cancel()
+	}
+}
+
+// failAbandoned fails expired jobs that ran out of attempts, grading the
+// ones that belong to a test run
+func (eq *ExecutionQueue) failAbandoned(ctx context.Context, expired bson.M) {
+	cursor, err := eq.executionCollection.Find(ctx, bson.M{"$and": bson.A{expired, bson.M{"attempts": bson.M{"$gte": eq.config.MaxAttempts}}}})
+	if err != nil {
+		log.Println("Error finding abandoned executions:", err)
+		return
+	}
+	var executions []models.CodeExecution
+	if err := cursor.All(ctx, &executions); err != nil {
+		log.Println("Error decoding abandoned executions:", err)
+		return
+	}
+
+	for _, execution := range executions {
+		execution.Status = models.StatusFailed
+		execution.ErrorMessage = "Execution was abandoned by its worker"
+		execution.CompletedAt = time.Now()
+		failed, err := eq.executionCollection.UpdateOne(ctx,
+			bson.M{"$and": bson.A{expired, bson.M{"_id": execution.ID}}},
+			bson.M{
+				"$set":   bson.M{"status": execution.Status, "error_message": execution.ErrorMessage, "completed_at": execution.CompletedAt},
+				"$unset": bson.M{"lease_expires_at": ""},
+			},
+		)
+		if err != nil {
+			log.Println("Error failing abandoned execution:", err)
+			continue
+		}
+		if failed.ModifiedCount == 0 {
+			continue
+		}
+		broadcastExecStatus(eq.hub, execution)
+		if !execution.TestRunID.IsZero() {
+			if err := gradeExecution(ctx, eq.testRunCollection, eq.hub, execution); err != nil {
+				log.Println("Error grading test case:", err)
+			}
+		}
+	}
+}
+
+// interactiveInput carries keystrokes from the session socket to a running
+// program's stdin
+type interactiveInput struct {
+	sync.Mutex
+	frames chan []byte
+	closed bool
+	buf    []byte
+	stream *executionStream
+}
+
+// Read hands the program the next piece of input, waiting for one if needed
+func (in *interactiveInput) Read(p []byte) (int, error) {
+	if len(in.buf) == 0 {
+		data, ok := <-in.frames
+		if !ok {
+			return 0, io.EOF
+		}
+		in.buf = data
+	}
+	n := copy(p, in.buf)
+	in.buf = in.buf[n:]
+	return n, nil
+}
+
+// send queues input, or ends it when eof is set
+func (in *interactiveInput) send(data []byte, eof bool) error {
+	in.Lock()
+	defer in.Unlock()
+
+	if in.closed {
+		return errExecutionNotRunning
+	}
+	if len(data) > 0 {
+		select {
+		case in.frames <- data:
+		default:
+			return errInputBacklog
+		}
+		// Echo the input so the room's transcript shows what was typed
+		in.stream.write(utils.PhaseRun, StreamStdin, data)
+	}
+	if eof {
+		in.closed = true
+		close(in.frames)
+	}
+	return nil
+}
+
+// openInput registers a running interactive execution
+func (eq *ExecutionQueue) openInput(executionID primitive.ObjectID, stream *executionStream) *interactiveInput {
+	input := &interactiveInput{
+		frames: make(chan []byte, interactiveInputBacklog),
+		stream: stream,
+	}
+
+	eq.inputsMu.Lock()
+	eq.inputs[executionID] = input
+	eq.inputsMu.Unlock()
+	return input
+}
+
+// closeInput ends an execution's input and forgets it; it is safe to call twice
+func (eq *ExecutionQueue) closeInput(executionID primitive.ObjectID) {
+	eq.inputsMu.Lock()
+	input, ok := eq.inputs[executionID]
+	delete(eq.inputs, executionID)
+	eq.inputsMu.Unlock()
+
+	if ok {
+		input.send(nil, true)
+	}
+}
+
+// execInput is input for an execution running on another instance
+type execInput struct {
+	ExecutionID primitive.ObjectID `bson:"execution_id"`
+	WorkerID    string             `bson:"worker_id"`
+	Data        []byte             `bson:"data,omitempty"`
+	EOF         bool               `bson:"eof,omitempty"`
+}
+
+// SendInput forwards input from a user to an interactive execution of the
+// given session that they started; eof closes the program's stdin. Input
+// for an execution running on another instance goes through the broker, and
+// is dropped there if the program is not reading.
+func (eq *ExecutionQueue) SendInput(ctx context.Context, executionID primitive.ObjectID, sessionID, userID string, data []byte, eof bool) error {
+	eq.inputsMu.Lock()
+	input, ok := eq.inputs[executionID]
+	eq.inputsMu.Unlock()
+
+	if ok {
+		execution := input.stream.execution
+		if execution.SessionID.Hex() != sessionID {
+			return errExecutionNotRunning
+		}
+		if execution.UserID.Hex() != userID {
+			return errNotExecutionOwner
+		}
+		return input.send(data, eof)
+	}
+
+	var execution models.CodeExecution
+	err := eq.executionCollection.FindOne(ctx, bson.M{
+		"_id":         executionID,
+		"status":      models.StatusRunning,
+		"interactive": true,
+	}).Decode(&execution)
+	if err == mongo.ErrNoDocuments || (err == nil && execution.SessionID.Hex() != sessionID) {
+		return errExecutionNotRunning
+	}
+	if err != nil {
+		return err
+	}
+	if execution.UserID.Hex() != userID {
+		return errNotExecutionOwner
+	}
+
+	payload, err := bson.Marshal(execInput{ExecutionID: executionID, WorkerID: execution.WorkerID, Data: data, EOF: eof})
+	if err != nil {
+		return err
+	}
+	return eq.hub.Publish(ctx, BrokerMessage{Kind: brokerKindExecInput, SessionID: sessionID, Data: payload})
+}
+
+// deliverInput hands input sent from another instance to the execution, if
+// it runs on this one
+func (eq *ExecutionQueue) deliverInput(msg BrokerMessage) {
+	var in execInput
+	if err := bson.Unmarshal(msg.Data, &in); err != nil {
+		log.Println("Error decoding execution input:", err)
+		return
+	}
+	if in.WorkerID != eq.workerID {
+		return
+	}
+
+	eq.inputsMu.Lock()
+	input, ok := eq.inputs[in.ExecutionID]
+	eq.inputsMu.Unlock()
+	if !ok {
+		return
+	}
+	if err := input.send(in.Data, in.EOF); err != nil {
+		log.Printf("Dropping input for execution %s: %v", in.ExecutionID.Hex(), err)
+	}
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+)
+
+// testInputQueue is a queue with one interactive execution running on it
+func testInputQueue(t *testing.T, h *Hub) (*ExecutionQueue, models.CodeExecution, *interactiveInput) {
+	eq := &ExecutionQueue{
+		hub:      h,
+		workerID: primitive.NewObjectID().Hex(),
+		inputs:   make(map[primitive.ObjectID]*interactiveInput),
+	}
+	h.Handle(brokerKindExecInput, eq.deliverInput)
+
+	execution := models.CodeExecution{
+		ID:          primitive.NewObjectID(),
+		UserID:      primitive.NewObjectID(),
+		SessionID:   primitive.NewObjectID(),
+		Interactive: true,
+	}
+	stream := newExecutionStream(h, execution)
+	input := eq.openInput(execution.ID, stream)
+	t.Cleanup(func() {
+		eq.closeInput(execution.ID)
+		stream.close()
+	})
+	return eq, execution, input
+}
+
+// readInput reads what reached the program until its input ends
+func readInput(t *testing.T, eq *ExecutionQueue, execution models.CodeExecution, input *interactiveInput) string {
+	t.Helper()
+	eq.closeInput(execution.ID)
+	data, err := io.ReadAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSendInputOnlyFromStarter(t *testing.T) {
+	eq, execution, input := testInputQueue(t, testHub(NewMemoryBroker()))
+	ctx := context.Background()
+	sessionID, owner := execution.SessionID.Hex(), execution.UserID.Hex()
+
+	if err := eq.SendInput(ctx, execution.ID, sessionID, primitive.NewObjectID().Hex(), []byte("other\n"), false); err != errNotExecutionOwner {
+		t.Errorf("input from another member got %v, want errNotExecutionOwner", err)
+	}
+	if err := eq.SendInput(ctx, execution.ID, primitive.NewObjectID().Hex(), owner, []byte("session\n"), false); err != errExecutionNotRunning {
+		t.Errorf("input through another session got %v, want errExecutionNotRunning", err)
+	}
+	if err := eq.SendInput(ctx, execution.ID, sessionID, owner, []byte("mine\n"), false); err != nil {
+		t.Fatalf("input from the starter: %v", err)
+	}
+
+	if got := readInput(t, eq, execution, input); got != "mine\n" {
+		t.Errorf("program read %q, want only the starter's input", got)
+	}
+}
+
+func TestInputFromOtherInstances(t *testing.T) {
+	h := testHub(NewMemoryBroker())
+	eq, execution, input := testInputQueue(t, h)
+
+	publish := func(workerID, data string) {
+		t.Helper()
+		payload, err := bson.Marshal(execInput{ExecutionID: execution.ID, WorkerID: workerID, Data: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.Publish(context.Background(), BrokerMessage{Kind: brokerKindExecInput, SessionID: execution.SessionID.Hex(), Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(eq.workerID, "routed\n")
+	// Input for the same execution ID held by another worker is not ours
+	publish(primitive.NewObjectID().Hex(), "elsewhere\n")
+
+	if got := readInput(t, eq, execution, input); got != "routed\n" {
+		t.Errorf("program read %q, want the input routed to this worker", got)
+	}
+}
+
+func TestEnqueueLimits(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	quota := config.ExecutionQuota{RunsPerMinute: 100, CPUPerDay: time.Hour, MaxConcurrent: 100}
+	eq := &ExecutionQueue{
+		executionCollection: db.Collection("code_executions"),
+		quotaCollection:     db.Collection("execution_quotas"),
+		config:              config.ExecutionConfig{MaxQueued: 3, MaxQueuedPerUser: 2, UserQuota: quota, HostQuota: quota},
+		hub:                 testHub(NewMemoryBroker()),
+		wake:                make(chan struct{}, 1),
+	}
+	job := func(userID primitive.ObjectID) models.CodeExecution {
+		return models.CodeExecution{ID: primitive.NewObjectID(), UserID: userID, SessionID: primitive.NewObjectID(), CreatedAt: time.Now()}
+	}
+	alice, bob, carol := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+	steps := []struct {
+		name string
+		user primitive.ObjectID
+		want error
+	}{
+		{name: "first of alice", user: alice},
+		{name: "second of alice", user: alice},
+		{name: "third of alice", user: alice, want: errUserQueueFull},
+		{name: "first of bob", user: bob},
+		{name: "queue full", user: carol, want: errQueueFull},
+	}
+	for _, step := range steps {
+		if err := eq.Enqueue(ctx, job(step.user)); err != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, err, step.want)
+		}
+	}
+}
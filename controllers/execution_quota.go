@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+)
+
+// Quotas an execution can run into
+const (
+	quotaRunsPerMinute = "runs_per_minute"
+	quotaCPUPerDay     = "cpu_per_day"
+	quotaConcurrent    = "max_concurrent"
+)
+
+// Whose quota an execution ran into
+const (
+	quotaScopeUser = "user"
+	quotaScopeHost = "host"
+)
+
+// quotaError is returned by Enqueue when a run would go over the quota of
+// the user starting it or of the session's host
+type quotaError struct {
+	Scope   string
+	Quota   string
+	Limit   string
+	ResetAt time.Time
+}
+
+func (e *quotaError) Error() string {
+	owner := "your"
+	if e.Scope == quotaScopeHost {
+		owner = "the session host's"
+	}
+	switch e.Quota {
+	case quotaRunsPerMinute:
+		return fmt.Sprintf("Over %s quota of %s runs per minute", owner, e.Limit)
+	case quotaCPUPerDay:
+		return fmt.Sprintf("Over %s quota of %s CPU time per day", owner, e.Limit)
+	default:
+		return fmt.Sprintf("Over %s quota of %s runs at once", owner, e.Limit)
+	}
+}
+
+// QuotaUsage is how much of its execution quota a user, or the sessions a
+// user hosts, have used
+type QuotaUsage struct {
+	Runs          int64 `json:"runs"` // started in the last minute
+	RunsPerMinute int   `json:"runs_per_minute"`
+	// When the oldest of those runs stops counting
+	RunsResetAt *time.Time `json:"runs_reset_at,omitempty"`
+
+	CPUTime    time.Duration `json:"cpu_time"` // used since midnight UTC
+	CPUPerDay  time.Duration `json:"cpu_per_day"`
+	CPUResetAt time.Time     `json:"cpu_reset_at"`
+
+	Active        int64 `json:"active"` // queued or running
+	MaxConcurrent int   `json:"max_concurrent"`
+	// When the oldest active run is due to be done at the latest
+	ActiveResetAt *time.Time `json:"active_reset_at,omitempty"`
+}
+
+// Usage reports how much of the user quota a user has used, and of the host
+// quota their sessions have
+func (eq *ExecutionQueue) Usage(ctx context.Context, userID primitive.ObjectID) (user, host QuotaUsage, err error) {
+	if user, err = eq.quotaUsage(ctx, "user_id", userID, eq.config.UserQuota); err != nil {
+		return
+	}
+	host, err = eq.quotaUsage(ctx, "host_user_id", userID, eq.config.HostQuota)
+	return
+}
+
+// checkQuotas turns away executions that would put the user who starts
+// them or the session's host over quota. It must run in the transaction that
+// stores the executions: it first writes the quota records of the user and
+// host, so that any other transaction admitting runs for either conflicts
+// with this one and is started over to see its runs.
+func (eq *ExecutionQueue) checkQuotas(sc mongo.SessionContext, execution models.CodeExecution) error {
+	if err := eq.lockQuota(sc, quotaScopeUser, execution.UserID); err != nil {
+		return err
+	}
+	if !execution.HostUserID.IsZero() {
+		if err := eq.lockQuota(sc, quotaScopeHost, execution.HostUserID); err != nil {
+			return err
+		}
+	}
+
+	usage, err := eq.quotaUsage(sc, "user_id", execution.UserID, eq.config.UserQuota)
+	if err != nil {
+		return err
+	}
+	if err := usage.exceeded(quotaScopeUser); err != nil {
+		return err
+	}
+
+	if execution.HostUserID.IsZero() {
+		return nil
+	}
+	usage, err = eq.quotaUsage(sc, "host_user_id", execution.HostUserID, eq.config.HostQuota)
+	if err != nil {
+		return err
+	}
+	if err := usage.exceeded(quotaScopeHost); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lockQuota writes the quota record of a user in one scope, which no other
+// transaction can then write until this one ends
+func (eq *ExecutionQueue) lockQuota(sc mongo.SessionContext, scope string, userID primitive.ObjectID) error {
+	_, err := eq.quotaCollection.UpdateOne(sc,
+		bson.M{"_id": scope + ":" + userID.Hex()},
+		bson.M{"$inc": bson.M{"admitted": 1}, "$set": bson.M{"updated_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// exceeded returns the quota one more run would go over, if any
+func (u QuotaUsage) exceeded(scope string) error {
+	switch {
+	case u.Active >= int64(u.MaxConcurrent):
+		resetAt := time.Now()
+		if u.ActiveResetAt != nil {
+			resetAt = *u.ActiveResetAt
+		}
+		return &quotaError{Scope: scope, Quota: quotaConcurrent, Limit: fmt.Sprint(u.MaxConcurrent), ResetAt: resetAt}
+	case u.Runs >= int64(u.RunsPerMinute):
+		resetAt := time.Now()
+		if u.RunsResetAt != nil {
+			resetAt = *u.RunsResetAt
+		}
+		return &quotaError{Scope: scope, Quota: quotaRunsPerMinute, Limit: fmt.Sprint(u.RunsPerMinute), ResetAt: resetAt}
+	case u.CPUTime >= u.CPUPerDay:
+		return &quotaError{Scope: scope, Quota: quotaCPUPerDay, Limit: u.CPUPerDay.String(), ResetAt: u.CPUResetAt}
+	}
+	return nil
+}
+
+// quotaUsage measures the executions whose field, user_id or host_user_id,
+// is the given user against a quota
+func (eq *ExecutionQueue) quotaUsage(ctx context.Context, field string, userID primitive.ObjectID, quota config.ExecutionQuota) (QuotaUsage, error) {
+	now := time.Now()
+	usage := QuotaUsage{
+		RunsPerMinute: quota.RunsPerMinute,
+		CPUPerDay:     quota.CPUPerDay,
+		CPUResetAt:    now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour),
+		MaxConcurrent: quota.MaxConcurrent,
+	}
+
+	recent, err := eq.runs(ctx, bson.M{field: userID, "created_at": bson.M{"$gte": now.Add(-time.Minute)}})
+	if err != nil {
+		return usage, err
+	}
+	usage.Runs = recent.Count
+	if recent.Count > 0 {
+		resetAt := recent.Created.Add(time.Minute)
+		usage.RunsResetAt = &resetAt
+	}
+
+	active, err := eq.runs(ctx, bson.M{field: userID, "status": bson.M{"$in": bson.A{models.StatusQueued, models.StatusRunning}}})
+	if err != nil {
+		return usage, err
+	}
+	usage.Active = active.Count
+	if active.Count > 0 {
+		// A run that has not started yet could take its whole time limit
+		// once it does
+		start := now
+		if !active.Started.IsZero() {
+			start = active.Started
+		}
+		resetAt := start.Add(eq.config.CompileTime + eq.config.WallTime)
+		usage.ActiveResetAt = &resetAt
+	}
+
+	cursor, err := eq.executionCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: userID, "completed_at": bson.M{"$gte": usage.CPUResetAt.Add(-24 * time.Hour)}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "cpu": bson.M{"$sum": "$execution_time"}}}},
+	})
+	if err != nil {
+		return usage, err
+	}
+	var totals []struct {
+		CPU int64 `bson:"cpu"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return usage, err
+	}
+	if len(totals) > 0 {
+		usage.CPUTime = time.Duration(totals[0].CPU)
+	}
+	return usage, nil
+}
+
+// runCount is the number of runs among some executions, with the creation
+// and start times of the oldest
+type runCount struct {
+	Count   int64     `bson:"count"`
+	Created time.Time `bson:"created"`
+	Started time.Time `bson:"started"`
+}
+
+// runs counts the runs among the executions matching a filter, taking the
+// cases of a test run together as one
+func (eq *ExecutionQueue) runs(ctx context.Context, match bson.M) (runCount, error) {
+	cursor, err := eq.executionCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     bson.M{"$ifNull": bson.A{"$test_run_id", "$_id"}},
+			"created": bson.M{"$min": "$created_at"},
+			"started": bson.M{"$min": "$started_at"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"count":   bson.M{"$sum": 1},
+			"created": bson.M{"$min": "$created"},
+			"started": bson.M{"$min": "$started"},
+		}}},
+	})
+	if err != nil {
+		return runCount{}, err
+	}
+	var counts []runCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return runCount{}, err
+	}
+	if len(counts) == 0 {
+		return runCount{}, nil
+	}
+	return counts[0], nil
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"codeCollab-backend/models"
+)
+
+// StreamStdin marks transcript chunks holding input typed into an
+// interactive execution
+const StreamStdin = "stdin"
+
+const (
+	// How often buffered output is sent to the session room
+	outputFlushInterval = 50 * time.Millisecond
+	// Output is split into chunks of at most this many bytes
+	outputChunkSize = 4 << 10
+)
+
+// executionStream relays the output of a running execution to its session
+// room. Small writes are merged into chunks and sent from a separate
+// goroutine, so a chatty program is never held up by the broker; the chunks
+// sent also make up the saved transcript.
+type executionStream struct {
+	sync.Mutex
+	hub        *Hub
+	execution  models.CodeExecution
+	start      time.Time
+	pending    []models.TranscriptChunk
+	transcript []models.TranscriptChunk
+	// Trailing bytes of a character split across writes, by phase and stream
+	partial map[string][]byte
+	done    chan struct{}
+	flushed chan struct{}
+}
+
+// newExecutionStream starts relaying output of an execution
+func newExecutionStream(hub *Hub, execution models.CodeExecution) *executionStream {
+	s := &executionStream{
+		hub:       hub,
+		execution: execution,
+		start:     time.Now(),
+		partial:   make(map[string][]byte),
+		done:      make(chan struct{}),
+		flushed:   make(chan struct{}),
+	}
+	go s.relay()
+	return s
+}
+
+// write buffers output; it is the utils.RunOptions.OnOutput callback
+func (s *executionStream) write(phase, stream string, data []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Hold back an incomplete trailing character until the rest arrives
+	key := phase + "/" + stream
+	data = append(s.partial[key], data...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	s.partial[key] = append([]byte(nil), data[cut:]...)
+	data = data[:cut]
+
+	for len(data) > 0 {
+		last := len(s.pending) - 1
+		if last < 0 || s.pending[last].Phase != phase || s.pending[last].Stream != stream || len(s.pending[last].Data) > outputChunkSize-utf8.UTFMax {
+			s.pending = append(s.pending, models.TranscriptChunk{
+				Phase:  phase,
+				Stream: stream,
+				Offset: time.Since(s.start).Milliseconds(),
+			})
+			last++
+		}
+
+		room := min(len(data), outputChunkSize-len(s.pending[last].Data))
+		n := room
+		for n < len(data) && n > 0 && !utf8.RuneStart(data[n]) {
+			n--
+		}
+		if n == 0 {
+			// Invalid UTF-8; split it anywhere
+			n = room
+		}
+		s.pending[last].Data += string(data[:n])
+		data = data[n:]
+	}
+}
+
+// relay sends buffered chunks until the stream is closed
+func (s *executionStream) relay() {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+	defer close(s.flushed)
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends the chunks buffered so far
+func (s *executionStream) flush() {
+	s.Lock()
+	chunks := s.pending
+	s.pending = nil
+	s.transcript = append(s.transcript, chunks...)
+	s.Unlock()
+
+	// The output of a hidden case would give its input away to the room; the
+	// host reads it from the saved transcript instead
+	if s.execution.HiddenTestCase {
+		return
+	}
+	for _, chunk := range chunks {
+		s.hub.Broadcast(newEnvelope(MessageExecOutput, s.execution.SessionID.Hex(), s.execution.UserID.Hex(), ExecOutputPayload{
+			ExecutionID:     s.execution.ID.Hex(),
+			TranscriptChunk: chunk,
+		}))
+	}
+}
+
+// close sends what is left and returns the full transcript
+func (s *executionStream) close() []models.TranscriptChunk {
+	close(s.done)
+	<-s.flushed
+	return s.transcript
+}
+
+// broadcastExecStatus tells an execution's session room about a status
+// change. Errors and diagnostics of hidden cases are left out.
+func broadcastExecStatus(hub *Hub, execution models.CodeExecution) {
+	if execution.HiddenTestCase {
+		execution.ErrorMessage = ""
+		execution.Diagnostics = nil
+	}
+	payload := ExecStatusPayload{
+		ExecutionID:  execution.ID.Hex(),
+		FileID:       execution.FileID.Hex(),
+		UserID:       execution.UserID.Hex(),
+		Status:       execution.Status,
+		ErrorMessage: execution.ErrorMessage,
+	}
+	if !execution.CompletedAt.IsZero() {
+		exitCode := execution.ExitCode
+		payload.ExitCode = &exitCode
+		payload.ExecutionTime = execution.ExecutionTime
+		payload.MemoryUsed = execution.MemoryUsed
+		payload.Diagnostics = execution.Diagnostics
+	}
+	if !execution.FolderID.IsZero() {
+		payload.FolderID = execution.FolderID.Hex()
+	}
+	hub.Broadcast(newEnvelope(MessageExecStatus, execution.SessionID.Hex(), execution.UserID.Hex(), payload))
+}
@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -14,23 +16,47 @@ import (
 	"codeCollab-backend/utils"
 )
 
+// Times UpdateFile, or a live document, rereads a file that was saved while
+// it was updating it
+const maxSaveAttempts = 3
+
 type FileController struct {
 	fileCollection        *mongo.Collection
 	fileVersionCollection *mongo.Collection
 	userCollection        *mongo.Collection
 	folderCollection      *mongo.Collection
+	languages             *utils.LanguageRegistry
+	documents             *DocumentManager
+	yjs                   *YjsManager
 }
 
 // Constructor for FileController
-func NewFileController(db *mongo.Database) *FileController {
+func NewFileController(db *mongo.Database, languages *utils.LanguageRegistry, documents *DocumentManager, yjs *YjsManager) *FileController {
 	return &FileController{
 		fileCollection:        db.Collection("files"),
 		fileVersionCollection: db.Collection("file_versions"),
 		userCollection:        db.Collection("users"),
 		folderCollection:      db.Collection("folders"),
+		languages:             languages,
+		documents:             documents,
+		yjs:                   yjs,
 	}
 }
 
+// fileLanguage checks a language given for a file against the registry, or
+// detects it from the file name when none is given. Files the registry has
+// no language for, such as notes, get none.
+func (fc *FileController) fileLanguage(name, language string) (string, error) {
+	if language == "" {
+		detected, _ := fc.languages.Detect(name)
+		return detected.Name, nil
+	}
+	if _, ok := fc.languages.Lookup(language); !ok {
+		return "", fmt.Errorf("%w: %q", utils.ErrUnsupportedLanguage, language)
+	}
+	return language, nil
+}
+
 // CreateFile adds a new file to a folder
 func (fc *FileController) CreateFile(c *gin.Context) {
 	var file models.File
@@ -68,6 +94,12 @@ func (fc *FileController) CreateFile(c *gin.Context) {
 		return
 	}
 
+	file.Language, err = fc.fileLanguage(file.Name, file.Language)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Set fields
 	file.ID = primitive.NewObjectID()
 	file.UserID = userObjectID
@@ -103,7 +135,7 @@ func (fc *FileController) CreateFile(c *gin.Context) {
 		EditedBy: userObjectID,
 		EditedAt: file.CreatedAt,
 	}
-	_, err = fc.fileVersionCollection.InsertOne(context.Background(), version)
+	err = recordFileVersion(context.Background(), fc.fileVersionCollection, version, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file version"})
 		return
@@ -148,7 +180,11 @@ func (fc *FileController) GetFiles(c *gin.Context) {
 	c.JSON(http.StatusOK, files)
 }
 
-// UpdateFile updates a file's content and tracks versions
+// UpdateFile updates a file's content and tracks versions. Clients send the
+// base_version their edit started from; when others have saved since, the
+// edit is merged with theirs, and a 409 with the conflicting lines comes
+// back if both changed the same part. A request without a base version is
+// rejected, as there is no telling what it would overwrite.
 func (fc *FileController) UpdateFile(c *gin.Context) {
 	fileID := c.Param("id")
 	objectID, err := primitive.ObjectIDFromHex(fileID)
@@ -158,8 +194,9 @@ func (fc *FileController) UpdateFile(c *gin.Context) {
 	}
 
 	var updates struct {
-		Content  string `json:"content" binding:"required"`
-		Language string `json:"language"`
+		Content     string `json:"content" binding:"required"`
+		Language    string `json:"language"`
+		BaseVersion int    `json:"base_version" binding:"required,min=1"`
 	}
 
 	if err := c.ShouldBindJSON(&updates); err != nil {
@@ -186,46 +223,127 @@ func (fc *FileController) UpdateFile(c *gin.Context) {
 		return
 	}
 
-	// Retrieve current file
-	var currentFile models.File
-	err = fc.fileCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&currentFile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "File not found"})
-		return
-	}
-
-	// Increment version and update fields
-	newVersion := currentFile.Version + 1
-	updatesMap := bson.M{
-		"content":        updates.Content,
-		"language":       updates.Language,
-		"version":        newVersion,
-		"updated_at":     time.Now(),
-		"last_edited_by": editorID,
-	}
-
-	_, err = fc.fileCollection.UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{"$set": updatesMap})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
-		return
-	}
-
-	// Save version
-	version := models.FileVersion{
-		ID:       primitive.NewObjectID(),
-		FileID:   objectID,
-		Content:  updates.Content,
-		Version:  newVersion,
-		EditedBy: editorID,
-		EditedAt: time.Now(),
-	}
-	_, err = fc.fileVersionCollection.InsertOne(context.Background(), version)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file version"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Another save can land between reading the file and writing it, so the
+	// write only succeeds against the version read, and is retried on top
+	// of the newer one otherwise
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		// Retrieve current file
+		var currentFile models.File
+		err = fc.fileCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&currentFile)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		// Without a new language the file keeps the one it has
+		language := currentFile.Language
+		if updates.Language != "" || language == "" {
+			language, err = fc.fileLanguage(currentFile.Name, updates.Language)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		baseVersion := updates.BaseVersion
+		if baseVersion > currentFile.Version {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Base version is newer than the file"})
+			return
+		}
+
+		content, merged := updates.Content, false
+		if baseVersion < currentFile.Version {
+			base, err := loadFileVersion(ctx, fc.fileVersionCollection, objectID, baseVersion)
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusConflict, gin.H{
+					"error":           "Base version is no longer available, reload the file",
+					"current_version": currentFile.Version,
+					"content":         currentFile.Content,
+				})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve base version"})
+				return
+			}
+
+			var conflicts []utils.MergeConflict
+			content, conflicts = utils.MergeText(base.Content, updates.Content, currentFile.Content)
+			if len(conflicts) > 0 {
+				c.JSON(http.StatusConflict, gin.H{
+					"error":           fmt.Sprintf("Edit conflicts with changes saved since version %d", baseVersion),
+					"base_version":    baseVersion,
+					"current_version": currentFile.Version,
+					"content":         currentFile.Content,
+					"conflicts":       conflicts,
+				})
+				return
+			}
+			merged = true
+		}
+
+		// Increment version and update fields, together with the version
+		// record so neither is written without the other
+		newVersion := currentFile.Version + 1
+		err = runTransaction(ctx, fc.fileCollection.Database().Client(), func(sc mongo.SessionContext) error {
+			now := time.Now()
+			updatesMap := bson.M{
+				"content":        content,
+				"language":       language,
+				"version":        newVersion,
+				"updated_at":     now,
+				"last_edited_by": editorID,
+			}
+
+			result, err := fc.fileCollection.UpdateOne(sc,
+				bson.M{"_id": objectID, "version": currentFile.Version},
+				bson.M{"$set": updatesMap},
+			)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errFileChanged
+			}
+
+			version := models.FileVersion{
+				ID:       primitive.NewObjectID(),
+				FileID:   objectID,
+				Content:  content,
+				Version:  newVersion,
+				EditedBy: editorID,
+				EditedAt: now,
+			}
+			return recordFileVersion(sc, fc.fileVersionCollection, version, currentFile.Content)
+		})
+		if err == errFileChanged || isTransientTransactionError(err) {
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
+			return
+		}
+
+		// Editors with the file open live get the change as an edit
+		if err := fc.documents.Refresh(ctx, objectID); err != nil {
+			log.Println("Error refreshing live document:", err)
+		}
+		if err := fc.yjs.Refresh(ctx, objectID); err != nil {
+			log.Println("Error refreshing Yjs document:", err)
+		}
+
+		response := gin.H{"message": "File updated successfully", "version": newVersion, "merged": merged}
+		if merged {
+			response["content"] = content
+		}
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File updated successfully"})
+	c.JSON(http.StatusConflict, gin.H{"error": "File is being saved by others, try again"})
 }
 
 // DeleteFile removes a file by its ID
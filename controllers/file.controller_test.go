@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUpdateFile(t *testing.T) {
+	db := testDatabase(t)
+	hub := testHub(NewMemoryBroker())
+	fc := NewFileController(db, nil, NewDocumentManager(db, hub), NewYjsManager(db, hub, "content"))
+	host, other := primitive.NewObjectID(), primitive.NewObjectID()
+
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantContent string
+		wantVersion int
+		wantMerged  bool
+	}{
+		{
+			name:        "without a base version",
+			body:        `{"content": "a\nb\nC\n"}`,
+			wantCode:    http.StatusBadRequest,
+			wantContent: "A\nb\nc\n",
+			wantVersion: 2,
+		},
+		{
+			name:        "base version newer than the file",
+			body:        `{"content": "a\nb\nC\n", "base_version": 3}`,
+			wantCode:    http.StatusBadRequest,
+			wantContent: "A\nb\nc\n",
+			wantVersion: 2,
+		},
+		{
+			name:        "on the current version",
+			body:        `{"content": "A\nb\nC\n", "base_version": 2}`,
+			wantCode:    http.StatusOK,
+			wantContent: "A\nb\nC\n",
+			wantVersion: 3,
+		},
+		{
+			name:        "merged with a save made since",
+			body:        `{"content": "a\nb\nC\n", "base_version": 1}`,
+			wantCode:    http.StatusOK,
+			wantContent: "A\nb\nC\n",
+			wantVersion: 3,
+			wantMerged:  true,
+		},
+		{
+			name:        "conflicting with a save made since",
+			body:        `{"content": "X\nb\nc\n", "base_version": 1}`,
+			wantCode:    http.StatusConflict,
+			wantContent: "A\nb\nc\n",
+			wantVersion: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Version 1 is what the editor started from, version 2 was
+			// saved by someone else since
+			file := testFile(t, db, host, "a\nb\nc\n")
+			saveTestVersion(t, db, &file, other, "A\nb\nc\n")
+
+			params := gin.Params{{Key: "id", Value: file.ID.Hex()}}
+			w := serveTest(fc.UpdateFile, http.MethodPut, params, host, tt.body)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d (%s), want %d", w.Code, w.Body, tt.wantCode)
+			}
+
+			head := fileAt(t, db, file.ID)
+			if head.Content != tt.wantContent || head.Version != tt.wantVersion {
+				t.Errorf("file is at version %d with %q, want version %d with %q", head.Version, head.Content, tt.wantVersion, tt.wantContent)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Version int  `json:"version"`
+				Merged  bool `json:"merged"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Version != tt.wantVersion || response.Merged != tt.wantMerged {
+				t.Errorf("answered version %d merged %v, want version %d merged %v", response.Version, response.Merged, tt.wantVersion, tt.wantMerged)
+			}
+
+			// The saved version is in the history along with the file
+			version, err := loadFileVersion(context.Background(), fc.fileVersionCollection, file.ID, tt.wantVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version.Content != tt.wantContent || version.EditedBy != host {
+				t.Errorf("version %d holds %q by %s, want %q by %s", tt.wantVersion, version.Content, version.EditedBy.Hex(), tt.wantContent, host.Hex())
+			}
+		})
+	}
+}
+
+func TestUpdateFileConcurrentSaves(t *testing.T) {
+	db := testDatabase(t)
+	hub := testHub(NewMemoryBroker())
+	fc := NewFileController(db, nil, NewDocumentManager(db, hub), NewYjsManager(db, hub, "content"))
+	host := primitive.NewObjectID()
+	file := testFile(t, db, host, "0\n1\n2\n3\n4\n5\n6\n7\n")
+
+	// Each save changes its own line from version 1; all of them must end
+	// up in the file, each as a version of its own
+	const saves = 4
+	codes := make(chan int, saves)
+	for i := 0; i < saves; i++ {
+		lines := []byte("0\n1\n2\n3\n4\n5\n6\n7\n")
+		lines[4*i] = 'x'
+		body := fmt.Sprintf(`{"content": %q, "base_version": 1}`, lines)
+		go func() {
+			params := gin.Params{{Key: "id", Value: file.ID.Hex()}}
+			codes <- serveTest(fc.UpdateFile, http.MethodPut, params, host, body).Code
+		}()
+	}
+	saved := 0
+	for i := 0; i < saves; i++ {
+		if code := <-codes; code == http.StatusOK {
+			saved++
+		}
+	}
+
+	head := fileAt(t, db, file.ID)
+	if head.Version != 1+saved {
+		t.Errorf("file is at version %d after %d saves", head.Version, saved)
+	}
+	for v := 2; v <= head.Version; v++ {
+		if _, err := loadFileVersion(context.Background(), fc.fileVersionCollection, file.ID, v); err != nil {
+			t.Errorf("version %d is missing from the history: %v", v, err)
+		}
+	}
+	if saved == saves && head.Content != "x\n1\nx\n3\nx\n5\nx\n7\n" {
+		t.Errorf("file reads %q after every save merged", head.Content)
+	}
+}
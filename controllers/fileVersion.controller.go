@@ -0,0 +1,441 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// Page sizes for version history
+const (
+	defaultVersionPage = 50
+	maxVersionPage     = 200
+)
+
+// Unchanged lines shown around each difference in a version diff, unless
+// the request asks for another number
+const versionDiffContext = 3
+
+type FileVersionController struct {
+	fileVersionCollection  *mongo.Collection
+	fileCollection         *mongo.Collection
+	folderCollection       *mongo.Collection
+	sessionCollection      *mongo.Collection
+	collaboratorCollection *mongo.Collection
+	userCollection         *mongo.Collection
+	documents              *DocumentManager
+	yjs                    *YjsManager
+}
+
+// Constructor for FileVersionController
+func NewFileVersionController(db *mongo.Database, documents *DocumentManager, yjs *YjsManager) *FileVersionController {
+	fvc := &FileVersionController{
+		fileVersionCollection:  db.Collection("file_versions"),
+		fileCollection:         db.Collection("files"),
+		folderCollection:       db.Collection("folders"),
+		sessionCollection:      db.Collection("sessions"),
+		collaboratorCollection: db.Collection("collaborators"),
+		userCollection:         db.Collection("users"),
+		documents:              documents,
+		yjs:                    yjs,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := fvc.fileVersionCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "version", Value: -1}},
+	})
+	if err != nil {
+		log.Println("Error creating file version indexes:", err)
+	}
+	return fvc
+}
+
+// fileVersionEntry is a version as listed in a file's history
+type fileVersionEntry struct {
+	Version      int                `json:"version"`
+	EditedBy     primitive.ObjectID `json:"edited_by"`
+	Editor       string             `json:"editor"`
+	EditedAt     time.Time          `json:"edited_at"`
+	RestoredFrom int                `json:"restored_from,omitempty"`
+}
+
+// ListVersions lists the versions of a file, newest first, with who saved
+// each and when. GetVersion has their content.
+func (fvc *FileVersionController) ListVersions(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultVersionPage)))
+	if err != nil || limit < 1 || limit > maxVersionPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxVersionPage)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	file, ok := fvc.requireFileMember(c, ctx)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"file_id": file.ID}
+	total, err := fvc.fileVersionCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count versions"})
+		return
+	}
+	cursor, err := fvc.fileVersionCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "version", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64((page-1)*limit)).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"content": 0, "delta": 0}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve versions"})
+		return
+	}
+	var versions []models.FileVersion
+	if err := cursor.All(ctx, &versions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode versions"})
+		return
+	}
+
+	editors := make([]primitive.ObjectID, 0, len(versions))
+	for _, version := range versions {
+		editors = append(editors, version.EditedBy)
+	}
+	names, err := usernames(ctx, fvc.userCollection, editors)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve editors"})
+		return
+	}
+
+	entries := make([]fileVersionEntry, 0, len(versions))
+	for _, version := range versions {
+		entries = append(entries, fileVersionEntry{
+			Version:      version.Version,
+			EditedBy:     version.EditedBy,
+			Editor:       names[version.EditedBy],
+			EditedAt:     version.EditedAt,
+			RestoredFrom: version.RestoredFrom,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": entries, "head": file.Version, "total": total, "page": page, "limit": limit})
+}
+
+// GetVersion returns one version of a file with its content
+func (fvc *FileVersionController) GetVersion(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	file, ok := fvc.requireFileMember(c, ctx)
+	if !ok {
+		return
+	}
+
+	version, err := loadFileVersion(ctx, fvc.fileVersionCollection, file.ID, number)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve version"})
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// DiffVersions compares two versions of a file, given as from and to. To
+// defaults to the head version and from to the one before to. With
+// format=unified the diff comes as diff -u text, otherwise as hunks of
+// lines; context sets how many unchanged lines surround each change.
+func (fvc *FileVersionController) DiffVersions(c *gin.Context) {
+	contextLines, err := strconv.Atoi(c.DefaultQuery("context", strconv.Itoa(versionDiffContext)))
+	if err != nil || contextLines < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid context"})
+		return
+	}
+	format := c.DefaultQuery("format", "lines")
+	if format != "lines" && format != "unified" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be lines or unified"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	file, ok := fvc.requireFileMember(c, ctx)
+	if !ok {
+		return
+	}
+
+	to, err := strconv.Atoi(c.DefaultQuery("to", strconv.Itoa(file.Version)))
+	if err != nil || to < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to version"})
+		return
+	}
+	from, err := strconv.Atoi(c.DefaultQuery("from", strconv.Itoa(to-1)))
+	if err != nil || from < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from version"})
+		return
+	}
+
+	// Version 0 is the empty file before the first save
+	var contents [2]string
+	for i, number := range []int{from, to} {
+		if number == 0 {
+			continue
+		}
+		version, err := loadFileVersion(ctx, fvc.fileVersionCollection, file.ID, number)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Version %d not found", number)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve version"})
+			return
+		}
+		contents[i] = version.Content
+	}
+
+	hunks := utils.DiffHunks(utils.DiffLines(utils.SplitLines(contents[0]), utils.SplitLines(contents[1])), contextLines)
+	if format == "unified" {
+		diff := utils.UnifiedDiff(fmt.Sprintf("%s@%d", file.Name, from), fmt.Sprintf("%s@%d", file.Name, to), hunks)
+		c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "diff": diff})
+		return
+	}
+	if hunks == nil {
+		hunks = []utils.DiffHunk{}
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "hunks": hunks})
+}
+
+// RestoreVersion brings back the content of an old version as a new head
+// version, leaving the history in between untouched
+func (fvc *FileVersionController) RestoreVersion(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	file, ok := fvc.requireFileMember(c, ctx)
+	if !ok {
+		return
+	}
+
+	old, err := loadFileVersion(ctx, fvc.fileVersionCollection, file.ID, number)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve version"})
+		return
+	}
+
+	// The head version is written only if the file was not saved since it
+	// was read, together with its history record
+	var version models.FileVersion
+	err = runTransaction(ctx, fvc.fileCollection.Database().Client(), func(sc mongo.SessionContext) error {
+		var current models.File
+		if err := fvc.fileCollection.FindOne(sc, bson.M{"_id": file.ID}).Decode(&current); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result, err := fvc.fileCollection.UpdateOne(sc,
+			bson.M{"_id": file.ID, "version": current.Version},
+			bson.M{"$set": bson.M{
+				"content":        old.Content,
+				"version":        current.Version + 1,
+				"updated_at":     now,
+				"last_edited_by": userID,
+			}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errFileChanged
+		}
+
+		version = models.FileVersion{
+			ID:           primitive.NewObjectID(),
+			FileID:       file.ID,
+			Content:      old.Content,
+			Version:      current.Version + 1,
+			EditedBy:     userID,
+			EditedAt:     now,
+			RestoredFrom: number,
+		}
+		return recordFileVersion(sc, fvc.fileVersionCollection, version, current.Content)
+	})
+
+	if err == errFileChanged || isTransientTransactionError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "File was saved during the restore, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file"})
+		return
+	}
+
+	// Editors with the file open live get the restored content
+	if err := fvc.documents.Reset(ctx, file.ID); err != nil {
+		log.Println("Error resetting live document:", err)
+	}
+	if err := fvc.yjs.Reset(ctx, file.ID); err != nil {
+		log.Println("Error resetting Yjs document:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Version restored", "version": version})
+}
+
+// blameLine says which version last changed a line of a file, and who saved
+// it when
+type blameLine struct {
+	Line     int                `json:"line"`
+	Text     string             `json:"text"`
+	Version  int                `json:"version"`
+	EditedBy primitive.ObjectID `json:"edited_by"`
+	Editor   string             `json:"editor"`
+	EditedAt time.Time          `json:"edited_at"`
+}
+
+// Blame tells for every line of a file's current content the version that
+// last changed it and who saved that version when
+func (fvc *FileVersionController) Blame(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	file, ok := fvc.requireFileMember(c, ctx)
+	if !ok {
+		return
+	}
+
+	// Replay the history keeping, for each line, the version that wrote it
+	var history []models.FileVersion
+	var owners []int
+	previous := ""
+	step := func(version models.FileVersion, delta []models.DeltaOp) {
+		next := make([]int, 0, len(owners))
+		pos := 0
+		for _, op := range delta {
+			next = append(next, owners[pos:pos+op.Keep]...)
+			pos += op.Keep + op.Drop
+			for range op.Add {
+				next = append(next, len(history))
+			}
+		}
+		owners = next
+		history = append(history, version)
+	}
+	err := eachFileVersion(ctx, fvc.fileVersionCollection, file.ID, func(record models.FileVersion, content string) error {
+		delta := record.Delta
+		if !record.IsDelta {
+			delta = utils.LineDelta(previous, content)
+		}
+		// eachFileVersion has checked the delta fits
+		step(record, delta)
+		previous = content
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file history"})
+		return
+	}
+	// A save whose version failed to record is put down to the last editor
+	if len(history) == 0 || previous != file.Content {
+		step(models.FileVersion{
+			Version:  file.Version,
+			EditedBy: file.LastEditedBy,
+			EditedAt: file.UpdatedAt,
+		}, utils.LineDelta(previous, file.Content))
+	}
+
+	editors := make([]primitive.ObjectID, 0, len(history))
+	for _, version := range history {
+		editors = append(editors, version.EditedBy)
+	}
+	names, err := usernames(ctx, fvc.userCollection, editors)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve editors"})
+		return
+	}
+
+	lines := make([]blameLine, 0, len(owners))
+	for i, text := range utils.SplitLines(file.Content) {
+		version := history[owners[i]]
+		lines = append(lines, blameLine{
+			Line:     i + 1,
+			Text:     text,
+			Version:  version.Version,
+			EditedBy: version.EditedBy,
+			Editor:   names[version.EditedBy],
+			EditedAt: version.EditedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "version": file.Version, "lines": lines})
+}
+
+// requireFileMember loads the file named in the request path and checks the
+// user belongs to its session, writing the error response when not
+func (fvc *FileVersionController) requireFileMember(c *gin.Context, ctx context.Context) (models.File, bool) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("file_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return models.File{}, false
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return models.File{}, false
+	}
+
+	var file models.File
+	if err := fvc.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return models.File{}, false
+	}
+	sessionID, err := fileSessionID(ctx, fvc.fileCollection, fvc.folderCollection, fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return models.File{}, false
+	}
+	if !requireSessionMember(c, fvc.sessionCollection, fvc.collaboratorCollection, sessionID, userID) {
+		return models.File{}, false
+	}
+	return file, true
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"codeCollab-backend/models"
+)
+
+func testFileVersionController(db *mongo.Database) *FileVersionController {
+	hub := testHub(NewMemoryBroker())
+	return NewFileVersionController(db, NewDocumentManager(db, hub), NewYjsManager(db, hub, "content"))
+}
+
+func TestRestoreVersion(t *testing.T) {
+	db := testDatabase(t)
+	fvc := testFileVersionController(db)
+	host := primitive.NewObjectID()
+	file := testFile(t, db, host, "one\n")
+	saveTestVersion(t, db, &file, host, "one\ntwo\n")
+
+	restore := func(version string) int {
+		params := gin.Params{{Key: "file_id", Value: file.ID.Hex()}, {Key: "version", Value: version}}
+		return serveTest(fvc.RestoreVersion, http.MethodPost, params, host, "").Code
+	}
+
+	if code := restore("1"); code != http.StatusOK {
+		t.Fatalf("restore answered %d", code)
+	}
+	head := fileAt(t, db, file.ID)
+	if head.Version != 3 || head.Content != "one\n" {
+		t.Errorf("file is at version %d with %q, want version 3 with %q", head.Version, head.Content, "one\n")
+	}
+	version, err := loadFileVersion(context.Background(), fvc.fileVersionCollection, file.ID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Content != "one\n" || version.RestoredFrom != 1 {
+		t.Errorf("version 3 holds %q restored from %d, want %q restored from 1", version.Content, version.RestoredFrom, "one\n")
+	}
+
+	if code := restore("9"); code != http.StatusNotFound {
+		t.Errorf("restoring a missing version answered %d, want 404", code)
+	}
+	if head := fileAt(t, db, file.ID); head.Version != 3 {
+		t.Errorf("failed restore moved the file to version %d", head.Version)
+	}
+
+	// Someone else is not a member of the session
+	params := gin.Params{{Key: "file_id", Value: file.ID.Hex()}, {Key: "version", Value: "2"}}
+	if code := serveTest(fvc.RestoreVersion, http.MethodPost, params, primitive.NewObjectID(), "").Code; code != http.StatusForbidden {
+		t.Errorf("restore by a stranger answered %d, want 403", code)
+	}
+}
+
+// blame asks who last changed each line of a file
+func blame(t *testing.T, fvc *FileVersionController, fileID, userID primitive.ObjectID) []blameLine {
+	t.Helper()
+	params := gin.Params{{Key: "file_id", Value: fileID.Hex()}}
+	w := serveTest(fvc.Blame, http.MethodGet, params, userID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("blame answered %d: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Lines []blameLine `json:"lines"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Lines
+}
+
+func TestBlame(t *testing.T) {
+	db := testDatabase(t)
+	fvc := testFileVersionController(db)
+	host, alice := primitive.NewObjectID(), primitive.NewObjectID()
+	users := []interface{}{
+		models.User{ID: host, Username: "host"},
+		models.User{ID: alice, Username: "alice"},
+	}
+	if _, err := db.Collection("users").InsertMany(context.Background(), users); err != nil {
+		t.Fatal(err)
+	}
+
+	file := testFile(t, db, host, "a\nb\nc\n")
+	saveTestVersion(t, db, &file, alice, "a\nB\nc\nd\n")
+	saveTestVersion(t, db, &file, host, "a\nB\nd\n")
+
+	want := []blameLine{
+		{Line: 1, Text: "a", Version: 1, EditedBy: host, Editor: "host"},
+		{Line: 2, Text: "B", Version: 2, EditedBy: alice, Editor: "alice"},
+		{Line: 3, Text: "d", Version: 2, EditedBy: alice, Editor: "alice"},
+	}
+	lines := blame(t, fvc, file.ID, host)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		line.EditedAt = want[i].EditedAt
+		if line != want[i] {
+			t.Errorf("line %d: got %+v, want %+v", i+1, line, want[i])
+		}
+	}
+}
+
+func TestBlameAcrossSnapshots(t *testing.T) {
+	db := testDatabase(t)
+	fvc := testFileVersionController(db)
+	host := primitive.NewObjectID()
+
+	// Every version appends a line, so line n was written by version n;
+	// most versions are stored as deltas
+	content := "line 1\n"
+	file := testFile(t, db, host, content)
+	for v := 2; v <= 2*versionSnapshotInterval+5; v++ {
+		content += fmt.Sprintf("line %d\n", v)
+		saveTestVersion(t, db, &file, host, content)
+	}
+
+	lines := blame(t, fvc, file.ID, host)
+	if len(lines) != file.Version {
+		t.Fatalf("got %d lines, want %d", len(lines), file.Version)
+	}
+	for i, line := range lines {
+		if line.Version != i+1 || line.Text != fmt.Sprintf("line %d", i+1) {
+			t.Errorf("line %d %q put down to version %d", i+1, line.Text, line.Version)
+		}
+	}
+}
+
+func TestBlameUnrecordedSave(t *testing.T) {
+	db := testDatabase(t)
+	fvc := testFileVersionController(db)
+	host, alice := primitive.NewObjectID(), primitive.NewObjectID()
+	file := testFile(t, db, host, "a\nb\n")
+
+	// A save whose version record is missing is put down to the last editor
+	_, err := db.Collection("files").UpdateOne(context.Background(),
+		bson.M{"_id": file.ID},
+		bson.M{"$set": bson.M{"content": "a\nb\nc\n", "version": 2, "last_edited_by": alice}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, line := range blame(t, fvc, file.ID, host) {
+		got = append(got, fmt.Sprintf("%s:%d:%s", line.Text, line.Version, line.EditedBy.Hex()))
+	}
+	want := []string{
+		fmt.Sprintf("a:1:%s", host.Hex()),
+		fmt.Sprintf("b:1:%s", host.Hex()),
+		fmt.Sprintf("c:2:%s", alice.Hex()),
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// Every this many versions one is stored in full, bounding how many deltas
+// rebuilding a version takes
+const versionSnapshotInterval = 20
+
+// errVersionChainBroken is returned when a delta version cannot be rebuilt
+// because a version before it is missing
+var errVersionChainBroken = errors.New("file version history is incomplete")
+
+// errFileChanged is returned inside a transaction when a file was saved
+// after it was read there, so the transaction writes nothing
+var errFileChanged = errors.New("file was saved concurrently")
+
+// isSnapshotVersion reports whether a version number is due to be stored in full
+func isSnapshotVersion(version int) bool {
+	return (version-1)%versionSnapshotInterval == 0
+}
+
+// recordFileVersion saves a new version of a file whose content was
+// previous just before it. It is stored as a delta from the version before
+// unless it is due for a snapshot or that version is missing.
+func recordFileVersion(ctx context.Context, versions *mongo.Collection, version models.FileVersion, previous string) error {
+	if !isSnapshotVersion(version.Version) {
+		count, err := versions.CountDocuments(ctx, bson.M{"file_id": version.FileID, "version": version.Version - 1})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			version.Delta = utils.LineDelta(previous, version.Content)
+			version.IsDelta = true
+			version.Content = ""
+		}
+	}
+	_, err := versions.InsertOne(ctx, version)
+	return err
+}
+
+// loadFileVersion reads one version of a file, rebuilding its content from
+// the snapshot before it when it is stored as a delta
+func loadFileVersion(ctx context.Context, versions *mongo.Collection, fileID primitive.ObjectID, version int) (models.FileVersion, error) {
+	// Saves that raced each other may have recorded a version twice; the
+	// later record holds what the file was left with
+	cursor, err := versions.Find(ctx,
+		bson.M{"file_id": fileID, "version": bson.M{"$lte": version}},
+		options.Find().SetSort(bson.D{{Key: "version", Value: -1}, {Key: "_id", Value: -1}}),
+	)
+	if err != nil {
+		return models.FileVersion{}, err
+	}
+	defer cursor.Close(ctx)
+
+	// Walk back to the nearest full version, then replay the deltas forward
+	var chain []models.FileVersion
+	for cursor.Next(ctx) {
+		var record models.FileVersion
+		if err := cursor.Decode(&record); err != nil {
+			return models.FileVersion{}, err
+		}
+		if len(chain) > 0 && record.Version == chain[len(chain)-1].Version {
+			continue
+		}
+		if len(chain) == 0 && record.Version != version {
+			return models.FileVersion{}, mongo.ErrNoDocuments
+		}
+		if len(chain) > 0 && record.Version != chain[len(chain)-1].Version-1 {
+			return models.FileVersion{}, errVersionChainBroken
+		}
+		chain = append(chain, record)
+		if !record.IsDelta {
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return models.FileVersion{}, err
+	}
+	if len(chain) == 0 {
+		return models.FileVersion{}, mongo.ErrNoDocuments
+	}
+	if chain[len(chain)-1].IsDelta {
+		return models.FileVersion{}, errVersionChainBroken
+	}
+
+	content := chain[len(chain)-1].Content
+	for i := len(chain) - 2; i >= 0; i-- {
+		if content, err = utils.ApplyLineDelta(content, chain[i].Delta); err != nil {
+			return models.FileVersion{}, fmt.Errorf("rebuilding version %d: %w", chain[i].Version, err)
+		}
+	}
+
+	target := chain[0]
+	target.Content = content
+	target.IsDelta = false
+	target.Delta = nil
+	return target, nil
+}
+
+// eachFileVersion walks the versions of a file from the first, passing each
+// with its full content. Of several records of one version only the last is
+// passed, as loadFileVersion would read it.
+func eachFileVersion(ctx context.Context, versions *mongo.Collection, fileID interface{}, fn func(record models.FileVersion, content string) error) error {
+	cursor, err := versions.Find(ctx,
+		bson.M{"file_id": fileID},
+		options.Find().SetSort(bson.D{{Key: "version", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	previous, previousVersion := "", 0
+	visit := func(record models.FileVersion) error {
+		content := record.Content
+		if record.IsDelta {
+			if previousVersion != record.Version-1 {
+				return errVersionChainBroken
+			}
+			if content, err = utils.ApplyLineDelta(previous, record.Delta); err != nil {
+				return fmt.Errorf("rebuilding version %d: %w", record.Version, err)
+			}
+		}
+		if err := fn(record, content); err != nil {
+			return err
+		}
+		previous, previousVersion = content, record.Version
+		return nil
+	}
+
+	// Each record is held until the next one shows it was not superseded
+	var held *models.FileVersion
+	for cursor.Next(ctx) {
+		var record models.FileVersion
+		if err := cursor.Decode(&record); err != nil {
+			return err
+		}
+		if held != nil && held.Version != record.Version {
+			if err := visit(*held); err != nil {
+				return err
+			}
+		}
+		held = &record
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if held != nil {
+		return visit(*held)
+	}
+	return nil
+}
+
+// CompactFileVersions rewrites versions stored in full as deltas, keeping a
+// snapshot every versionSnapshotInterval versions. It can be run again
+// safely; versions already compacted are left as they are.
+func CompactFileVersions(ctx context.Context, db *mongo.Database) (compacted int, err error) {
+	versions := db.Collection("file_versions")
+
+	var fileIDs []interface{}
+	if fileIDs, err = versions.Distinct(ctx, "file_id", bson.M{"is_delta": bson.M{"$ne": true}}); err != nil {
+		return 0, err
+	}
+
+	for _, fileID := range fileIDs {
+		previous, previousVersion := "", 0
+		err := eachFileVersion(ctx, versions, fileID, func(record models.FileVersion, content string) error {
+			defer func() { previous, previousVersion = content, record.Version }()
+			if record.IsDelta || isSnapshotVersion(record.Version) || previousVersion != record.Version-1 {
+				return nil
+			}
+			_, err := versions.UpdateOne(ctx,
+				bson.M{"_id": record.ID},
+				bson.M{
+					"$set":   bson.M{"is_delta": true, "delta": utils.LineDelta(previous, content)},
+					"$unset": bson.M{"content": ""},
+				},
+			)
+			if err != nil {
+				return err
+			}
+			compacted++
+			return nil
+		})
+		if err != nil {
+			return compacted, fmt.Errorf("file %v: %w", fileID, err)
+		}
+	}
+	return compacted, nil
+}
+
+// usernames resolves user IDs to usernames, leaving out users that no
+// longer exist
+func usernames(ctx context.Context, users *mongo.Collection, ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	names := make(map[primitive.ObjectID]string, len(ids))
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	cursor, err := users.Find(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"username": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var found []models.User
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, user := range found {
+		names[user.ID] = user.Username
+	}
+	return names, nil
+}
@@ -58,6 +58,7 @@ func (fc *FolderController) CreateFolder(c *gin.Context) {
 	newFolder := models.Folder{
 		ID:        folderID,
 		UserID:    userObjectID,
+		SessionID: folder.SessionID,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		Name:      folder.Name,
@@ -0,0 +1,608 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/config"
+)
+
+// Reasons a connection ended, reported to the room when the user leaves
+const (
+	CloseReasonClosed  = "closed"
+	CloseReasonTimeout = "timeout"
+	CloseReasonIdle    = "idle"
+	CloseReasonEvicted = "evicted"
+)
+
+// errClientGone is returned when a frame cannot be queued for a client
+var errClientGone = errors.New("client is too slow or disconnected")
+
+// How long a claim on a session's live documents lasts without being used.
+// Claims are renewed through the broker once half of it has passed.
+const sessionClaimTTL = 30 * time.Second
+
+// frame is a message waiting in a client's send queue
+type frame struct {
+	messageType int
+	data        []byte
+}
+
+// Client is a single WebSocket connection that belongs to one session room.
+// All writes go through a buffered queue drained by the client's own writer
+// goroutine, so a slow socket never blocks anyone else.
+type Client struct {
+	id        string
+	conn      *websocket.Conn
+	hub       *Hub
+	sessionID string
+	userID    string
+
+	send      chan frame
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Unix nanoseconds of the last frame received from the client
+	lastActivity atomic.Int64
+	// Why the server closed the connection, if it did
+	closeReason atomic.Value
+}
+
+// NewClient wraps an upgraded connection of an authenticated user for the
+// given session room and starts its writer
+func (h *Hub) NewClient(conn *websocket.Conn, sessionID, userID string) *Client {
+	client := &Client{
+		id:        primitive.NewObjectID().Hex(),
+		conn:      conn,
+		hub:       h,
+		sessionID: sessionID,
+		userID:    userID,
+		send:      make(chan frame, h.config.SendQueueSize),
+		done:      make(chan struct{}),
+	}
+	client.lastActivity.Store(time.Now().UnixNano())
+
+	// Drop peers that stop answering pings and refuse oversized frames
+	conn.SetReadLimit(h.config.MaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(h.config.PingInterval + h.config.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.config.PingInterval + h.config.PongTimeout))
+	})
+
+	go client.writePump()
+	return client
+}
+
+// Touch records a frame from the client; it counts as liveness and activity
+func (cl *Client) Touch() {
+	cl.lastActivity.Store(time.Now().UnixNano())
+	cl.conn.SetReadDeadline(time.Now().Add(cl.hub.config.PingInterval + cl.hub.config.PongTimeout))
+}
+
+// CloseReason explains why the connection ended. Connections the server did
+// not close itself either timed out or were closed by the peer.
+func (cl *Client) CloseReason(readErr error) string {
+	if reason, ok := cl.closeReason.Load().(string); ok {
+		return reason
+	}
+	if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() {
+		return CloseReasonTimeout
+	}
+	return CloseReasonClosed
+}
+
+// SessionID returns the room the client is a member of
+func (cl *Client) SessionID() string {
+	return cl.sessionID
+}
+
+// UserID returns the server-verified user behind the connection
+func (cl *Client) UserID() string {
+	return cl.userID
+}
+
+// Send queues a frame for this client only
+func (cl *Client) Send(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return cl.sendFrame(frame{websocket.TextMessage, data})
+}
+
+// SendBinary queues a binary frame for this client only
+func (cl *Client) SendBinary(data []byte) error {
+	return cl.sendFrame(frame{websocket.BinaryMessage, data})
+}
+
+// sendFrame queues a frame and evicts the client if it cannot keep up
+func (cl *Client) sendFrame(f frame) error {
+	err := cl.queue(f)
+	if err != nil {
+		cl.hub.evict(cl)
+	}
+	return err
+}
+
+// CloseWith queues a close frame; the writer closes the connection once it
+// has been sent
+func (cl *Client) CloseWith(code int, text string) {
+	cl.queue(frame{websocket.CloseMessage, websocket.FormatCloseMessage(code, text)})
+}
+
+// Close stops the writer and closes the connection straight away
+func (cl *Client) Close() {
+	cl.closeOnce.Do(func() {
+		close(cl.done)
+		cl.conn.Close()
+	})
+}
+
+// queue puts a frame in the send queue without blocking. A full queue is
+// reported to the caller, which must evict the client once it holds no locks.
+func (cl *Client) queue(f frame) error {
+	select {
+	case <-cl.done:
+		return errClientGone
+	default:
+	}
+
+	select {
+	case cl.send <- f:
+		return nil
+	default:
+		return errClientGone
+	}
+}
+
+// writePump drains the send queue onto the connection, pings the peer and
+// closes connections that have gone quiet for too long
+func (cl *Client) writePump() {
+	config := cl.hub.config
+	ticker := time.NewTicker(config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		cl.Close()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, cl.lastActivity.Load()))
+			if config.IdleTimeout > 0 && idle > config.IdleTimeout {
+				cl.closeReason.Store(CloseReasonIdle)
+				cl.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+				cl.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"))
+				return
+			}
+			if err := cl.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.WriteTimeout)); err != nil {
+				return
+			}
+		case f := <-cl.send:
+			cl.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if err := cl.conn.WriteMessage(f.messageType, f.data); err != nil {
+				log.Println("Error writing message:", err)
+				return
+			}
+			cl.hub.framesSent.Add(1)
+			if f.messageType == websocket.CloseMessage {
+				return
+			}
+		case <-cl.done:
+			return
+		}
+	}
+}
+
+// HubStats is a snapshot of the hub's connections and counters
+type HubStats struct {
+	Rooms          int    `json:"rooms"`
+	Clients        int    `json:"clients"`
+	FramesSent     uint64 `json:"frames_sent"`
+	FramesDropped  uint64 `json:"frames_dropped"`
+	ClientsEvicted uint64 `json:"clients_evicted"`
+	PublishErrors  uint64 `json:"publish_errors"`
+}
+
+// loggedFrame is a broadcast kept for replay to reconnecting clients
+type loggedFrame struct {
+	seq  uint64
+	data []byte
+}
+
+// room is one session's connections plus the recent broadcasts sent to it.
+// The epoch changes whenever the room is recreated, so sequence numbers from
+// an older incarnation are never mistaken for current ones.
+type room struct {
+	sync.Mutex
+	clients    map[*Client]bool
+	epoch      string
+	seq        uint64
+	backlog    []loggedFrame
+	emptySince time.Time
+	deleted    bool
+}
+
+// ResumeState is what a reconnecting client last saw of its room
+type ResumeState struct {
+	Epoch   string `json:"epoch"`
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// Hub keeps WebSocket connections grouped by session so a message is only
+// fanned out to the members of the room it was sent to. Broadcasts go through
+// the broker so members connected to other server instances get them too.
+type Hub struct {
+	sync.RWMutex
+	rooms  map[string]*room
+	config config.WebSocketConfig
+	broker Broker
+
+	// Sessions whose live documents this instance owns, until when the
+	// claim is trusted without asking the broker again
+	claimsMu sync.Mutex
+	claims   map[string]time.Time
+
+	// Receivers of broker messages that are not room broadcasts, by kind
+	handlers map[string]func(BrokerMessage)
+
+	framesSent     atomic.Uint64
+	framesDropped  atomic.Uint64
+	clientsEvicted atomic.Uint64
+	publishErrors  atomic.Uint64
+}
+
+// NewHub creates an empty hub whose connections follow the given limits and
+// whose broadcasts travel through the broker
+func NewHub(cfg config.WebSocketConfig, broker Broker) *Hub {
+	h := &Hub{
+		rooms:    make(map[string]*room),
+		config:   cfg,
+		broker:   broker,
+		claims:   make(map[string]time.Time),
+		handlers: make(map[string]func(BrokerMessage)),
+	}
+	broker.Subscribe(h.deliver, h.lost)
+	go h.sweepRooms()
+	return h
+}
+
+// room returns a session's room, creating it when create is set
+func (h *Hub) room(sessionID string, create bool) *room {
+	h.RLock()
+	r, ok := h.rooms[sessionID]
+	h.RUnlock()
+	if ok || !create {
+		return r
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if r, ok := h.rooms[sessionID]; ok {
+		return r
+	}
+	r = &room{
+		clients:    make(map[*Client]bool),
+		epoch:      primitive.NewObjectID().Hex(),
+		emptySince: time.Now(),
+	}
+	h.rooms[sessionID] = r
+	return r
+}
+
+// Join adds a client to its session room. greet builds the welcome frame from
+// the room's epoch and latest sequence number; it runs under the room lock so
+// the welcome is queued ahead of any broadcast. When resume names this room's epoch, every
+// logged frame after resume.LastSeq is replayed; Join reports false when
+// resume was asked for but the gap can no longer be replayed.
+func (h *Hub) Join(client *Client, resume *ResumeState, greet func(epoch string, seq uint64) Envelope) bool {
+	for {
+		r := h.room(client.sessionID, true)
+
+		r.Lock()
+		if r.deleted {
+			// Swept between lookup and lock; fetch a fresh room
+			r.Unlock()
+			continue
+		}
+		r.clients[client] = true
+
+		var overflowed bool
+		if greet != nil {
+			data, err := json.Marshal(greet(r.epoch, r.seq))
+			if err != nil {
+				log.Println("Error encoding message:", err)
+			} else if client.queue(frame{websocket.TextMessage, data}) != nil {
+				overflowed = true
+			}
+		}
+
+		resumed := resume == nil
+		if !overflowed && resume != nil && resume.Epoch == r.epoch && resume.LastSeq <= r.seq && r.canReplayFrom(resume.LastSeq) {
+			resumed = true
+			for _, logged := range r.backlog {
+				if logged.seq <= resume.LastSeq {
+					continue
+				}
+				if client.queue(frame{websocket.TextMessage, logged.data}) != nil {
+					overflowed = true
+					break
+				}
+			}
+		}
+		r.Unlock()
+
+		if overflowed {
+			h.evict(client)
+		}
+		return resumed
+	}
+}
+
+// canReplayFrom reports whether every frame after lastSeq is still logged;
+// the room lock must be held
+func (r *room) canReplayFrom(lastSeq uint64) bool {
+	if lastSeq == r.seq {
+		return true
+	}
+	return len(r.backlog) > 0 && r.backlog[0].seq <= lastSeq+1
+}
+
+// Leave removes a client from its room. Empty rooms keep their backlog for a
+// while so members coming back from a short disconnect can still resume.
+func (h *Hub) Leave(client *Client) {
+	r := h.room(client.sessionID, false)
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.clients[client]; !ok {
+		return
+	}
+	delete(r.clients, client)
+	if len(r.clients) == 0 {
+		r.emptySince = time.Now()
+	}
+}
+
+// sweepRooms drops rooms that have been empty for longer than the retention
+func (h *Hub) sweepRooms() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.Lock()
+		for sessionID, r := range h.rooms {
+			r.Lock()
+			if len(r.clients) == 0 && time.Since(r.emptySince) > h.config.RoomRetention {
+				r.deleted = true
+				delete(h.rooms, sessionID)
+			}
+			r.Unlock()
+		}
+		h.Unlock()
+	}
+}
+
+// RoomSize reports how many clients are connected to a session room
+func (h *Hub) RoomSize(sessionID string) int {
+	r := h.room(sessionID, false)
+	if r == nil {
+		return 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	return len(r.clients)
+}
+
+// Stats reports the current rooms and the delivery counters
+func (h *Hub) Stats() HubStats {
+	h.RLock()
+	stats := HubStats{Rooms: len(h.rooms)}
+	for _, r := range h.rooms {
+		r.Lock()
+		stats.Clients += len(r.clients)
+		r.Unlock()
+	}
+	h.RUnlock()
+
+	stats.FramesSent = h.framesSent.Load()
+	stats.FramesDropped = h.framesDropped.Load()
+	stats.ClientsEvicted = h.clientsEvicted.Load()
+	stats.PublishErrors = h.publishErrors.Load()
+	return stats
+}
+
+// evict disconnects a client whose send queue overflowed. Dropping frames
+// silently would leave its editor out of sync, so it has to reconnect.
+func (h *Hub) evict(client *Client) {
+	h.framesDropped.Add(1)
+
+	select {
+	case <-client.done:
+		return
+	default:
+	}
+	h.clientsEvicted.Add(1)
+	client.closeReason.Store(CloseReasonEvicted)
+	log.Printf("Evicting slow client %s from session %s", client.userID, client.sessionID)
+	h.Leave(client)
+	client.Close()
+}
+
+// Claim reports whether this instance may change a session's live
+// documents, claiming the session through the broker when its claim is due
+// for renewal. acquired is set when the session was owned elsewhere before,
+// so documents kept from an earlier claim have to be brought up to date.
+func (h *Hub) Claim(ctx context.Context, sessionID string) (owned, acquired bool, err error) {
+	h.claimsMu.Lock()
+	trusted := time.Now().Before(h.claims[sessionID])
+	h.claimsMu.Unlock()
+	if trusted {
+		return true, false, nil
+	}
+
+	start := time.Now()
+	owned, acquired, err = h.broker.Claim(ctx, sessionID, sessionClaimTTL)
+	h.claimsMu.Lock()
+	if owned {
+		h.claims[sessionID] = start.Add(sessionClaimTTL / 2)
+	} else {
+		delete(h.claims, sessionID)
+	}
+	h.claimsMu.Unlock()
+	return owned, acquired, err
+}
+
+// lost is called by the broker when broadcasts from other instances may have
+// been missed. Every room starts a new epoch, so the gap is never replayed
+// over, and its clients are told to reload.
+func (h *Hub) lost() {
+	log.Println("Broadcasts were lost; asking every client to resync")
+
+	h.RLock()
+	rooms := make(map[string]*room, len(h.rooms))
+	for sessionID, r := range h.rooms {
+		rooms[sessionID] = r
+	}
+	h.RUnlock()
+
+	var overflowed []*Client
+	for sessionID, r := range rooms {
+		data, err := json.Marshal(newEnvelope(MessageResync, sessionID, "", ResyncPayload{Reason: "messages from other servers were lost"}))
+		if err != nil {
+			log.Println("Error encoding message:", err)
+			continue
+		}
+
+		r.Lock()
+		r.epoch = primitive.NewObjectID().Hex()
+		r.backlog = nil
+		for client := range r.clients {
+			if client.queue(frame{websocket.TextMessage, data}) != nil {
+				overflowed = append(overflowed, client)
+			}
+		}
+		r.Unlock()
+	}
+
+	for _, client := range overflowed {
+		h.evict(client)
+	}
+}
+
+// Broadcast delivers a frame to every client in the frame's session room
+func (h *Hub) Broadcast(env Envelope) {
+	h.BroadcastFrom(nil, env)
+}
+
+// BroadcastFrom delivers a frame to every client in the frame's session room
+// except the sender, on this instance and on any other
+func (h *Hub) BroadcastFrom(sender *Client, env Envelope) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Println("Error encoding message:", err)
+		return
+	}
+
+	msg := BrokerMessage{SessionID: env.SessionID, Data: data, CreatedAt: time.Now()}
+	if sender != nil {
+		msg.SenderID = sender.id
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.broker.Publish(ctx, msg); err != nil {
+		h.publishErrors.Add(1)
+		log.Println("Error publishing message:", err)
+	}
+}
+
+// Handle registers the receiver of broker messages of a kind other than room
+// broadcasts. It must be called before the messages are published.
+func (h *Hub) Handle(kind string, handler func(BrokerMessage)) {
+	h.Lock()
+	h.handlers[kind] = handler
+	h.Unlock()
+}
+
+// Publish sends a broker message of a kind other than room broadcasts to
+// every instance
+func (h *Hub) Publish(ctx context.Context, msg BrokerMessage) error {
+	msg.CreatedAt = time.Now()
+	err := h.broker.Publish(ctx, msg)
+	if err != nil {
+		h.publishErrors.Add(1)
+	}
+	return err
+}
+
+// deliver hands a room broadcast to the local members of its room, and other
+// messages to the receiver of their kind. A broadcast is numbered and logged
+// for replay here, so sequence numbers and epochs are local to this
+// instance; the sender gets the frame too if it reconnects before seeing it.
+func (h *Hub) deliver(msg BrokerMessage) {
+	if msg.Kind != "" {
+		h.RLock()
+		handler := h.handlers[msg.Kind]
+		h.RUnlock()
+		if handler != nil {
+			handler(msg)
+		}
+		return
+	}
+
+	r := h.room(msg.SessionID, false)
+	if r == nil {
+		return
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(msg.Data, &env); err != nil {
+		log.Println("Error decoding broker message:", err)
+		return
+	}
+
+	var overflowed []*Client
+	r.Lock()
+	r.seq++
+	env.Seq = r.seq
+	data, err := json.Marshal(env)
+	if err != nil {
+		r.seq--
+		r.Unlock()
+		log.Println("Error encoding message:", err)
+		return
+	}
+
+	r.backlog = append(r.backlog, loggedFrame{seq: env.Seq, data: data})
+	if over := len(r.backlog) - h.config.ReplayBufferSize; over > 0 {
+		r.backlog = append(r.backlog[:0:0], r.backlog[over:]...)
+	}
+
+	for client := range r.clients {
+		if client.id == msg.SenderID {
+			continue
+		}
+		if client.queue(frame{websocket.TextMessage, data}) != nil {
+			overflowed = append(overflowed, client)
+		}
+	}
+	r.Unlock()
+
+	for _, client := range overflowed {
+		h.evict(client)
+	}
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/config"
+)
+
+// testClient is a connection without a socket; what the hub sends it stays
+// in its queue
+func testClient(h *Hub, sessionID string) *Client {
+	return &Client{
+		id:        primitive.NewObjectID().Hex(),
+		hub:       h,
+		sessionID: sessionID,
+		userID:    primitive.NewObjectID().Hex(),
+		send:      make(chan frame, 16),
+		done:      make(chan struct{}),
+	}
+}
+
+// received decodes the frames queued for a client
+func received(t *testing.T, client *Client) []Envelope {
+	t.Helper()
+	var envs []Envelope
+	for {
+		select {
+		case f := <-client.send:
+			var env Envelope
+			if err := json.Unmarshal(f.data, &env); err != nil {
+				t.Fatalf("decoding frame: %v", err)
+			}
+			envs = append(envs, env)
+		default:
+			return envs
+		}
+	}
+}
+
+func testHub(broker Broker) *Hub {
+	return NewHub(config.WebSocketConfig{ReplayBufferSize: 10}, broker)
+}
+
+func TestHubBroadcast(t *testing.T) {
+	h := testHub(NewMemoryBroker())
+	sessionID := primitive.NewObjectID().Hex()
+	sender, other := testClient(h, sessionID), testClient(h, sessionID)
+	outsider := testClient(h, primitive.NewObjectID().Hex())
+	for _, client := range []*Client{sender, other, outsider} {
+		h.Join(client, nil, nil)
+	}
+
+	h.BroadcastFrom(sender, newEnvelope(MessageChat, sessionID, sender.UserID(), ChatPayload{Text: "hi"}))
+	h.Broadcast(newEnvelope(MessageChat, sessionID, "", ChatPayload{Text: "all"}))
+
+	if got := received(t, sender); len(got) != 1 || got[0].Seq != 2 {
+		t.Errorf("sender got %+v, want only the second frame", got)
+	}
+	if got := received(t, other); len(got) != 2 || got[0].Seq != 1 || got[1].Seq != 2 {
+		t.Errorf("other member got %+v, want both frames in order", got)
+	}
+	if got := received(t, outsider); len(got) != 0 {
+		t.Errorf("member of another session got %+v", got)
+	}
+}
+
+func TestHubLostBroadcasts(t *testing.T) {
+	h := testHub(NewMemoryBroker())
+	sessionID := primitive.NewObjectID().Hex()
+	client := testClient(h, sessionID)
+
+	var epoch string
+	h.Join(client, nil, func(e string, seq uint64) Envelope {
+		epoch = e
+		return newEnvelope(MessageWelcome, sessionID, "", WelcomePayload{Epoch: e, Seq: seq})
+	})
+	h.Broadcast(newEnvelope(MessageChat, sessionID, "", ChatPayload{Text: "before"}))
+	received(t, client)
+
+	h.lost()
+
+	got := received(t, client)
+	if len(got) != 1 || got[0].Type != MessageResync {
+		t.Fatalf("got %+v, want a resync", got)
+	}
+
+	// What was logged before the gap can no longer be resumed from
+	returning := testClient(h, sessionID)
+	var newEpoch string
+	resumed := h.Join(returning, &ResumeState{Epoch: epoch, LastSeq: 0}, func(e string, seq uint64) Envelope {
+		newEpoch = e
+		return newEnvelope(MessageWelcome, sessionID, "", WelcomePayload{Epoch: e, Seq: seq})
+	})
+	if resumed || newEpoch == epoch {
+		t.Errorf("resumed %v in epoch %q, want a new epoch without resuming", resumed, newEpoch)
+	}
+	if got := received(t, returning); len(got) != 1 || got[0].Type != MessageWelcome {
+		t.Errorf("returning client got %+v, want only the welcome", got)
+	}
+}
+
+// claimBroker answers claims with a fixed result and counts them
+type claimBroker struct {
+	*MemoryBroker
+	owned, acquired bool
+	claims          int
+}
+
+func (b *claimBroker) Claim(ctx context.Context, sessionID string, ttl time.Duration) (bool, bool, error) {
+	b.claims++
+	return b.owned, b.acquired, nil
+}
+
+func TestHubClaim(t *testing.T) {
+	tests := []struct {
+		name       string
+		owned      bool
+		acquired   bool
+		wantClaims int
+	}{
+		{name: "taken over", owned: true, acquired: true, wantClaims: 1},
+		{name: "owned elsewhere", owned: false, wantClaims: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &claimBroker{MemoryBroker: NewMemoryBroker(), owned: tt.owned, acquired: tt.acquired}
+			h := testHub(broker)
+			sessionID := primitive.NewObjectID().Hex()
+
+			owned, acquired, err := h.Claim(context.Background(), sessionID)
+			if err != nil || owned != tt.owned || acquired != tt.acquired {
+				t.Fatalf("got %v, %v, %v, want %v, %v", owned, acquired, err, tt.owned, tt.acquired)
+			}
+			// A fresh claim is trusted without asking the broker; a refused
+			// one is asked for again
+			owned, acquired, _ = h.Claim(context.Background(), sessionID)
+			if owned != tt.owned || acquired {
+				t.Errorf("second claim got %v, %v, want %v, false", owned, acquired, tt.owned)
+			}
+			if broker.claims != tt.wantClaims {
+				t.Errorf("broker was asked %d times, want %d", broker.claims, tt.wantClaims)
+			}
+		})
+	}
+}
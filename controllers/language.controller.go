@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"codeCollab-backend/utils"
+)
+
+type LanguageController struct {
+	languages *utils.LanguageRegistry
+}
+
+// Constructor for LanguageController
+func NewLanguageController(languages *utils.LanguageRegistry) *LanguageController {
+	return &LanguageController{languages: languages}
+}
+
+// languageInfo is what clients are told about a registered language
+type languageInfo struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Version     string   `json:"version"`
+	Extensions  []string `json:"extensions"`
+	Entrypoints []string `json:"entrypoints"`
+	Compiled    bool     `json:"compiled"`
+}
+
+// GetLanguages lists the languages sessions and files can use
+func (lc *LanguageController) GetLanguages(c *gin.Context) {
+	languages := []languageInfo{}
+	for _, language := range lc.languages.All() {
+		languages = append(languages, languageInfo{
+			Name:        language.Name,
+			DisplayName: language.DisplayName,
+			Version:     language.Version,
+			Extensions:  language.Extensions,
+			Entrypoints: language.Entrypoints,
+			Compiled:    len(language.Compile) > 0,
+		})
+	}
+	c.JSON(http.StatusOK, languages)
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"codeCollab-backend/models"
+)
+
+// errSessionNotFound is returned when a membership check targets a missing session
+var errSessionNotFound = errors.New("session not found")
+
+// isSessionMember reports whether a user hosts a session or has been added
+// to it as a collaborator
+func isSessionMember(ctx context.Context, sessions, collaborators *mongo.Collection, sessionID, userID primitive.ObjectID) (bool, error) {
+	var session models.Session
+	err := sessions.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return false, errSessionNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if session.HostUserID == userID {
+		return true, nil
+	}
+
+	count, err := collaborators.CountDocuments(ctx, bson.M{"session_id": sessionID, "user_id": userID})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// requireSessionMember checks membership for a request and writes the error
+// response when the user may not access the session
+func requireSessionMember(c *gin.Context, sessions, collaborators *mongo.Collection, sessionID, userID primitive.ObjectID) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	member, err := isSessionMember(ctx, sessions, collaborators, sessionID, userID)
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session membership"})
+		return false
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Not a member of this session"})
+		return false
+	}
+	return true
+}
+
+// isSessionHost reports whether a user hosts a session
+func isSessionHost(ctx context.Context, sessions *mongo.Collection, sessionID, userID primitive.ObjectID) (bool, error) {
+	var session models.Session
+	err := sessions.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return false, errSessionNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return session.HostUserID == userID, nil
+}
+
+// sessionHost looks up who hosts a session
+func sessionHost(ctx context.Context, sessions *mongo.Collection, sessionID primitive.ObjectID) (primitive.ObjectID, error) {
+	var session models.Session
+	if err := sessions.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return session.HostUserID, nil
+}
+
+// requireSessionHost checks a request comes from the session's host and
+// writes the error response when it does not
+func requireSessionHost(c *gin.Context, sessions *mongo.Collection, sessionID, userID primitive.ObjectID) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	host, err := isSessionHost(ctx, sessions, sessionID, userID)
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session host"})
+		return false
+	}
+	if !host {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Only the session host can do this"})
+		return false
+	}
+	return true
+}
+
+// fileSessionID resolves the session a file belongs to through its folder
+func fileSessionID(ctx context.Context, files, folders *mongo.Collection, fileID primitive.ObjectID) (primitive.ObjectID, error) {
+	var file models.File
+	if err := files.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	var folder models.Folder
+	if err := folders.FindOne(ctx, bson.M{"_id": file.FolderID}).Decode(&folder); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return folder.SessionID, nil
+}
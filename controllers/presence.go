@@ -0,0 +1,441 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+)
+
+const (
+	// How long a user can go without sending anything before being marked idle
+	presenceIdleAfter = 2 * time.Minute
+	// How often idle users are looked for
+	presenceIdleCheck = 15 * time.Second
+	// How often changed entries are written to the presence collection
+	presenceSyncInterval = time.Second
+	// How often unchanged entries are written again to show the instance
+	// holding them is alive, and how long they count after the last write
+	presenceHeartbeat = 20 * time.Second
+	presenceExpiry    = time.Minute
+)
+
+// Presence statuses
+const (
+	PresenceActive = "active"
+	PresenceIdle   = "idle"
+)
+
+// CursorPosition is a zero-based line and column in a file
+type CursorPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// SelectionRange is the selected span of a file; Start may come after End
+// when the user selected backwards
+type SelectionRange struct {
+	Start CursorPosition `json:"start"`
+	End   CursorPosition `json:"end"`
+}
+
+// PresenceEntry describes one user in a session roster
+type PresenceEntry struct {
+	UserID         string          `json:"user_id"`
+	Username       string          `json:"username"`
+	ProfilePicture string          `json:"profile_picture,omitempty"`
+	Status         string          `json:"status"`
+	ActiveFileID   string          `json:"active_file_id,omitempty"`
+	Cursor         *CursorPosition `json:"cursor,omitempty"`
+	Selection      *SelectionRange `json:"selection,omitempty"`
+	LastActiveAt   time.Time       `json:"last_active_at"`
+
+	// Open connections of the user on this instance, one per tab
+	connections int
+	// When the entry was last written to the presence collection, or zero
+	// when it changed since
+	storedAt time.Time
+}
+
+// presenceRecord is a user's entry as one instance stores it in the presence
+// collection, for the instances without a connection of the user to read
+type presenceRecord struct {
+	ID             string          `bson:"_id"`
+	SessionID      string          `bson:"session_id"`
+	UserID         string          `bson:"user_id"`
+	Instance       string          `bson:"instance"`
+	Username       string          `bson:"username"`
+	ProfilePicture string          `bson:"profile_picture,omitempty"`
+	Status         string          `bson:"status"`
+	ActiveFileID   string          `bson:"active_file_id,omitempty"`
+	Cursor         *CursorPosition `bson:"cursor,omitempty"`
+	Selection      *SelectionRange `bson:"selection,omitempty"`
+	LastActiveAt   time.Time       `bson:"last_active_at"`
+	UpdatedAt      time.Time       `bson:"updated_at"`
+}
+
+// PresenceTracker keeps who is connected to each session, which file they
+// have open and where their cursor is, and tells the room when that changes.
+// The connections of this instance are tracked in memory and copied to the
+// presence collection, where the rosters of all instances are put together.
+type PresenceTracker struct {
+	sync.Mutex
+	sessions           map[string]map[string]*PresenceEntry
+	removed            map[string]bool // stored entries of users who left
+	instance           string
+	userCollection     *mongo.Collection
+	presenceCollection *mongo.Collection
+	hub                *Hub
+}
+
+// NewPresenceTracker creates a tracker that reports to the hub's rooms
+func NewPresenceTracker(db *mongo.Database, hub *Hub) *PresenceTracker {
+	pt := &PresenceTracker{
+		sessions:           make(map[string]map[string]*PresenceEntry),
+		removed:            make(map[string]bool),
+		instance:           primitive.NewObjectID().Hex(),
+		userCollection:     db.Collection("users"),
+		presenceCollection: db.Collection("presence"),
+		hub:                hub,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := pt.presenceCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "session_id", Value: 1}, {Key: "user_id", Value: 1}}},
+		// Entries of instances that stopped are read past right away; this
+		// only clears them away
+		{Keys: bson.M{"updated_at": 1}, Options: options.Index().SetExpireAfterSeconds(int32(presenceExpiry.Seconds()))},
+	})
+	if err != nil {
+		log.Println("Error creating presence indexes:", err)
+	}
+
+	go pt.watchIdle()
+	go pt.syncStore()
+	return pt
+}
+
+// Join registers a connection and announces the user if it is their first tab
+func (pt *PresenceTracker) Join(client *Client) {
+	// Look the user up before taking the lock
+	var user models.User
+	if userID, err := primitive.ObjectIDFromHex(client.UserID()); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		pt.userCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+		cancel()
+	}
+
+	pt.Lock()
+	room, ok := pt.sessions[client.SessionID()]
+	if !ok {
+		room = make(map[string]*PresenceEntry)
+		pt.sessions[client.SessionID()] = room
+	}
+
+	entry, ok := room[client.UserID()]
+	first := !ok
+	if first {
+		entry = &PresenceEntry{
+			UserID:         client.UserID(),
+			Username:       user.Username,
+			ProfilePicture: user.ProfilePicture,
+		}
+		room[client.UserID()] = entry
+	}
+	entry.connections++
+	entry.Status = PresenceActive
+	entry.LastActiveAt = time.Now()
+	entry.storedAt = time.Time{}
+	joined := *entry
+	pt.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	roster, err := pt.Roster(ctx, client.SessionID())
+	if err != nil {
+		log.Println("Error reading presence:", err)
+		pt.Lock()
+		roster = pt.roster(client.SessionID(), nil)
+		pt.Unlock()
+	}
+
+	client.Send(newEnvelope(MessageRoster, client.SessionID(), "", RosterPayload{Users: roster}))
+	// Users connected through another instance already are not announced again
+	if first && !pt.elsewhere(ctx, client.SessionID(), client.UserID()) {
+		pt.hub.BroadcastFrom(client, newEnvelope(MessageJoin, client.SessionID(), client.UserID(), joined))
+	}
+}
+
+// Leave drops a connection and announces the user once their last tab
+// closes, along with why the connection ended
+func (pt *PresenceTracker) Leave(client *Client, reason string) {
+	pt.Lock()
+	room := pt.sessions[client.SessionID()]
+	entry, ok := room[client.UserID()]
+	if !ok {
+		pt.Unlock()
+		return
+	}
+	entry.connections--
+	gone := entry.connections == 0
+	if gone {
+		delete(room, client.UserID())
+		if len(room) == 0 {
+			delete(pt.sessions, client.SessionID())
+		}
+		pt.removed[pt.recordID(client.SessionID(), client.UserID())] = true
+	}
+	pt.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if gone && !pt.elsewhere(ctx, client.SessionID(), client.UserID()) {
+		pt.hub.Broadcast(newEnvelope(MessageLeave, client.SessionID(), client.UserID(), LeavePayload{UserID: client.UserID(), Reason: reason}))
+	}
+}
+
+// Touch records activity from a connection and announces users coming back
+// from idle
+func (pt *PresenceTracker) Touch(client *Client) {
+	pt.Lock()
+	entry, ok := pt.sessions[client.SessionID()][client.UserID()]
+	if !ok {
+		pt.Unlock()
+		return
+	}
+	wasIdle := entry.Status == PresenceIdle
+	entry.Status = PresenceActive
+	entry.LastActiveAt = time.Now()
+	if wasIdle {
+		entry.storedAt = time.Time{}
+	}
+	updated := *entry
+	pt.Unlock()
+
+	if wasIdle {
+		pt.hub.Broadcast(newEnvelope(MessagePresence, client.SessionID(), client.UserID(), updated))
+	}
+}
+
+// Update stores the file, cursor and selection a client reported and relays
+// them to the rest of the room
+func (pt *PresenceTracker) Update(client *Client, update PresenceUpdatePayload) {
+	pt.Lock()
+	entry, ok := pt.sessions[client.SessionID()][client.UserID()]
+	if !ok {
+		pt.Unlock()
+		return
+	}
+	entry.ActiveFileID = update.ActiveFileID
+	entry.Cursor = update.Cursor
+	entry.Selection = update.Selection
+	entry.Status = PresenceActive
+	entry.LastActiveAt = time.Now()
+	entry.storedAt = time.Time{}
+	updated := *entry
+	pt.Unlock()
+
+	pt.hub.BroadcastFrom(client, newEnvelope(MessagePresence, client.SessionID(), client.UserID(), updated))
+}
+
+// Roster lists the users currently connected to a session through any
+// instance
+func (pt *PresenceTracker) Roster(ctx context.Context, sessionID string) ([]PresenceEntry, error) {
+	cursor, err := pt.presenceCollection.Find(ctx, bson.M{
+		"session_id": sessionID,
+		"instance":   bson.M{"$ne": pt.instance},
+		"updated_at": bson.M{"$gt": time.Now().Add(-presenceExpiry)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var records []presenceRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	pt.Lock()
+	defer pt.Unlock()
+	return pt.roster(sessionID, records), nil
+}
+
+// roster builds a sorted copy of a session's entries, merged with those
+// other instances stored; the lock must be held. A user connected through
+// several instances is listed once, as last seen, and active if they are
+// anywhere.
+func (pt *PresenceTracker) roster(sessionID string, records []presenceRecord) []PresenceEntry {
+	users := make(map[string]PresenceEntry, len(pt.sessions[sessionID])+len(records))
+	merge := func(entry PresenceEntry) {
+		if current, ok := users[entry.UserID]; ok {
+			active := current.Status == PresenceActive || entry.Status == PresenceActive
+			if current.LastActiveAt.After(entry.LastActiveAt) {
+				entry = current
+			}
+			if active {
+				entry.Status = PresenceActive
+			}
+		}
+		users[entry.UserID] = entry
+	}
+	for _, entry := range pt.sessions[sessionID] {
+		merge(*entry)
+	}
+	for _, record := range records {
+		merge(PresenceEntry{
+			UserID:         record.UserID,
+			Username:       record.Username,
+			ProfilePicture: record.ProfilePicture,
+			Status:         record.Status,
+			ActiveFileID:   record.ActiveFileID,
+			Cursor:         record.Cursor,
+			Selection:      record.Selection,
+			LastActiveAt:   record.LastActiveAt,
+		})
+	}
+
+	roster := make([]PresenceEntry, 0, len(users))
+	for _, entry := range users {
+		roster = append(roster, entry)
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].Username < roster[j].Username
+	})
+	return roster
+}
+
+// elsewhere reports whether a user is connected to a session through another
+// instance. When that cannot be told, they are taken not to be.
+func (pt *PresenceTracker) elsewhere(ctx context.Context, sessionID, userID string) bool {
+	count, err := pt.presenceCollection.CountDocuments(ctx, bson.M{
+		"session_id": sessionID,
+		"user_id":    userID,
+		"instance":   bson.M{"$ne": pt.instance},
+		"updated_at": bson.M{"$gt": time.Now().Add(-presenceExpiry)},
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		log.Println("Error reading presence:", err)
+		return false
+	}
+	return count > 0
+}
+
+// recordID is the key of this instance's stored entry for a user
+func (pt *PresenceTracker) recordID(sessionID, userID string) string {
+	return sessionID + "/" + userID + "/" + pt.instance
+}
+
+// syncStore writes changed entries to the presence collection, removes those
+// of users who left and keeps the rest from expiring
+func (pt *PresenceTracker) syncStore() {
+	ticker := time.NewTicker(presenceSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		var records []presenceRecord
+
+		pt.Lock()
+		gone := pt.removed
+		pt.removed = make(map[string]bool)
+		for sessionID, room := range pt.sessions {
+			for userID, entry := range room {
+				if now.Sub(entry.storedAt) < presenceHeartbeat {
+					continue
+				}
+				id := pt.recordID(sessionID, userID)
+				// A user who left and came back is written again instead
+				delete(gone, id)
+				records = append(records, presenceRecord{
+					ID:             id,
+					SessionID:      sessionID,
+					UserID:         userID,
+					Instance:       pt.instance,
+					Username:       entry.Username,
+					ProfilePicture: entry.ProfilePicture,
+					Status:         entry.Status,
+					ActiveFileID:   entry.ActiveFileID,
+					Cursor:         entry.Cursor,
+					Selection:      entry.Selection,
+					LastActiveAt:   entry.LastActiveAt,
+					UpdatedAt:      now,
+				})
+				entry.storedAt = now
+			}
+		}
+		removed := make([]string, 0, len(gone))
+		for id := range gone {
+			removed = append(removed, id)
+		}
+		pt.Unlock()
+
+		if len(removed) == 0 && len(records) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := pt.store(ctx, removed, records); err != nil {
+			log.Println("Error storing presence:", err)
+			// Write everything again on the next round
+			pt.Lock()
+			for _, id := range removed {
+				pt.removed[id] = true
+			}
+			for _, room := range pt.sessions {
+				for _, entry := range room {
+					entry.storedAt = time.Time{}
+				}
+			}
+			pt.Unlock()
+		}
+		cancel()
+	}
+}
+
+// store deletes and then writes entries of the presence collection
+func (pt *PresenceTracker) store(ctx context.Context, removed []string, records []presenceRecord) error {
+	writes := make([]mongo.WriteModel, 0, len(removed)+len(records))
+	for _, id := range removed {
+		writes = append(writes, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": id}))
+	}
+	for _, record := range records {
+		writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": record.ID}).SetReplacement(record).SetUpsert(true))
+	}
+	_, err := pt.presenceCollection.BulkWrite(ctx, writes)
+	return err
+}
+
+// watchIdle periodically marks quiet users as idle and tells their rooms
+func (pt *PresenceTracker) watchIdle() {
+	ticker := time.NewTicker(presenceIdleCheck)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var changes []Envelope
+
+		pt.Lock()
+		for sessionID, room := range pt.sessions {
+			for userID, entry := range room {
+				if entry.Status == PresenceIdle || time.Since(entry.LastActiveAt) < presenceIdleAfter {
+					continue
+				}
+				entry.Status = PresenceIdle
+				entry.storedAt = time.Time{}
+				updated := *entry
+				changes = append(changes, newEnvelope(MessagePresence, sessionID, userID, updated))
+			}
+		}
+		pt.Unlock()
+
+		for _, env := range changes {
+			pt.hub.Broadcast(env)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPresenceRosterMergesInstances(t *testing.T) {
+	now := time.Now()
+	sessionID := primitive.NewObjectID().Hex()
+	pt := &PresenceTracker{
+		sessions: map[string]map[string]*PresenceEntry{sessionID: {
+			"u1": {UserID: "u1", Username: "bo", Status: PresenceIdle, ActiveFileID: "old", LastActiveAt: now.Add(-time.Hour)},
+			"u2": {UserID: "u2", Username: "al", Status: PresenceActive, LastActiveAt: now},
+		}},
+	}
+
+	// u1 is also connected through another instance, where they were seen
+	// last; u3 only there
+	roster := pt.roster(sessionID, []presenceRecord{
+		{UserID: "u1", Username: "bo", Status: PresenceActive, ActiveFileID: "new", LastActiveAt: now},
+		{UserID: "u3", Username: "cy", Status: PresenceIdle, LastActiveAt: now},
+	})
+
+	if len(roster) != 3 || roster[0].UserID != "u2" || roster[1].UserID != "u1" || roster[2].UserID != "u3" {
+		t.Fatalf("got %+v, want u2, u1 and u3 by name", roster)
+	}
+	if roster[1].ActiveFileID != "new" || roster[1].Status != PresenceActive {
+		t.Errorf("got %+v for u1, want the entry seen last and active", roster[1])
+	}
+	if roster[2].Status != PresenceIdle {
+		t.Errorf("got %+v for u3, want idle", roster[2])
+	}
+}
+
+func TestPresenceRosterAcrossInstances(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	h := testHub(NewMemoryBroker())
+	sessionID := primitive.NewObjectID().Hex()
+
+	a, b := NewPresenceTracker(db, h), NewPresenceTracker(db, h)
+	client := testClient(h, sessionID)
+	a.Join(client)
+
+	// b learns of the user once a has stored the entry
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		roster, err := b.Roster(ctx, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roster) == 1 && roster[0].UserID == client.UserID() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("other instance sees %+v, want the user", roster)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !b.elsewhere(ctx, sessionID, client.UserID()) {
+		t.Error("other instance does not see the user connected elsewhere")
+	}
+
+	a.Leave(client, CloseReasonClosed)
+	for {
+		roster, err := b.Roster(ctx, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roster) == 0 {
+			break
+		}
+		if time.Now().After(deadline.Add(5 * time.Second)) {
+			t.Fatalf("other instance still sees %+v after the user left", roster)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,325 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// ProtocolVersion is the newest version of the socket protocol the server speaks
+const ProtocolVersion = 1
+
+// Versions the server can still talk to, newest first
+var supportedProtocolVersions = []int{1}
+
+// Frame types on /ws
+const (
+	// Handshake
+	MessageHello   = "hello"   // client offers the versions it speaks
+	MessageWelcome = "welcome" // server picks the version for the connection
+
+	// Content
+	MessageChat     = "chat"     // a chat line
+	MessageDocOpen  = "doc_open" // client asks for a file's live content
+	MessageDoc      = "doc"      // server sends content and revision
+	MessageOp       = "op"       // an edit, from a client or relayed by the server
+	MessageAck      = "ack"      // server accepted the sender's edit
+	MessageResync   = "resync"   // client must reopen the document
+	MessageConflict = "conflict" // a saved version clashed with live edits, which were kept
+
+	// Presence
+	MessagePresence = "presence" // file, cursor and selection of a user, or a status change
+	MessageRoster   = "roster"   // everyone currently in the session, sent on join
+	MessageJoin     = "join"     // a user opened their first connection
+	MessageLeave    = "leave"    // a user closed their last connection
+
+	// Code execution
+	MessageExecStatus = "exec_status" // an execution was queued, started or finished
+	MessageExecOutput = "exec_output" // output of a running execution
+	MessageExecInput  = "exec_input"  // input for an interactive execution
+	MessageTestResult = "test_result" // a test case of a test run was graded
+
+	MessageError = "error"
+)
+
+// Error codes carried by error frames
+const (
+	ErrCodeMalformed          = "malformed_frame"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInputBacklog       = "input_backlog"
+	ErrCodeWrongInstance      = "wrong_instance"
+	ErrCodeInternal           = "internal_error"
+)
+
+// Envelope wraps every frame sent over /ws. The payload shape depends on Type.
+// Frames broadcast to a room carry Seq, which clients echo back in
+// HelloPayload.Resume after reconnecting.
+type Envelope struct {
+	V         int             `json:"v"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	SessionID string          `json:"session_id,omitempty"`
+	UserID    string          `json:"user_id,omitempty"`
+	Timestamp time.Time       `json:"ts"`
+	ReplyTo   string          `json:"reply_to,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// newEnvelope builds a server frame around a payload
+func newEnvelope(msgType, sessionID, userID string, payload interface{}) Envelope {
+	env := Envelope{
+		V:         ProtocolVersion,
+		Type:      msgType,
+		ID:        primitive.NewObjectID().Hex(),
+		SessionID: sessionID,
+		UserID:    userID,
+		Timestamp: time.Now(),
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("Error encoding payload:", err)
+		}
+		env.Payload = data
+	}
+	return env
+}
+
+// errorEnvelope builds an error frame answering the frame with the given ID
+func errorEnvelope(sessionID, replyTo, code, message string) Envelope {
+	env := newEnvelope(MessageError, sessionID, "", ErrorPayload{Code: code, Message: message})
+	env.ReplyTo = replyTo
+	return env
+}
+
+// payloadValidator is implemented by payloads that clients are allowed to send
+type payloadValidator interface {
+	validate() error
+}
+
+// decodePayload unmarshals and validates the payload of a client frame
+func decodePayload(env Envelope, payload payloadValidator) error {
+	if len(env.Payload) == 0 {
+		return errors.New("payload is required")
+	}
+	if err := json.Unmarshal(env.Payload, payload); err != nil {
+		return err
+	}
+	return payload.validate()
+}
+
+// negotiateVersion picks the newest version both sides speak, or 0
+func negotiateVersion(offered []int) int {
+	for _, supported := range supportedProtocolVersions {
+		for _, v := range offered {
+			if v == supported {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// HelloPayload opens a connection
+type HelloPayload struct {
+	Versions []int        `json:"versions"`
+	Client   string       `json:"client,omitempty"`
+	Resume   *ResumeState `json:"resume,omitempty"`
+}
+
+func (p *HelloPayload) validate() error {
+	if len(p.Versions) == 0 {
+		return errors.New("versions is required")
+	}
+	if p.Resume != nil && p.Resume.Epoch == "" {
+		return errors.New("resume.epoch is required")
+	}
+	return nil
+}
+
+// WelcomePayload confirms the connection and the version in use. Epoch and
+// Seq identify the last frame of the room at the time the client joined.
+type WelcomePayload struct {
+	Version   int    `json:"version"`
+	Supported []int  `json:"supported"`
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	Epoch     string `json:"epoch"`
+	Seq       uint64 `json:"seq"`
+}
+
+// ChatPayload is a chat line
+type ChatPayload struct {
+	Text string `json:"text"`
+}
+
+func (p *ChatPayload) validate() error {
+	if p.Text == "" {
+		return errors.New("text is required")
+	}
+	return nil
+}
+
+// DocOpenPayload asks for the live content of a file
+type DocOpenPayload struct {
+	FileID string `json:"file_id"`
+}
+
+func (p *DocOpenPayload) validate() error {
+	if !primitive.IsValidObjectID(p.FileID) {
+		return errors.New("file_id is invalid")
+	}
+	return nil
+}
+
+// DocPayload carries the live content of a file. Revisions only count
+// within an epoch; the epoch changes whenever the server reloads the file.
+type DocPayload struct {
+	FileID   string `json:"file_id"`
+	Epoch    string `json:"epoch"`
+	Revision int    `json:"revision"`
+	Content  string `json:"content"`
+}
+
+// OpPayload is an edit made against a revision of a file
+type OpPayload struct {
+	FileID    string               `json:"file_id"`
+	Epoch     string               `json:"epoch"`
+	Revision  int                  `json:"revision"`
+	Operation *utils.TextOperation `json:"operation"`
+}
+
+func (p *OpPayload) validate() error {
+	if !primitive.IsValidObjectID(p.FileID) {
+		return errors.New("file_id is invalid")
+	}
+	if p.Epoch == "" {
+		return errors.New("epoch is required")
+	}
+	if p.Revision < 0 {
+		return errors.New("revision is invalid")
+	}
+	if p.Operation == nil {
+		return errors.New("operation is required")
+	}
+	return nil
+}
+
+// AckPayload confirms an edit and the revision it produced
+type AckPayload struct {
+	FileID   string `json:"file_id"`
+	Revision int    `json:"revision"`
+}
+
+// ResyncPayload tells a client its copy of a file can no longer be patched.
+// An empty FileID means every open file must be reloaded from the server.
+type ResyncPayload struct {
+	FileID string `json:"file_id"`
+	Reason string `json:"reason"`
+}
+
+// ConflictPayload lists the lines where a version of a file saved from
+// elsewhere clashed with the live edits. Ours is the live side, which was
+// kept; the saved version stays in the file's history.
+type ConflictPayload struct {
+	FileID    string                `json:"file_id"`
+	Version   int                   `json:"version"`
+	Conflicts []utils.MergeConflict `json:"conflicts"`
+}
+
+// PresenceUpdatePayload is what a client reports about itself
+type PresenceUpdatePayload struct {
+	ActiveFileID string          `json:"active_file_id,omitempty"`
+	Cursor       *CursorPosition `json:"cursor,omitempty"`
+	Selection    *SelectionRange `json:"selection,omitempty"`
+}
+
+func (p *PresenceUpdatePayload) validate() error {
+	if p.ActiveFileID != "" && !primitive.IsValidObjectID(p.ActiveFileID) {
+		return errors.New("active_file_id is invalid")
+	}
+	if p.Cursor != nil && (p.Cursor.Line < 0 || p.Cursor.Column < 0) {
+		return errors.New("cursor is invalid")
+	}
+	return nil
+}
+
+// RosterPayload lists everyone in a session
+type RosterPayload struct {
+	Users []PresenceEntry `json:"users"`
+}
+
+// LeavePayload names the user who left and why: closed, timeout, idle or evicted
+type LeavePayload struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+// ExecStatusPayload reports a change in an execution's lifecycle. Exit code
+// and resource usage are set once it has finished.
+type ExecStatusPayload struct {
+	ExecutionID   string                       `json:"execution_id"`
+	FileID        string                       `json:"file_id"`
+	FolderID      string                       `json:"folder_id,omitempty"`
+	UserID        string                       `json:"user_id"`
+	Status        models.CodeExecutionStatus   `json:"status"`
+	ExitCode      *int                         `json:"exit_code,omitempty"`
+	ExecutionTime time.Duration                `json:"execution_time,omitempty"`
+	MemoryUsed    int64                        `json:"memory_used,omitempty"`
+	ErrorMessage  string                       `json:"error_message,omitempty"`
+	Diagnostics   []models.ExecutionDiagnostic `json:"diagnostics,omitempty"`
+}
+
+// ExecOutputPayload is output produced by a running execution
+type ExecOutputPayload struct {
+	ExecutionID string `json:"execution_id"`
+	models.TranscriptChunk
+}
+
+// TestResultPayload reports a graded test case and the progress of its test
+// run. Diffs of hidden cases are left out.
+type TestResultPayload struct {
+	TestRunID string            `json:"test_run_id"`
+	UserID    string            `json:"user_id"`
+	Result    models.TestResult `json:"result"`
+	Finished  int               `json:"finished"`
+	Total     int               `json:"total"`
+	Score     int               `json:"score"`
+	MaxScore  int               `json:"max_score"`
+	Completed bool              `json:"completed"`
+}
+
+// ExecInputPayload is input typed into an interactive execution; EOF closes
+// the program's stdin
+type ExecInputPayload struct {
+	ExecutionID string `json:"execution_id"`
+	Data        string `json:"data,omitempty"`
+	EOF         bool   `json:"eof,omitempty"`
+}
+
+func (p *ExecInputPayload) validate() error {
+	if !primitive.IsValidObjectID(p.ExecutionID) {
+		return errors.New("execution_id is invalid")
+	}
+	if p.Data == "" && !p.EOF {
+		return errors.New("data or eof is required")
+	}
+	return nil
+}
+
+// ErrorPayload explains why a frame was rejected
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
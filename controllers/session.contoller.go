@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -11,16 +12,19 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
 )
 
 type SessionController struct {
 	sessionCollection *mongo.Collection
+	languages         *utils.LanguageRegistry
 }
 
 // Constructor for SessionController
-func NewSessionController(db *mongo.Database) *SessionController {
+func NewSessionController(db *mongo.Database, languages *utils.LanguageRegistry) *SessionController {
 	return &SessionController{
 		sessionCollection: db.Collection("sessions"),
+		languages:         languages,
 	}
 }
 
@@ -32,6 +36,16 @@ func (sc *SessionController) CreateSession(c *gin.Context) {
 		return							
 	}
 
+	// Sessions are written in one of the registered languages, the default
+	// one unless the client picked another
+	if session.Language == "" {
+		session.Language = models.SessionLanguage(sc.languages.Default().Name)
+	}
+	if _, ok := sc.languages.Lookup(string(session.Language)); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported language: " + string(session.Language)})
+		return
+	}
+
 	session.ID = primitive.NewObjectID()
 	session.CreatedAt = time.Now()
 	session.LastActiveAt = time.Now()
@@ -79,6 +93,14 @@ func (sc *SessionController) UpdateSession(c *gin.Context) {
 		return
 	}
 
+	if language, ok := updates["language"]; ok {
+		name, _ := language.(string)
+		if _, ok := sc.languages.Lookup(name); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported language: %v", language)})
+			return
+		}
+	}
+
 	updates["last_active_at"] = time.Now()
 
 	_, err = sc.sessionCollection.UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{"$set": updates})
@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+)
+
+// Largest expected output accepted with a test case
+const maxExpectedOutputBytes = 1 << 20
+
+type TestCaseController struct {
+	testCaseCollection     *mongo.Collection
+	fileCollection         *mongo.Collection
+	folderCollection       *mongo.Collection
+	sessionCollection      *mongo.Collection
+	collaboratorCollection *mongo.Collection
+	config                 config.ExecutionConfig
+}
+
+// Constructor for TestCaseController
+func NewTestCaseController(db *mongo.Database, cfg config.ExecutionConfig) *TestCaseController {
+	return &TestCaseController{
+		testCaseCollection:     db.Collection("test_cases"),
+		fileCollection:         db.Collection("files"),
+		folderCollection:       db.Collection("folders"),
+		sessionCollection:      db.Collection("sessions"),
+		collaboratorCollection: db.Collection("collaborators"),
+		config:                 cfg,
+	}
+}
+
+// CreateTestCase adds a test case to a session, or to one file of it. Only
+// the host may add cases.
+func (tc *TestCaseController) CreateTestCase(c *gin.Context) {
+	var request struct {
+		SessionID      primitive.ObjectID `json:"session_id" binding:"required"`
+		FileID         primitive.ObjectID `json:"file_id"`
+		Name           string             `json:"name" binding:"required"`
+		Stdin          string             `json:"stdin"`
+		ExpectedOutput string             `json:"expected_output"`
+		TimeLimit      time.Duration      `json:"time_limit"`
+		Points         *int               `json:"points"`
+		Hidden         bool               `json:"hidden"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if !requireSessionHost(c, tc.sessionCollection, request.SessionID, userID) {
+		return
+	}
+
+	testCase := models.TestCase{
+		ID:             primitive.NewObjectID(),
+		SessionID:      request.SessionID,
+		FileID:         request.FileID,
+		Name:           request.Name,
+		Stdin:          request.Stdin,
+		ExpectedOutput: request.ExpectedOutput,
+		TimeLimit:      request.TimeLimit,
+		Points:         1,
+		Hidden:         request.Hidden,
+		CreatedBy:      userID,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if request.Points != nil {
+		testCase.Points = *request.Points
+	}
+	if !tc.validTestCase(c, testCase) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !testCase.FileID.IsZero() {
+		sessionID, err := fileSessionID(ctx, tc.fileCollection, tc.folderCollection, testCase.FileID)
+		if err != nil || sessionID != testCase.SessionID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File does not belong to this session"})
+			return
+		}
+	}
+
+	if _, err := tc.testCaseCollection.InsertOne(ctx, testCase); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create test case"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Test case created", "test_case": testCase})
+}
+
+// GetTestCases lists the test cases of a session, optionally only those
+// that apply to one file. Hidden cases are listed without their input and
+// expected output unless the host asks.
+func (tc *TestCaseController) GetTestCases(c *gin.Context) {
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if !requireSessionMember(c, tc.sessionCollection, tc.collaboratorCollection, sessionID, userID) {
+		return
+	}
+
+	filter := bson.M{"session_id": sessionID}
+	if fileID := c.Query("file_id"); fileID != "" {
+		objectID, err := primitive.ObjectIDFromHex(fileID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+			return
+		}
+		filter["file_id"] = bson.M{"$in": bson.A{objectID, nil}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	host, err := isSessionHost(ctx, tc.sessionCollection, sessionID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session host"})
+		return
+	}
+
+	cursor, err := tc.testCaseCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve test cases"})
+		return
+	}
+	testCases := []models.TestCase{}
+	if err := cursor.All(ctx, &testCases); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode test cases"})
+		return
+	}
+	if !host {
+		for i := range testCases {
+			if testCases[i].Hidden {
+				testCases[i].Stdin = ""
+				testCases[i].ExpectedOutput = ""
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, testCases)
+}
+
+// UpdateTestCase changes the fields given of a test case. Only the host may
+// change cases; runs already started keep the expected output they began with.
+func (tc *TestCaseController) UpdateTestCase(c *gin.Context) {
+	testCaseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid test case ID"})
+		return
+	}
+
+	var request struct {
+		Name           *string        `json:"name"`
+		Stdin          *string        `json:"stdin"`
+		ExpectedOutput *string        `json:"expected_output"`
+		TimeLimit      *time.Duration `json:"time_limit"`
+		Points         *int           `json:"points"`
+		Hidden         *bool          `json:"hidden"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var testCase models.TestCase
+	if err := tc.testCaseCollection.FindOne(ctx, bson.M{"_id": testCaseID}).Decode(&testCase); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Test case not found"})
+		return
+	}
+	if !requireSessionHost(c, tc.sessionCollection, testCase.SessionID, userID) {
+		return
+	}
+
+	if request.Name != nil {
+		testCase.Name = *request.Name
+	}
+	if request.Stdin != nil {
+		testCase.Stdin = *request.Stdin
+	}
+	if request.ExpectedOutput != nil {
+		testCase.ExpectedOutput = *request.ExpectedOutput
+	}
+	if request.TimeLimit != nil {
+		testCase.TimeLimit = *request.TimeLimit
+	}
+	if request.Points != nil {
+		testCase.Points = *request.Points
+	}
+	if request.Hidden != nil {
+		testCase.Hidden = *request.Hidden
+	}
+	if !tc.validTestCase(c, testCase) {
+		return
+	}
+	testCase.UpdatedAt = time.Now()
+
+	_, err = tc.testCaseCollection.UpdateOne(ctx, bson.M{"_id": testCaseID}, bson.M{"$set": bson.M{
+		"name":            testCase.Name,
+		"stdin":           testCase.Stdin,
+		"expected_output": testCase.ExpectedOutput,
+		"time_limit":      testCase.TimeLimit,
+		"points":          testCase.Points,
+		"hidden":          testCase.Hidden,
+		"updated_at":      testCase.UpdatedAt,
+	}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update test case"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Test case updated", "test_case": testCase})
+}
+
+// DeleteTestCase removes a test case. Only the host may remove cases.
+func (tc *TestCaseController) DeleteTestCase(c *gin.Context) {
+	testCaseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid test case ID"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var testCase models.TestCase
+	if err := tc.testCaseCollection.FindOne(ctx, bson.M{"_id": testCaseID}).Decode(&testCase); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Test case not found"})
+		return
+	}
+	if !requireSessionHost(c, tc.sessionCollection, testCase.SessionID, userID) {
+		return
+	}
+
+	if _, err := tc.testCaseCollection.DeleteOne(ctx, bson.M{"_id": testCaseID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete test case"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Test case deleted"})
+}
+
+// validTestCase checks the limits on a test case, writing the error response
+// when one is broken
+func (tc *TestCaseController) validTestCase(c *gin.Context, testCase models.TestCase) bool {
+	switch {
+	case testCase.Name == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+	case len(testCase.Stdin) > maxStdinBytes:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stdin is too large"})
+	case len(testCase.ExpectedOutput) > maxExpectedOutputBytes:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected output is too large"})
+	case testCase.TimeLimit < 0 || testCase.TimeLimit > tc.config.MaxTestTime:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Time limit must be between 0 and " + tc.config.MaxTestTime.String()})
+	case testCase.Points < 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Points cannot be negative"})
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// Unchanged lines shown around each difference in a test diff
+const testDiffContext = 3
+
+// normalizeOutput splits output into lines for comparison, ignoring
+// trailing whitespace on each line and blank lines at the end
+func normalizeOutput(output string) []string {
+	lines := utils.SplitLines(strings.ReplaceAll(output, "\r\n", "\n"))
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// testVerdict grades a finished execution against the expected output. A
+// wrong answer comes with the diff from the expected to the actual output.
+func testVerdict(execution models.CodeExecution, expected string) (models.TestResultStatus, string) {
+	switch execution.Status {
+	case models.StatusTimedOut:
+		return models.TestTimedOut, ""
+	case models.StatusCompleted:
+	default:
+		return models.TestError, ""
+	}
+
+	hunks := utils.DiffHunks(utils.DiffLines(normalizeOutput(expected), normalizeOutput(execution.Output)), testDiffContext)
+	if len(hunks) == 0 {
+		return models.TestPassed, ""
+	}
+	return models.TestFailed, utils.UnifiedDiff("expected", "actual", hunks)
+}
+
+// gradeExecution records the verdict on a finished test case execution in
+// its test run and reports it to the session room. Grading an execution a
+// second time, as when a requeued job finishes twice, changes nothing.
+func gradeExecution(ctx context.Context, testRuns *mongo.Collection, hub *Hub, execution models.CodeExecution) error {
+	var run models.TestRun
+	if err := testRuns.FindOne(ctx, bson.M{"_id": execution.TestRunID}).Decode(&run); err != nil {
+		return err
+	}
+	var result models.TestResult
+	for _, candidate := range run.Results {
+		if candidate.ExecutionID == execution.ID {
+			result = candidate
+		}
+	}
+
+	result.Status, result.Diff = testVerdict(execution, result.ExpectedOutput)
+	passed := 0
+	if result.Status == models.TestPassed {
+		result.Earned = result.Points
+		passed = 1
+	}
+
+	err := testRuns.FindOneAndUpdate(ctx,
+		bson.M{"_id": run.ID, "results": bson.M{"$elemMatch": bson.M{"execution_id": execution.ID, "status": models.TestPending}}},
+		bson.M{
+			"$set": bson.M{
+				"results.$.status": result.Status,
+				"results.$.earned": result.Earned,
+				"results.$.diff":   result.Diff,
+			},
+			"$inc": bson.M{"finished": 1, "passed": passed, "score": result.Earned},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&run)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	completed := run.Finished >= len(run.Results)
+	if completed {
+		_, err := testRuns.UpdateOne(ctx,
+			bson.M{"_id": run.ID, "status": bson.M{"$ne": models.StatusCompleted}},
+			bson.M{"$set": bson.M{"status": models.StatusCompleted, "completed_at": time.Now()}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if result.Hidden {
+		result.Diff = ""
+		result.ExpectedOutput = ""
+	}
+	hub.Broadcast(newEnvelope(MessageTestResult, run.SessionID.Hex(), run.UserID.Hex(), TestResultPayload{
+		TestRunID: run.ID.Hex(),
+		UserID:    run.UserID.Hex(),
+		Result:    result,
+		Finished:  run.Finished,
+		Total:     len(run.Results),
+		Score:     run.Score,
+		MaxScore:  run.MaxScore,
+		Completed: completed,
+	}))
+	return nil
+}
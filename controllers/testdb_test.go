@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// testDatabase connects to the MongoDB named by MONGODB_TEST_URI and returns
+// a database of the test's own, dropped when it ends. Tests are skipped when
+// the variable is unset. Transactions and change streams need the server to
+// be a replica set; a single node started with --replSet is enough.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("pinging MongoDB: %v", err)
+	}
+
+	db := client.Database("codecollab_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return db
+}
+
+// testFile stores a session hosted by host with one folder holding a file,
+// saved once with content as its first version
+func testFile(t *testing.T, db *mongo.Database, host primitive.ObjectID, content string) models.File {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+
+	session := models.Session{ID: primitive.NewObjectID(), Title: "test", HostUserID: host, CreatedAt: now}
+	if _, err := db.Collection("sessions").InsertOne(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	file := models.File{
+		ID:        primitive.NewObjectID(),
+		UserID:    host,
+		FolderID:  primitive.NewObjectID(),
+		Name:      "main.go",
+		Language:  "go",
+		Content:   content,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	folder := models.Folder{ID: file.FolderID, UserID: host, SessionID: session.ID, Name: "src", FileIDs: []primitive.ObjectID{file.ID}, CreatedAt: now}
+	if _, err := db.Collection("folders").InsertOne(ctx, folder); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("files").InsertOne(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	version := models.FileVersion{ID: primitive.NewObjectID(), FileID: file.ID, Content: content, Version: 1, EditedBy: host, EditedAt: now}
+	if err := recordFileVersion(ctx, db.Collection("file_versions"), version, ""); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// saveTestVersion saves content as the next version of a file, as editor
+func saveTestVersion(t *testing.T, db *mongo.Database, file *models.File, editor primitive.ObjectID, content string) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+
+	_, err := db.Collection("files").UpdateOne(ctx,
+		bson.M{"_id": file.ID},
+		bson.M{"$set": bson.M{"content": content, "version": file.Version + 1, "updated_at": now, "last_edited_by": editor}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := models.FileVersion{ID: primitive.NewObjectID(), FileID: file.ID, Content: content, Version: file.Version + 1, EditedBy: editor, EditedAt: now}
+	if err := recordFileVersion(ctx, db.Collection("file_versions"), version, file.Content); err != nil {
+		t.Fatal(err)
+	}
+	file.Content = content
+	file.Version = version.Version
+}
+
+// serveTest calls a handler as userID would reach it through the router,
+// signed in with an access token
+func serveTest(handler gin.HandlerFunc, method string, params gin.Params, userID primitive.ObjectID, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	token, _, _ := utils.GenerateTokens(&models.User{ID: userID})
+	c.Request.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+	c.Params = params
+	c.Set("user_id", userID.Hex())
+	handler(c)
+	return w
+}
+
+// fileAt reads a file as it is stored now
+func fileAt(t *testing.T, db *mongo.Database, fileID primitive.ObjectID) models.File {
+	t.Helper()
+	var file models.File
+	if err := db.Collection("files").FindOne(context.Background(), bson.M{"_id": fileID}).Decode(&file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How many times a transaction is started over after a transient error
+const maxTransactionAttempts = 5
+
+// isTransientTransactionError reports whether a transaction failed for a
+// reason that may go away when it is run again, such as a write conflict
+// with another transaction
+func isTransientTransactionError(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorLabel("TransientTransactionError")
+}
+
+// runTransaction runs fn in a transaction and commits it, starting over
+// when the server reports a transient error. Errors returned by fn abort
+// the transaction and are passed back as they are.
+func runTransaction(ctx context.Context, client *mongo.Client, fn func(sc mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	for attempt := 1; ; attempt++ {
+		err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+			if err := session.StartTransaction(); err != nil {
+				return err
+			}
+			if err := fn(sc); err != nil {
+				session.AbortTransaction(context.Background())
+				return err
+			}
+			return session.CommitTransaction(sc)
+		})
+		if err == nil || attempt == maxTransactionAttempts || !isTransientTransactionError(err) {
+			return err
+		}
+	}
+}
@@ -1,86 +1,618 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"sync"
+	"net/url"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"codeCollab-backend/utils"
 )
 
+// Origins allowed to open a WebSocket from a browser
+var allowedOrigins = map[string]bool{
+	"http://localhost:8080": true,
+}
+
+// How long a new connection has to send its hello before it is taken to be a
+// version 1 client and joined to its room anyway
+const helloTimeout = 2 * time.Second
+
 // Upgrader for upgrading HTTP connections to WebSocket
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins; customize for security
-	},
+	CheckOrigin: checkOrigin,
+}
+
+// checkOrigin accepts same-host requests, the configured frontend origins and
+// non-browser clients that do not send an Origin header
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowedOrigins[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+type WebSocketController struct {
+	sessionCollection      *mongo.Collection
+	collaboratorCollection *mongo.Collection
+	fileCollection         *mongo.Collection
+	folderCollection       *mongo.Collection
+	hub                    *Hub
+	documents              *DocumentManager
+	yjs                    *YjsManager
+	presence               *PresenceTracker
+	executions             *ExecutionQueue
 }
 
-// Connection pool to manage active WebSocket connections
-var connections = struct {
-	sync.RWMutex
-	clients map[*websocket.Conn]bool
-}{
-	clients: make(map[*websocket.Conn]bool),
+// Constructor for WebSocketController
+func NewWebSocketController(db *mongo.Database, hub *Hub, documents *DocumentManager, yjs *YjsManager, executions *ExecutionQueue) *WebSocketController {
+	return &WebSocketController{
+		sessionCollection:      db.Collection("sessions"),
+		collaboratorCollection: db.Collection("collaborators"),
+		fileCollection:         db.Collection("files"),
+		folderCollection:       db.Collection("folders"),
+		hub:                    hub,
+		documents:              documents,
+		yjs:                    yjs,
+		presence:               NewPresenceTracker(db, hub),
+		executions:             executions,
+	}
 }
 
-// Message represents a WebSocket message
-type Message struct {
-	SessionID string `json:"session_id"`
-	UserID    string `json:"user_id"`
-	Content   string `json:"content"`
+// IssueTicket hands out a short-lived ticket for clients that cannot send
+// the access token cookie with the WebSocket handshake
+func (wc *WebSocketController) IssueTicket(c *gin.Context) {
+	ticket, err := utils.GenerateTicket(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate ticket"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket})
 }
 
-// WebSocketHandler manages WebSocket connections and broadcasts messages
-func WebSocketHandler(c *gin.Context) {
+// GetPresence returns who is connected to a session and what they have open
+func (wc *WebSocketController) GetPresence(c *gin.Context) {
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if !wc.authorizeSession(c, sessionID, userID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users, err := wc.presence.Roster(ctx, sessionID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch presence"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "users": users})
+}
+
+// GetStats reports the hub's rooms and delivery counters
+func (wc *WebSocketController) GetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, wc.hub.Stats())
+}
+
+// authenticateHandshake identifies the user opening a socket from the access
+// token cookie or, failing that, a ticket in the query string
+func (wc *WebSocketController) authenticateHandshake(c *gin.Context) (primitive.ObjectID, bool) {
+	var userID string
+	token, err := c.Cookie("access_token")
+	switch {
+	case err == nil && token != "":
+		userID, err = utils.ParseToken(token)
+	case c.Query("ticket") != "":
+		userID, err = utils.ParseTicket(c.Query("ticket"))
+	default:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
+		return primitive.NilObjectID, false
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return primitive.NilObjectID, false
+	}
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return primitive.NilObjectID, false
+	}
+	return userObjectID, true
+}
+
+// authorizeSession makes sure the user hosts or collaborates on the session
+func (wc *WebSocketController) authorizeSession(c *gin.Context, sessionID, userID primitive.ObjectID) bool {
+	return requireSessionMember(c, wc.sessionCollection, wc.collaboratorCollection, sessionID, userID)
+}
+
+// WebSocketHandler authenticates the handshake, joins the connection to its
+// session room and relays messages to the other members of that room
+func (wc *WebSocketController) WebSocketHandler(c *gin.Context) {
+	sessionID, err := primitive.ObjectIDFromHex(c.Query("session_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	userID, ok := wc.authenticateHandshake(c)
+	if !ok {
+		return
+	}
+	if !wc.authorizeSession(c, sessionID, userID) {
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("Error upgrading connection:", err)
 		return
 	}
-	defer conn.Close()
+	client := wc.hub.NewClient(conn, sessionID.Hex(), userID.Hex())
 
-	// Add connection to the pool
-	connections.Lock()
-	connections.clients[conn] = true
-	connections.Unlock()
+	// Agree on a protocol version before joining the room; on failure the
+	// writer closes the connection after the close frame. A client that stays
+	// quiet is joined without one, and the frame it sends later is read below.
+	hello, first, pending, ok := wc.negotiate(client)
+	if !ok {
+		return
+	}
+	defer client.Close()
 
-	// Remove connection from the pool on close
-	defer func() {
-		connections.Lock()
-		delete(connections.clients, conn)
-		connections.Unlock()
-	}()
+	// Add connection to the session room, replaying what it missed if it is
+	// coming back from a dropped connection
+	resumed := wc.hub.Join(client, hello.Resume, func(epoch string, seq uint64) Envelope {
+		welcome := newEnvelope(MessageWelcome, client.SessionID(), client.UserID(), WelcomePayload{
+			Version:   hello.Version,
+			Supported: supportedProtocolVersions,
+			SessionID: client.SessionID(),
+			UserID:    client.UserID(),
+			Epoch:     epoch,
+			Seq:       seq,
+		})
+		welcome.ReplyTo = hello.ID
+		return welcome
+	})
+	if !resumed {
+		client.Send(newEnvelope(MessageResync, client.SessionID(), "", ResyncPayload{Reason: "missed messages are no longer available"}))
+	}
+	wc.presence.Join(client)
 
-	// Listen for messages from the client
+	if first != nil {
+		wc.dispatch(client, *first)
+	}
+
+	// Listen for frames from the client
+	var readErr error
 	for {
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		var env Envelope
+		var err error
+		if pending != nil {
+			read := <-pending
+			env, err, pending = read.env, read.err, nil
+		} else {
+			env, err = readEnvelope(client)
+		}
+		if err == errMalformedFrame {
+			client.Send(errorEnvelope(client.SessionID(), "", ErrCodeMalformed, "Frame is not a valid envelope"))
+			continue
+		}
 		if err != nil {
 			log.Println("Error reading message:", err)
+			readErr = err
 			break
 		}
 
-		// Log the received message
-		log.Printf("Received message: %+v\n", msg)
+		wc.dispatch(client, env)
+	}
+
+	// Remove connection from the room and tell the others why it went away
+	wc.hub.Leave(client)
+	wc.presence.Leave(client, client.CloseReason(readErr))
+}
+
+// errMalformedFrame is returned by readEnvelope for frames that are not JSON envelopes
+var errMalformedFrame = errors.New("malformed frame")
+
+// errSessionElsewhere is returned for edits to a session whose live
+// documents another server instance owns
+var errSessionElsewhere = errors.New("session is being edited through another server, reconnect")
+
+// readEnvelope reads the next frame from a client
+func readEnvelope(client *Client) (Envelope, error) {
+	var env Envelope
+	_, data, err := client.conn.ReadMessage()
+	if err != nil {
+		return env, err
+	}
+	client.Touch()
+	if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+		return env, errMalformedFrame
+	}
+	return env, nil
+}
+
+// frameRead is the outcome of a readEnvelope run in the background
+type frameRead struct {
+	env Envelope
+	err error
+}
+
+// handshake is what negotiate agreed with a client
+type handshake struct {
+	ID      string       // ID of the hello frame, if one was sent
+	Version int          // protocol version for the connection
+	Resume  *ResumeState // where a reconnecting client left off
+}
+
+// negotiate expects a hello frame and picks the version to use; the welcome
+// is sent once the client has joined its room. Clients that skip the hello
+// are assumed to speak version 1; their first frame is handed back so it can
+// be dispatched normally. Clients that send nothing within helloTimeout are
+// also taken to speak version 1 so that listeners still join; the read still
+// under way is handed back as pending.
+func (wc *WebSocketController) negotiate(client *Client) (handshake, *Envelope, <-chan frameRead, bool) {
+	hs := handshake{Version: 1}
+
+	reads := make(chan frameRead, 1)
+	go func() {
+		env, err := readEnvelope(client)
+		reads <- frameRead{env, err}
+	}()
+
+	timer := time.NewTimer(helloTimeout)
+	defer timer.Stop()
+	var env Envelope
+	var err error
+	select {
+	case read := <-reads:
+		env, err = read.env, read.err
+	case <-timer.C:
+		return hs, nil, reads, true
+	}
+	if err != nil && err != errMalformedFrame {
+		client.Close()
+		return hs, nil, nil, false
+	}
+
+	var first *Envelope
+	switch {
+	case err == errMalformedFrame:
+		client.Send(errorEnvelope(client.SessionID(), "", ErrCodeMalformed, "Frame is not a valid envelope"))
+	case env.Type != MessageHello:
+		first = &env
+	default:
+		var hello HelloPayload
+		if err := decodePayload(env, &hello); err != nil {
+			client.Send(errorEnvelope(client.SessionID(), env.ID, ErrCodeInvalidPayload, err.Error()))
+			client.CloseWith(websocket.CloseProtocolError, "invalid hello")
+			return hs, nil, nil, false
+		}
+		hs.ID = env.ID
+		hs.Resume = hello.Resume
+		hs.Version = negotiateVersion(hello.Versions)
+		if hs.Version == 0 {
+			client.Send(errorEnvelope(client.SessionID(), env.ID, ErrCodeUnsupportedVersion, "No common protocol version"))
+			client.CloseWith(websocket.CloseProtocolError, "unsupported protocol version")
+			return hs, nil, nil, false
+		}
+	}
+	return hs, first, nil, true
+}
+
+// dispatch validates a client frame, stamps it with the server's view of who
+// sent it and when, and routes it by type
+func (wc *WebSocketController) dispatch(client *Client, env Envelope) {
+	// Never trust the identity or room claimed by the client
+	env.V = ProtocolVersion
+	env.SessionID = client.SessionID()
+	env.UserID = client.UserID()
+	env.Timestamp = time.Now()
+	if env.ID == "" {
+		env.ID = primitive.NewObjectID().Hex()
+	}
+	wc.presence.Touch(client)
+
+	switch env.Type {
+	case MessageChat:
+		var chat ChatPayload
+		if !wc.decodeClientPayload(client, env, &chat) {
+			return
+		}
+		relay := newEnvelope(MessageChat, env.SessionID, env.UserID, chat)
+		relay.ID = env.ID
+		wc.hub.Broadcast(relay)
+
+	case MessagePresence:
+		var update PresenceUpdatePayload
+		if !wc.decodeClientPayload(client, env, &update) {
+			return
+		}
+		wc.presence.Update(client, update)
+
+	case MessageDocOpen:
+		var open DocOpenPayload
+		if !wc.decodeClientPayload(client, env, &open) {
+			return
+		}
+		wc.openDocument(client, env, open)
+
+	case MessageOp:
+		var op OpPayload
+		if !wc.decodeClientPayload(client, env, &op) {
+			return
+		}
+		wc.applyOperation(client, env, op)
+
+	case MessageExecInput:
+		var input ExecInputPayload
+		if !wc.decodeClientPayload(client, env, &input) {
+			return
+		}
+		executionID, _ := primitive.ObjectIDFromHex(input.ExecutionID)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := wc.executions.SendInput(ctx, executionID, env.SessionID, client.UserID(), []byte(input.Data), input.EOF)
+		cancel()
+		switch {
+		case err == errExecutionNotRunning:
+			client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeNotFound, err.Error()))
+		case err == errNotExecutionOwner:
+			client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeForbidden, err.Error()))
+		case err == errInputBacklog:
+			client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeInputBacklog, err.Error()))
+		case err != nil:
+			log.Println("Error sending execution input:", err)
+			client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeInternal, "Failed to send input"))
+		}
+
+	case MessageHello:
+		// Only possible from a client that was slower than helloTimeout and
+		// has already been welcomed as version 1
+		client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeUnsupportedVersion, "Hello must be sent right after connecting; continuing with version 1"))
+
+	default:
+		client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeUnknownType, "Unknown frame type: "+env.Type))
+	}
+}
+
+// decodeClientPayload decodes a frame's payload and reports invalid ones to the sender
+func (wc *WebSocketController) decodeClientPayload(client *Client, env Envelope, payload payloadValidator) bool {
+	if err := decodePayload(env, payload); err != nil {
+		client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeInvalidPayload, err.Error()))
+		return false
+	}
+	return true
+}
+
+// openDocument sends the live content and revision of a file to the client
+func (wc *WebSocketController) openDocument(client *Client, env Envelope, open DocOpenPayload) {
+	doc, err := wc.loadDocument(client, open.FileID)
+	if err != nil {
+		client.Send(errorEnvelope(env.SessionID, env.ID, documentErrorCode(err), err.Error()))
+		return
+	}
+
+	content, epoch, revision := doc.Snapshot()
+	reply := newEnvelope(MessageDoc, env.SessionID, "", DocPayload{
+		FileID:   open.FileID,
+		Epoch:    epoch,
+		Revision: revision,
+		Content:  content,
+	})
+	reply.ReplyTo = env.ID
+	client.Send(reply)
+}
+
+// applyOperation merges a client's edit into the live document, acknowledges
+// it to the sender and relays the transformed edit to everyone else
+func (wc *WebSocketController) applyOperation(client *Client, env Envelope, payload OpPayload) {
+	doc, err := wc.loadDocument(client, payload.FileID)
+	if err != nil {
+		client.Send(errorEnvelope(env.SessionID, env.ID, documentErrorCode(err), err.Error()))
+		return
+	}
+
+	editor, _ := primitive.ObjectIDFromHex(client.UserID())
+	err = wc.documents.Apply(doc, payload.Epoch, payload.Revision, *payload.Operation, editor, func(op utils.TextOperation, revision int) {
+		ack := newEnvelope(MessageAck, env.SessionID, "", AckPayload{FileID: payload.FileID, Revision: revision})
+		ack.ReplyTo = env.ID
+		client.Send(ack)
+
+		relay := newEnvelope(MessageOp, env.SessionID, env.UserID, OpPayload{
+			FileID:    payload.FileID,
+			Epoch:     payload.Epoch,
+			Revision:  revision,
+			Operation: &op,
+		})
+		relay.ID = env.ID
+		wc.hub.BroadcastFrom(client, relay)
+	})
+	if err == errRevisionTooOld || err == errRevisionAhead || err == errDocumentReloaded || err == utils.ErrOperationLength || err == utils.ErrIncompatibleOps {
+		resync := newEnvelope(MessageResync, env.SessionID, "", ResyncPayload{FileID: payload.FileID, Reason: err.Error()})
+		resync.ReplyTo = env.ID
+		client.Send(resync)
+		return
+	}
+	if err != nil {
+		client.Send(errorEnvelope(env.SessionID, env.ID, ErrCodeInternal, err.Error()))
+	}
+}
+
+// loadDocument opens the live document for a file in the client's session
+func (wc *WebSocketController) loadDocument(client *Client, fileID string) (*Document, error) {
+	fileObjectID, err := primitive.ObjectIDFromHex(fileID)
+	if err != nil {
+		return nil, errors.New("Invalid file ID")
+	}
+	sessionObjectID, err := primitive.ObjectIDFromHex(client.SessionID())
+	if err != nil {
+		return nil, errors.New("Invalid session ID")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := wc.claimSession(ctx, client.SessionID()); err != nil {
+		return nil, err
+	}
+	doc, err := wc.documents.Open(ctx, fileObjectID, sessionObjectID)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("File not found")
+	}
+	return doc, err
+}
+
+// documentErrorCode picks the error code for a document that could not be
+// loaded
+func documentErrorCode(err error) string {
+	if err == errSessionElsewhere {
+		return ErrCodeWrongInstance
+	}
+	return ErrCodeNotFound
+}
+
+// claimSession makes sure this instance owns the live documents of a
+// session. Documents kept from an earlier claim are brought up to date when
+// the session comes back from another instance.
+func (wc *WebSocketController) claimSession(ctx context.Context, sessionID string) error {
+	owned, acquired, err := wc.hub.Claim(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return errSessionElsewhere
+	}
+	if !acquired {
+		return nil
+	}
 
-		// Broadcast the message to all connected clients
-		broadcastMessage(msg)
+	sessionObjectID, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return err
 	}
+	if err := wc.documents.RefreshSession(ctx, sessionObjectID); err != nil {
+		return err
+	}
+	return wc.yjs.RefreshSession(ctx, sessionID)
 }
 
-// broadcastMessage sends a message to all connected WebSocket clients
-func broadcastMessage(msg Message) {
-	connections.RLock()
-	defer connections.RUnlock()
+// YjsHandler speaks the y-websocket binary protocol for a single file so
+// off-the-shelf Yjs editor bindings can sync against it
+func (wc *WebSocketController) YjsHandler(c *gin.Context) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("file_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	userID, ok := wc.authenticateHandshake(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sessionID, err := fileSessionID(ctx, wc.fileCollection, wc.folderCollection, fileID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+		return
+	}
+	if !wc.authorizeSession(c, sessionID, userID) {
+		return
+	}
+	err = wc.claimSession(ctx, sessionID.Hex())
+	if err == errSessionElsewhere {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is being edited through another server"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open document"})
+		return
+	}
 
-	for client := range connections.clients {
-		err := client.WriteJSON(msg)
+	// Upgrade HTTP connection to WebSocket
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Error upgrading connection:", err)
+		return
+	}
+	client := wc.hub.NewClient(conn, sessionID.Hex(), userID.Hex())
+	defer client.Close()
+
+	doc, err := wc.yjs.Join(ctx, fileID, client)
+	if err != nil {
+		log.Println("Error opening Yjs document:", err)
+		return
+	}
+	defer wc.yjs.Leave(doc, client)
+
+	for {
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error broadcasting message:", err)
-			client.Close()
-			delete(connections.clients, client)
+			log.Println("Error reading message:", err)
+			break
+		}
+		client.Touch()
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		// Another instance may have taken the session over while the
+		// connection was quiet
+		if err := wc.claimYjsSession(client); err == errSessionElsewhere {
+			client.CloseWith(websocket.CloseTryAgainLater, err.Error())
+			break
+		} else if err != nil {
+			log.Println("Error claiming session:", err)
+			continue
+		}
+
+		if err := wc.yjs.Handle(doc, client, data); err == utils.ErrYjsTooManyPending {
+			// The peer keeps sending edits that build on ones it never sent
+			client.CloseWith(websocket.ClosePolicyViolation, err.Error())
+			break
+		} else if err != nil {
+			log.Println("Error handling Yjs message:", err)
 		}
 	}
 }
+
+// claimYjsSession renews the claim on the session of a Yjs connection
+func (wc *WebSocketController) claimYjsSession(client *Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return wc.claimSession(ctx, client.SessionID())
+}
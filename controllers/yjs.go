@@ -0,0 +1,499 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+// How long a Yjs document waits after the last update before it is saved
+const yjsFlushDelay = 2 * time.Second
+
+// YjsDoc relays the y-websocket protocol for one file. The server merges
+// every update into its own copy of the document, which answers sync
+// requests, is saved to the file as text and is stored as a single update.
+type YjsDoc struct {
+	sync.Mutex
+	fileID    primitive.ObjectID
+	sessionID string
+	state     *utils.YjsDocument
+	peers     map[*Client]*yjsPeer
+	awareness map[uint64]utils.AwarenessState
+
+	// The saved version the text was last merged with, and its content
+	baseVersion int
+	baseContent string
+
+	dirty      bool
+	closed     bool
+	lastEditor primitive.ObjectID
+	flushTimer *time.Timer
+}
+
+// yjsPeer is the per-connection state of a document
+type yjsPeer struct {
+	// Yjs client IDs announced through awareness on this connection
+	awarenessIDs map[uint64]bool
+}
+
+// YjsManager keeps the Yjs documents that have connected peers. The content
+// of a file is kept in the root Y.Text named textName.
+type YjsManager struct {
+	sync.Mutex
+	docs                  map[primitive.ObjectID]*YjsDoc
+	fileCollection        *mongo.Collection
+	fileVersionCollection *mongo.Collection
+	hub                   *Hub
+	textName              string
+	saved                 func(ctx context.Context, fileID primitive.ObjectID) error
+}
+
+// NewYjsManager creates a manager backed by the given database that tells
+// sessions about conflicting saves through the hub
+func NewYjsManager(db *mongo.Database, hub *Hub, textName string) *YjsManager {
+	return &YjsManager{
+		docs:                  make(map[primitive.ObjectID]*YjsDoc),
+		fileCollection:        db.Collection("files"),
+		fileVersionCollection: db.Collection("file_versions"),
+		hub:                   hub,
+		textName:              textName,
+	}
+}
+
+// OnSave sets a function called with every file the manager saves a new
+// version of, so other editors of the file can merge it in
+func (ym *YjsManager) OnSave(saved func(ctx context.Context, fileID primitive.ObjectID) error) {
+	ym.saved = saved
+}
+
+// load returns the document for a file of the given session, reading the
+// saved updates on first use
+func (ym *YjsManager) load(ctx context.Context, fileID primitive.ObjectID, sessionID string) (*YjsDoc, error) {
+	ym.Lock()
+	defer ym.Unlock()
+
+	if doc, ok := ym.docs[fileID]; ok {
+		return doc, nil
+	}
+
+	var file models.File
+	if err := ym.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	state := utils.NewYjsDocument()
+	for _, update := range file.YjsUpdates {
+		if err := state.ApplyUpdate(update); err != nil {
+			log.Printf("Skipping unreadable Yjs update of file %s: %v", fileID.Hex(), err)
+		}
+	}
+
+	doc := &YjsDoc{
+		fileID:      fileID,
+		sessionID:   sessionID,
+		state:       state,
+		peers:       make(map[*Client]*yjsPeer),
+		awareness:   make(map[uint64]utils.AwarenessState),
+		baseVersion: file.Version,
+		baseContent: file.Content,
+	}
+	// The file may have been saved from elsewhere since its Yjs state was,
+	// or never have been edited through Yjs; its content is where peers start
+	if state.ReplaceText(ym.textName, file.Content) != nil {
+		doc.dirty = true
+	}
+	ym.docs[fileID] = doc
+	return doc, nil
+}
+
+// Join attaches a connection to a file's document and asks the peer for what
+// the server lacks; the peer asks for the rest itself. The current awareness
+// of the other peers is sent along.
+func (ym *YjsManager) Join(ctx context.Context, fileID primitive.ObjectID, client *Client) (*YjsDoc, error) {
+	for {
+		doc, err := ym.load(ctx, fileID, client.SessionID())
+		if err != nil {
+			return nil, err
+		}
+
+		doc.Lock()
+		if doc.closed {
+			// Unloaded between load and lock; fetch a fresh one
+			doc.Unlock()
+			continue
+		}
+
+		client.SendBinary(utils.EncodeYjsSyncMessage(utils.YjsSyncStep1, doc.state.StateVector()))
+		if len(doc.awareness) > 0 {
+			client.SendBinary(utils.EncodeAwarenessMessage(doc.awarenessStates()))
+		}
+
+		doc.peers[client] = &yjsPeer{awarenessIDs: make(map[uint64]bool)}
+		doc.Unlock()
+		return doc, nil
+	}
+}
+
+// Leave detaches a connection, tells the others its awareness is gone and
+// saves and unloads the document once nobody is left
+func (ym *YjsManager) Leave(doc *YjsDoc, client *Client) {
+	doc.Lock()
+	peer, ok := doc.peers[client]
+	if ok {
+		delete(doc.peers, client)
+
+		var removed []utils.AwarenessState
+		for id := range peer.awarenessIDs {
+			state := doc.awareness[id]
+			removed = append(removed, utils.AwarenessState{ClientID: id, Clock: state.Clock + 1, State: "null"})
+			delete(doc.awareness, id)
+		}
+		if len(removed) > 0 {
+			doc.broadcast(nil, utils.EncodeAwarenessMessage(removed))
+		}
+	}
+	empty := len(doc.peers) == 0
+	doc.Unlock()
+
+	if !empty {
+		return
+	}
+
+	ym.Lock()
+	defer ym.Unlock()
+	doc.Lock()
+	defer doc.Unlock()
+
+	// Someone may have joined while the locks were released
+	if len(doc.peers) > 0 || doc.closed {
+		return
+	}
+	if doc.dirty {
+		if err := ym.save(doc); err != nil {
+			log.Println("Error saving Yjs document:", err)
+			ym.scheduleFlush(doc)
+			return
+		}
+	}
+	if doc.flushTimer != nil {
+		doc.flushTimer.Stop()
+	}
+	doc.closed = true
+	delete(ym.docs, doc.fileID)
+}
+
+// Handle processes one binary y-websocket message from a peer
+func (ym *YjsManager) Handle(doc *YjsDoc, client *Client, data []byte) error {
+	decoder := utils.NewYjsDecoder(data)
+	messageType, err := decoder.ReadVarUint()
+	if err != nil {
+		return err
+	}
+
+	switch messageType {
+	case utils.YjsMessageSync:
+		syncType, err := decoder.ReadVarUint()
+		if err != nil {
+			return err
+		}
+		payload, err := decoder.ReadVarBytes()
+		if err != nil {
+			return err
+		}
+
+		switch syncType {
+		case utils.YjsSyncStep1:
+			sv, err := utils.DecodeYjsStateVector(payload)
+			if err != nil {
+				return err
+			}
+			doc.Lock()
+			update := doc.state.EncodeUpdate(sv)
+			doc.Unlock()
+			return client.SendBinary(utils.EncodeYjsSyncMessage(utils.YjsSyncStep2, update))
+		case utils.YjsSyncStep2, utils.YjsSyncUpdate:
+			return ym.applyUpdate(doc, client, payload)
+		}
+
+	case utils.YjsMessageAwareness:
+		payload, err := decoder.ReadVarBytes()
+		if err != nil {
+			return err
+		}
+		states, err := utils.DecodeAwarenessUpdate(payload)
+		if err != nil {
+			return err
+		}
+
+		doc.Lock()
+		if peer, ok := doc.peers[client]; ok {
+			for _, state := range states {
+				if state.State == "null" {
+					delete(doc.awareness, state.ClientID)
+					delete(peer.awarenessIDs, state.ClientID)
+					continue
+				}
+				doc.awareness[state.ClientID] = state
+				peer.awarenessIDs[state.ClientID] = true
+			}
+			doc.broadcast(client, data)
+		}
+		doc.Unlock()
+
+	case utils.YjsMessageQueryAwareness:
+		doc.Lock()
+		states := doc.awarenessStates()
+		doc.Unlock()
+		return client.SendBinary(utils.EncodeAwarenessMessage(states))
+	}
+
+	return nil
+}
+
+// applyUpdate merges an update from a peer into the document and relays it
+// to the other peers
+func (ym *YjsManager) applyUpdate(doc *YjsDoc, client *Client, update []byte) error {
+	doc.Lock()
+	defer doc.Unlock()
+
+	if _, ok := doc.peers[client]; !ok {
+		return nil
+	}
+	if bytes.Equal(update, utils.YjsEmptyUpdate) {
+		return nil
+	}
+	if err := doc.state.ApplyUpdate(update); err != nil {
+		return err
+	}
+	doc.broadcast(client, utils.EncodeYjsSyncMessage(utils.YjsSyncUpdate, update))
+
+	doc.lastEditor, _ = primitive.ObjectIDFromHex(client.UserID())
+	doc.dirty = true
+	ym.scheduleFlush(doc)
+	return nil
+}
+
+// replace edits the text of the document as the server and sends the edit
+// to the peers; the document lock must be held
+func (ym *YjsManager) replace(doc *YjsDoc, text string) {
+	if update := doc.state.ReplaceText(ym.textName, text); update != nil {
+		doc.broadcast(nil, utils.EncodeYjsSyncMessage(utils.YjsSyncUpdate, update))
+		doc.dirty = true
+	}
+}
+
+// rebase merges a version of the file saved from elsewhere into the
+// document; the document lock must be held. Where both changed the same
+// lines the live edits are kept; the session is told about the clash and the
+// other version stays in the history.
+func (ym *YjsManager) rebase(doc *YjsDoc, file models.File) {
+	if file.Version <= doc.baseVersion {
+		return
+	}
+	text := doc.state.Text(ym.textName)
+	merged, conflicts := utils.MergeText(doc.baseContent, text, file.Content)
+	if len(conflicts) > 0 {
+		ym.hub.Broadcast(newEnvelope(MessageConflict, doc.sessionID, "", ConflictPayload{
+			FileID:    doc.fileID.Hex(),
+			Version:   file.Version,
+			Conflicts: conflicts,
+		}))
+		merged = text
+	}
+	doc.baseVersion, doc.baseContent = file.Version, file.Content
+	doc.dirty = true
+	ym.replace(doc, merged)
+}
+
+// Refresh merges the saved content of a file into its Yjs document, if it
+// is open, after the file was saved from elsewhere
+func (ym *YjsManager) Refresh(ctx context.Context, fileID primitive.ObjectID) error {
+	ym.Lock()
+	doc, ok := ym.docs[fileID]
+	ym.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var file models.File
+	if err := ym.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return err
+	}
+
+	doc.Lock()
+	defer doc.Unlock()
+	if doc.closed {
+		return nil
+	}
+	ym.rebase(doc, file)
+	if doc.dirty {
+		ym.scheduleFlush(doc)
+	}
+	return nil
+}
+
+// broadcast sends a message to every peer except the sender; the document
+// lock must be held
+func (doc *YjsDoc) broadcast(sender *Client, data []byte) {
+	for peer := range doc.peers {
+		if peer == sender {
+			continue
+		}
+		if err := peer.SendBinary(data); err != nil {
+			log.Println("Error relaying Yjs message:", err)
+		}
+	}
+}
+
+// awarenessStates lists the known awareness entries; the document lock must be held
+func (doc *YjsDoc) awarenessStates() []utils.AwarenessState {
+	states := make([]utils.AwarenessState, 0, len(doc.awareness))
+	for _, state := range doc.awareness {
+		states = append(states, state)
+	}
+	return states
+}
+
+// RefreshSession brings every open document of a session up to date with
+// its file, after another server instance may have edited the session
+func (ym *YjsManager) RefreshSession(ctx context.Context, sessionID string) error {
+	ym.Lock()
+	var fileIDs []primitive.ObjectID
+	for fileID, doc := range ym.docs {
+		if doc.sessionID == sessionID {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	ym.Unlock()
+
+	for _, fileID := range fileIDs {
+		if err := ym.Refresh(ctx, fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset replaces the text of a file's Yjs document, if it is open, with the
+// content saved to the file. Unsaved edits are dropped rather than merged,
+// as the file was rolled back to an old version on purpose.
+func (ym *YjsManager) Reset(ctx context.Context, fileID primitive.ObjectID) error {
+	ym.Lock()
+	doc, ok := ym.docs[fileID]
+	ym.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var file models.File
+	if err := ym.fileCollection.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file); err != nil {
+		return err
+	}
+
+	doc.Lock()
+	defer doc.Unlock()
+	if doc.closed || file.Version <= doc.baseVersion {
+		return nil
+	}
+	doc.baseVersion, doc.baseContent = file.Version, file.Content
+	ym.replace(doc, file.Content)
+	// The text is saved already; the merged state still has to be
+	doc.dirty = true
+	ym.scheduleFlush(doc)
+	return nil
+}
+
+// scheduleFlush (re)arms the save timer; the document lock must be held
+func (ym *YjsManager) scheduleFlush(doc *YjsDoc) {
+	if doc.flushTimer != nil {
+		doc.flushTimer.Stop()
+	}
+	doc.flushTimer = time.AfterFunc(yjsFlushDelay, func() {
+		doc.Lock()
+		defer doc.Unlock()
+		if !doc.dirty || doc.closed {
+			return
+		}
+		if err := ym.save(doc); err != nil {
+			log.Println("Error saving Yjs document:", err)
+			ym.scheduleFlush(doc)
+		}
+	})
+}
+
+// save writes the text of the document to the file as a new version, when
+// it changed, along with the document's merged state, in one transaction;
+// the document lock must be held. The write only succeeds against the version the text was based
+// on; a newer one saved from elsewhere is merged in first.
+func (ym *YjsManager) save(doc *YjsDoc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		text := doc.state.Text(ym.textName)
+		updates := [][]byte{doc.state.EncodeUpdate(nil)}
+		if pending := doc.state.PendingUpdate(); pending != nil {
+			updates = append(updates, pending)
+		}
+
+		now := time.Now()
+		set := bson.M{"yjs_updates": updates, "updated_at": now}
+		changed := text != doc.baseContent
+		if changed {
+			set["content"] = text
+			set["version"] = doc.baseVersion + 1
+			set["last_edited_by"] = doc.lastEditor
+		}
+		version := models.FileVersion{
+			ID:       primitive.NewObjectID(),
+			FileID:   doc.fileID,
+			Content:  text,
+			Version:  doc.baseVersion + 1,
+			EditedBy: doc.lastEditor,
+			EditedAt: now,
+		}
+		err := runTransaction(ctx, ym.fileCollection.Database().Client(), func(sc mongo.SessionContext) error {
+			result, err := ym.fileCollection.UpdateOne(sc,
+				bson.M{"_id": doc.fileID, "version": doc.baseVersion},
+				bson.M{"$set": set},
+			)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errFileChanged
+			}
+			if !changed {
+				return nil
+			}
+			return recordFileVersion(sc, ym.fileVersionCollection, version, doc.baseContent)
+		})
+		if err == nil {
+			doc.dirty = false
+			if changed {
+				doc.baseVersion, doc.baseContent = version.Version, text
+				notifySaved(ym.saved, doc.fileID)
+			}
+			return nil
+		}
+		if err != errFileChanged && !isTransientTransactionError(err) {
+			return err
+		}
+
+		var file models.File
+		if err := ym.fileCollection.FindOne(ctx, bson.M{"_id": doc.fileID}).Decode(&file); err != nil {
+			return err
+		}
+		ym.rebase(doc, file)
+	}
+	return errFileKeepsChanging
+}
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeCollab-backend/config"
+	"codeCollab-backend/models"
+	"codeCollab-backend/utils"
+)
+
+func TestYjsRebaseReportsConflicts(t *testing.T) {
+	broker := &recordingBroker{MemoryBroker: NewMemoryBroker()}
+	ym := &YjsManager{hub: NewHub(config.WebSocketConfig{}, broker), textName: "t"}
+
+	doc := &YjsDoc{
+		fileID:      primitive.NewObjectID(),
+		sessionID:   primitive.NewObjectID().Hex(),
+		state:       utils.NewYjsDocument(),
+		peers:       make(map[*Client]*yjsPeer),
+		baseContent: "a\nb\nc\n",
+	}
+	doc.state.ReplaceText("t", "a\nB\nc\n")
+
+	ym.rebase(doc, models.File{Content: "a\nX\nc\n", Version: 1})
+
+	if got := doc.state.Text("t"); got != "a\nB\nc\n" {
+		t.Errorf("got text %q, want the Yjs edits kept", got)
+	}
+	if doc.baseVersion != 1 || !doc.dirty {
+		t.Errorf("based on version %d and dirty %v, want version 1 and dirty", doc.baseVersion, doc.dirty)
+	}
+	if sent := broker.sent(MessageConflict); len(sent) != 1 || sent[0].SessionID != doc.sessionID {
+		t.Errorf("got conflict frames %+v, want one to the session", sent)
+	}
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+    "context"
+    "flag"
     "log"
     "os"
     "github.com/gin-gonic/gin"
@@ -9,9 +11,18 @@ import (
     "codeCollab-backend/config"
     "codeCollab-backend/controllers"
     "codeCollab-backend/routes"
+    "codeCollab-backend/utils"
 )
 
 func main() {
+    // Sandboxed code executions re-run this binary to apply their limits
+    if utils.IsSandboxInit() {
+        utils.SandboxInit()
+    }
+
+    compactVersions := flag.Bool("compact-versions", false, "store file versions saved in full as deltas, then exit")
+    flag.Parse()
+
     // Set up logging
     gin.DefaultWriter = os.Stdout
     log.SetOutput(os.Stderr) // Use stderr for error logging
@@ -19,12 +30,55 @@ func main() {
     // Connect to MongoDB
     config.ConnectDB()
 
+    // Migrate file versions from before delta storage
+    if *compactVersions {
+        compacted, err := controllers.CompactFileVersions(context.Background(), config.DB)
+        if err != nil {
+            log.Fatalf("❌ Failed to compact file versions after %d: %v", compacted, err)
+        }
+        log.Printf("✅ Compacted %d file versions", compacted)
+        return
+    }
+
+    // Languages code can be written and run in
+    languageConfigs, err := config.LoadLanguages()
+    if err != nil {
+        log.Fatalf("❌ Failed to load languages: %v", err)
+    }
+    languages, err := utils.NewLanguageRegistry(languageConfigs)
+    if err != nil {
+        log.Fatalf("❌ Invalid language registry: %v", err)
+    }
+
+    // The hub and the live documents are shared by the socket controller and
+    // the controllers that save files
+    wsConfig := config.LoadWebSocketConfig()
+    broker, err := controllers.NewBroker(wsConfig.Broker, config.DB)
+    if err != nil {
+        log.Fatalf("❌ Failed to start %s broker: %v", wsConfig.Broker, err)
+    }
+    defer broker.Close()
+    hub := controllers.NewHub(wsConfig, broker)
+    documents := controllers.NewDocumentManager(config.DB, hub)
+    yjsDocuments := controllers.NewYjsManager(config.DB, hub, wsConfig.YjsTextName)
+    // A file edited through both protocols merges what either one saves
+    documents.OnSave(yjsDocuments.Refresh)
+    yjsDocuments.OnSave(documents.Refresh)
+
     // Initialize controllers with the connected database
     authController := controllers.NewAuthController(config.DB)
-    sessionController := controllers.NewSessionController(config.DB)
-    fileController := controllers.NewFileController(config.DB)
+    sessionController := controllers.NewSessionController(config.DB, languages)
+    fileController := controllers.NewFileController(config.DB, languages, documents, yjsDocuments)
+    fileVersionController := controllers.NewFileVersionController(config.DB, documents, yjsDocuments)
+    checkpointController := controllers.NewCheckpointController(config.DB, documents, yjsDocuments)
+    languageController := controllers.NewLanguageController(languages)
     collaboratorController := controllers.NewCollaboratorController(config.DB)
     folderController := controllers.NewFolderController(config.DB)
+    executionConfig := config.LoadExecutionConfig()
+    executionQueue := controllers.NewExecutionQueue(config.DB, executionConfig, hub, languages)
+    wsController := controllers.NewWebSocketController(config.DB, hub, documents, yjsDocuments, executionQueue)
+    executionController := controllers.NewExecutionController(config.DB, executionQueue)
+    testCaseController := controllers.NewTestCaseController(config.DB, executionConfig)
     // projectController := controllers.NewProjectController(config.DB) // Initialize ProjectController
 
     // Set Gin to release mode for production
@@ -63,12 +117,18 @@ router.OPTIONS("/*path", func(c *gin.Context) {
     routes.RegisterAuthRoutes(router, authController)
     routes.RegisterSessionRoutes(router, sessionController)
     routes.RegisterFileRoutes(router, fileController)
+    routes.RegisterFileVersionRoutes(router, fileVersionController)
+    routes.RegisterCheckpointRoutes(router, checkpointController)
     routes.RegisterFolderRoutes(router, folderController)
     routes.RegisterCollaboratorRoutes(router, collaboratorController)
+    routes.RegisterExecutionRoutes(router, executionController)
+    routes.RegisterTestCaseRoutes(router, testCaseController)
+    routes.RegisterLanguageRoutes(router, languageController)
+    routes.RegisterUsageRoutes(router, executionController)
     // routes.ProjectRoutes(router, projectController) // Add project routes
 
     // Register WebSocket routes
-    routes.RegisterWebSocketRoutes(router)
+    routes.RegisterWebSocketRoutes(router, wsController)
 
     // Define a /data endpoint
     router.GET("/data", func(c *gin.Context) {
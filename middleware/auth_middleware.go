@@ -49,7 +49,10 @@ func AuthMiddleware() gin.HandlerFunc {
 			userID, idExists := claims["sub"].(string)
 			// userRole, roleExists := claims["role"].(string)
 
-			if !idExists  {
+			// WebSocket tickets are only good for opening a socket
+			typ, _ := claims["typ"].(string)
+
+			if !idExists || typ == "ws_ticket" {
 				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid claims structure"})
 				c.Abort()
 				return
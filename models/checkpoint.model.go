@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CheckpointFile is one file as a checkpoint found it
+type CheckpointFile struct {
+	FileID   primitive.ObjectID `bson:"file_id" json:"file_id"`
+	FolderID primitive.ObjectID `bson:"folder_id" json:"folder_id"`
+	Name     string             `bson:"name" json:"name"`
+	Version  int                `bson:"version" json:"version"`
+}
+
+// Checkpoint marks the versions every file of a session, or of one folder
+// of it, had at a point in time, so they can be compared or brought back
+// together
+type Checkpoint struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SessionID primitive.ObjectID `bson:"session_id" json:"session_id"`
+	// Set when the checkpoint covers one folder instead of the whole session
+	FolderID    primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Files       []CheckpointFile   `bson:"files" json:"files,omitempty"`
+
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
@@ -17,16 +17,63 @@ const (
 	StatusTimedOut   CodeExecutionStatus = "timed_out"
 )
 
+// TranscriptChunk is a piece of output in the order the program produced it
+type TranscriptChunk struct {
+	Phase  string `bson:"phase" json:"phase"`   // compile or run
+	Stream string `bson:"stream" json:"stream"` // stdout or stderr
+	Data   string `bson:"data" json:"data"`
+	Offset int64  `bson:"offset_ms" json:"offset_ms"` // since the run started
+}
+
+// SourceFile is one file of a project execution, as it was when queued
+type SourceFile struct {
+	FileID  primitive.ObjectID `bson:"file_id" json:"file_id"`
+	Path    string             `bson:"path" json:"path"`
+	Content string             `bson:"content" json:"content"`
+	Version int                `bson:"version" json:"version"`
+}
+
+// ExecutionDiagnostic is a compiler or runtime error located in a source file
+type ExecutionDiagnostic struct {
+	FileID   primitive.ObjectID `bson:"file_id,omitempty" json:"file_id,omitempty"`
+	Path     string             `bson:"path" json:"path"`
+	Line     int                `bson:"line" json:"line"`
+	Column   int                `bson:"column,omitempty" json:"column,omitempty"`
+	Severity string             `bson:"severity" json:"severity"`
+	Message  string             `bson:"message" json:"message"`
+}
+
 // CodeExecution represents a code execution request and its result
 type CodeExecution struct {
 	ID             primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
 	UserID         primitive.ObjectID     `bson:"user_id" json:"user_id"`
 	SessionID      primitive.ObjectID     `bson:"session_id" json:"session_id"`
 	FileID         primitive.ObjectID     `bson:"file_id" json:"file_id"`
+	// Set when a whole folder runs as a project; FileID is then the entrypoint
+	FolderID       primitive.ObjectID     `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	// Host of the session when queued, whose quota the run also counts against
+	HostUserID     primitive.ObjectID     `bson:"host_user_id,omitempty" json:"host_user_id,omitempty"`
 	
 	// Code Details
 	Language       SessionLanguage        `bson:"language" json:"language"`
+	// Version of the toolchain from the language registry at the time
+	LanguageVersion string                `bson:"language_version,omitempty" json:"language_version,omitempty"`
 	SourceCode     string                 `bson:"source_code" json:"source_code"`
+	FileVersion    int                    `bson:"file_version" json:"file_version"`
+	Entrypoint     string                 `bson:"entrypoint,omitempty" json:"entrypoint,omitempty"`
+	Sources        []SourceFile           `bson:"sources,omitempty" json:"sources,omitempty"`
+	Stdin          string                 `bson:"stdin,omitempty" json:"stdin,omitempty"`
+	// Interactive runs also read input sent over the session socket
+	Interactive    bool                   `bson:"interactive" json:"interactive"`
+	// Set for runs of a test case, which may bring a tighter time limit
+	TestRunID      primitive.ObjectID     `bson:"test_run_id,omitempty" json:"test_run_id,omitempty"`
+	TestCaseID     primitive.ObjectID     `bson:"test_case_id,omitempty" json:"test_case_id,omitempty"`
+	// Whether the case was hidden when queued; its input and output are then
+	// only shown to the host
+	HiddenTestCase bool                   `bson:"hidden_test_case,omitempty" json:"hidden_test_case,omitempty"`
+	TimeLimit      time.Duration          `bson:"time_limit,omitempty" json:"time_limit,omitempty"`
+	// The execution this one repeats, with the same code and input
+	RerunOf        primitive.ObjectID     `bson:"rerun_of,omitempty" json:"rerun_of,omitempty"`
 	
 	// Execution Metadata
 	Status         CodeExecutionStatus    `bson:"status" json:"status"`
@@ -36,8 +83,17 @@ type CodeExecution struct {
 	// Execution Results
 	Output         string                 `bson:"output" json:"output"`
 	ErrorMessage   string                 `bson:"error_message" json:"error_message,omitempty"`
+	ExitCode       int                    `bson:"exit_code" json:"exit_code"`
+	Transcript     []TranscriptChunk      `bson:"transcript,omitempty" json:"transcript,omitempty"`
+	Diagnostics    []ExecutionDiagnostic  `bson:"diagnostics,omitempty" json:"diagnostics,omitempty"`
 	
 	// Timestamps
 	CreatedAt      time.Time              `bson:"created_at" json:"created_at"`
+	StartedAt      time.Time              `bson:"started_at,omitempty" json:"started_at,omitempty"`
 	CompletedAt    time.Time              `bson:"completed_at" json:"completed_at,omitempty"`
+
+	// Queue Bookkeeping
+	WorkerID       string                 `bson:"worker_id,omitempty" json:"-"`
+	LeaseExpiresAt time.Time              `bson:"lease_expires_at,omitempty" json:"-"`
+	Attempts       int                    `bson:"attempts" json:"attempts"`
 }
\ No newline at end of file
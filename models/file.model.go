@@ -38,14 +38,34 @@ type File struct {
 	
 	// Collaboration Tracking
 	LastEditedBy primitive.ObjectID `bson:"last_edited_by" json:"last_edited_by"`
+
+	// Yjs updates saved by the y-websocket endpoint
+	YjsUpdates [][]byte `bson:"yjs_updates,omitempty" json:"-"`
 }
 
-// FileVersion tracks different versions of a file
+// FileVersion tracks different versions of a file. Most versions only store
+// a delta from the version before; every so often one keeps the full content
+// to rebuild the others from.
 type FileVersion struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	FileID     primitive.ObjectID `bson:"file_id" json:"file_id"`
-	Content    string             `bson:"content" json:"content"`
+	Content    string             `bson:"content,omitempty" json:"content"`
+	IsDelta    bool               `bson:"is_delta,omitempty" json:"-"`
+	Delta      []DeltaOp          `bson:"delta,omitempty" json:"-"`
 	Version    int                `bson:"version" json:"version"`
 	EditedBy   primitive.ObjectID `bson:"edited_by" json:"edited_by"`
 	EditedAt   time.Time          `bson:"edited_at" json:"edited_at"`
-}
\ No newline at end of file
+	// Set when the version brought back the content of an older one
+	RestoredFrom int              `bson:"restored_from,omitempty" json:"restored_from,omitempty"`
+	// Set when the version came from rolling back to a checkpoint
+	CheckpointID primitive.ObjectID `bson:"checkpoint_id,omitempty" json:"checkpoint_id,omitempty"`
+}
+
+// DeltaOp is one step of a line delta from the previous version of a file:
+// keep or drop that many of its lines, or add new ones. Lines keep their
+// line breaks.
+type DeltaOp struct {
+	Keep int      `bson:"keep,omitempty" json:"keep,omitempty"`
+	Drop int      `bson:"drop,omitempty" json:"drop,omitempty"`
+	Add  []string `bson:"add,omitempty" json:"add,omitempty"`
+}
@@ -15,17 +15,10 @@ const (
 	TypeWorkspace SessionType = "workspace"
 )
 
-// SessionLanguage represents supported programming languages
+// SessionLanguage is the name of a language in the language registry,
+// config/languages.json unless LANGUAGES_CONFIG names another file
 type SessionLanguage string
 
-const (
-	LanguagePython   SessionLanguage = "python"
-	LanguageGo       SessionLanguage = "go"
-	LanguageJavaScript SessionLanguage = "javascript"
-	LanguageRust     SessionLanguage = "rust"
-	LanguageJava     SessionLanguage = "java"
-)
-
 // Session represents a collaborative coding session
 type Session struct {
 	ID              primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
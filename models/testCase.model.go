@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestCase is an input and the output a program must print for it
+type TestCase struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SessionID primitive.ObjectID `bson:"session_id" json:"session_id"`
+	// Set when the case only applies to one file; otherwise it applies to
+	// every run in the session
+	FileID primitive.ObjectID `bson:"file_id,omitempty" json:"file_id,omitempty"`
+
+	Name           string        `bson:"name" json:"name"`
+	Stdin          string        `bson:"stdin" json:"stdin"`
+	ExpectedOutput string        `bson:"expected_output" json:"expected_output"`
+	TimeLimit      time.Duration `bson:"time_limit,omitempty" json:"time_limit,omitempty"`
+	Points         int           `bson:"points" json:"points"`
+	// Hidden cases only show their input and expected output to the host
+	Hidden bool `bson:"hidden" json:"hidden"`
+
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// TestResultStatus is the verdict on one test case
+type TestResultStatus string
+
+const (
+	TestPending  TestResultStatus = "pending"
+	TestPassed   TestResultStatus = "passed"
+	TestFailed   TestResultStatus = "failed"
+	TestTimedOut TestResultStatus = "timed_out"
+	// The program did not build, crashed or could not be run
+	TestError TestResultStatus = "error"
+)
+
+// TestResult is the outcome of running one test case
+type TestResult struct {
+	TestCaseID  primitive.ObjectID `bson:"test_case_id" json:"test_case_id"`
+	ExecutionID primitive.ObjectID `bson:"execution_id" json:"execution_id"`
+	Name        string             `bson:"name" json:"name"`
+	Hidden      bool               `bson:"hidden" json:"hidden"`
+	Status      TestResultStatus   `bson:"status" json:"status"`
+	Points      int                `bson:"points" json:"points"`
+	Earned      int                `bson:"earned" json:"earned"`
+	// Copied from the case when the run starts, so later edits don't change it
+	ExpectedOutput string `bson:"expected_output" json:"expected_output,omitempty"`
+	// Unified diff from the expected to the actual output
+	Diff string `bson:"diff,omitempty" json:"diff,omitempty"`
+}
+
+// TestRun runs a file or folder against the test cases of its session and
+// grades the results; each case is a CodeExecution of its own
+type TestRun struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	SessionID primitive.ObjectID `bson:"session_id" json:"session_id"`
+	FileID    primitive.ObjectID `bson:"file_id,omitempty" json:"file_id,omitempty"`
+	FolderID  primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+
+	Status   CodeExecutionStatus `bson:"status" json:"status"`
+	Results  []TestResult        `bson:"results" json:"results"`
+	Finished int                 `bson:"finished" json:"finished"`
+	Passed   int                 `bson:"passed" json:"passed"`
+	Score    int                 `bson:"score" json:"score"`
+	MaxScore int                 `bson:"max_score" json:"max_score"`
+
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	CompletedAt time.Time `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterCheckpointRoutes(router *gin.Engine, checkpointController *controllers.CheckpointController) {
+	checkpoint := router.Group("/checkpoints")
+
+	// Apply authentication middleware to all checkpoint routes
+	checkpoint.Use(middleware.AuthMiddleware())
+	{
+		checkpoint.POST("/", checkpointController.CreateCheckpoint)                 // Capture the files of a session or folder
+		checkpoint.GET("/session/:session_id", checkpointController.GetCheckpoints) // Checkpoints of a session
+		checkpoint.GET("/:id", checkpointController.GetCheckpoint)                  // A checkpoint and its file versions
+		checkpoint.GET("/:id/diff", checkpointController.DiffCheckpoints)           // Changes since a checkpoint
+		checkpoint.POST("/:id/restore", checkpointController.RestoreCheckpoint)     // Roll the files back, host only
+	}
+}
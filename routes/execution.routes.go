@@ -0,0 +1,24 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterExecutionRoutes(router *gin.Engine, executionController *controllers.ExecutionController) {
+	execution := router.Group("/executions")
+
+	// Apply authentication middleware to all execution routes
+	execution.Use(middleware.AuthMiddleware())
+	{
+		execution.POST("/", executionController.CreateExecution)         // Queue a run of a file
+		execution.GET("/", executionController.ListExecutions)           // Past runs by file, session or user
+		execution.GET("/queue", executionController.GetQueueStats)       // Queue depth and wait times
+		execution.GET("/:id", executionController.GetExecution)          // Status and output of a run
+		execution.POST("/:id/rerun", executionController.RerunExecution) // Run a past execution's code again
+		execution.POST("/tests", executionController.RunTests)           // Run code against its test cases
+		execution.GET("/tests/:id", executionController.GetTestRun)      // Verdicts and score of a test run
+	}
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterFileVersionRoutes(router *gin.Engine, fileVersionController *controllers.FileVersionController) {
+	version := router.Group("/versions")
+
+	// Apply authentication middleware to all version routes
+	version.Use(middleware.AuthMiddleware())
+	{
+		version.GET("/file/:file_id", fileVersionController.ListVersions)                     // Versions of a file, newest first
+		version.GET("/file/:file_id/diff", fileVersionController.DiffVersions)                // Diff between two versions
+		version.GET("/file/:file_id/blame", fileVersionController.Blame)                      // Who last changed each line
+		version.GET("/file/:file_id/:version", fileVersionController.GetVersion)              // Content of one version
+		version.POST("/file/:file_id/:version/restore", fileVersionController.RestoreVersion) // Make an old version the head
+	}
+}
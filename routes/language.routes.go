@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterLanguageRoutes(router *gin.Engine, languageController *controllers.LanguageController) {
+	language := router.Group("/languages")
+
+	// Apply authentication middleware to all language routes
+	language.Use(middleware.AuthMiddleware())
+	{
+		language.GET("/", languageController.GetLanguages) // Languages code can be run in
+	}
+}
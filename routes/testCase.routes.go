@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterTestCaseRoutes(router *gin.Engine, testCaseController *controllers.TestCaseController) {
+	testCase := router.Group("/tests")
+
+	// Apply authentication middleware to all test case routes
+	testCase.Use(middleware.AuthMiddleware())
+	{
+		testCase.POST("/", testCaseController.CreateTestCase)                  // Add a test case, host only
+		testCase.GET("/session/:session_id", testCaseController.GetTestCases) // Test cases of a session
+		testCase.PUT("/:id", testCaseController.UpdateTestCase)               // Change a test case, host only
+		testCase.DELETE("/:id", testCaseController.DeleteTestCase)            // Remove a test case, host only
+	}
+}
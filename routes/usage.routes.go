@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterUsageRoutes(router *gin.Engine, executionController *controllers.ExecutionController) {
+	me := router.Group("/me")
+
+	// Apply authentication middleware to all routes about the caller
+	me.Use(middleware.AuthMiddleware())
+	{
+		me.GET("/usage", executionController.GetUsage) // Execution quotas and how much is used
+	}
+}
@@ -2,11 +2,25 @@ package routes
 
 import (
 	"codeCollab-backend/controllers"
+	"codeCollab-backend/middleware"
 
 	"github.com/gin-gonic/gin"
 )
 
 // RegisterWebSocketRoutes defines WebSocket-related routes
-func RegisterWebSocketRoutes(router *gin.Engine) {
-	router.GET("/ws", controllers.WebSocketHandler)
+func RegisterWebSocketRoutes(router *gin.Engine, wsController *controllers.WebSocketController) {
+	// The handshake authenticates itself so it can accept a ticket instead of the cookie
+	router.GET("/ws", wsController.WebSocketHandler)
+
+	// y-websocket endpoint, one document per file
+	router.GET("/yjs/:file_id", wsController.YjsHandler)
+
+	// Short-lived tickets for opening a socket without the cookie
+	router.POST("/ws/ticket", middleware.AuthMiddleware(), wsController.IssueTicket)
+
+	// Connection and delivery counters of the hub
+	router.GET("/ws/stats", middleware.AuthMiddleware(), wsController.GetStats)
+
+	// Who is currently connected to a session
+	router.GET("/sessions/:id/presence", middleware.AuthMiddleware(), wsController.GetPresence)
 }
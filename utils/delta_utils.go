@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+
+	"codeCollab-backend/models"
+)
+
+// ErrDeltaMismatch is returned when a delta does not fit the text it is
+// applied to
+var ErrDeltaMismatch = errors.New("delta does not fit the text")
+
+// splitLinesKeepEnds splits text after each line break, so joining the lines
+// gives the text back exactly
+func splitLinesKeepEnds(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// LineDelta computes the line delta that turns old into new
+func LineDelta(old, new string) []models.DeltaOp {
+	var delta []models.DeltaOp
+	for _, line := range DiffLines(splitLinesKeepEnds(old), splitLinesKeepEnds(new)) {
+		last := len(delta) - 1
+		switch line.Op {
+		case DiffEqual:
+			if last >= 0 && delta[last].Keep > 0 {
+				delta[last].Keep++
+				continue
+			}
+			delta = append(delta, models.DeltaOp{Keep: 1})
+		case DiffDelete:
+			if last >= 0 && delta[last].Drop > 0 {
+				delta[last].Drop++
+				continue
+			}
+			delta = append(delta, models.DeltaOp{Drop: 1})
+		case DiffInsert:
+			if last >= 0 && len(delta[last].Add) > 0 {
+				delta[last].Add = append(delta[last].Add, line.Text)
+				continue
+			}
+			delta = append(delta, models.DeltaOp{Add: []string{line.Text}})
+		}
+	}
+	return delta
+}
+
+// ApplyLineDelta rebuilds the text a delta made from old
+func ApplyLineDelta(old string, delta []models.DeltaOp) (string, error) {
+	lines := splitLinesKeepEnds(old)
+	var out strings.Builder
+	pos := 0
+	for _, op := range delta {
+		if pos+op.Keep+op.Drop > len(lines) {
+			return "", ErrDeltaMismatch
+		}
+		for _, line := range lines[pos : pos+op.Keep] {
+			out.WriteString(line)
+		}
+		pos += op.Keep + op.Drop
+		for _, line := range op.Add {
+			out.WriteString(line)
+		}
+	}
+	if pos != len(lines) {
+		return "", ErrDeltaMismatch
+	}
+	return out.String(), nil
+}
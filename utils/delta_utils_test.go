@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"codeCollab-backend/models"
+)
+
+func TestLineDeltaRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+	}{
+		{name: "both empty", old: "", new: ""},
+		{name: "from empty", old: "", new: "a\nb\n"},
+		{name: "to empty", old: "a\nb\n", new: ""},
+		{name: "unchanged", old: "a\nb\nc\n", new: "a\nb\nc\n"},
+		{name: "line changed", old: "a\nb\nc\n", new: "a\nB\nc\n"},
+		{name: "line added", old: "a\nc\n", new: "a\nb\nc\n"},
+		{name: "line removed", old: "a\nb\nc\n", new: "a\nc\n"},
+		{name: "no trailing newline", old: "a\nb\nc", new: "a\nB\nc"},
+		{name: "trailing newline added", old: "a\nb", new: "a\nb\n"},
+		{name: "trailing newline removed", old: "a\nb\n", new: "a\nb"},
+		{name: "line appended without newline", old: "a", new: "a\nb"},
+		{name: "last line changed without newline", old: "a\nb", new: "a\nc"},
+		{name: "blank lines", old: "\n\n\n", new: "\n\nx\n\n"},
+		{name: "only newlines to text", old: "\n", new: "x"},
+		{name: "carriage returns", old: "a\r\nb\r\n", new: "a\r\nB\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyLineDelta(tt.old, LineDelta(tt.old, tt.new))
+			if err != nil {
+				t.Fatalf("ApplyLineDelta: %v", err)
+			}
+			if got != tt.new {
+				t.Errorf("got %q, want %q", got, tt.new)
+			}
+		})
+	}
+}
+
+// Large texts with many changes make the diff give up on a shortest edit
+// script; the delta must still rebuild the text exactly
+func TestLineDeltaRoundTripLarge(t *testing.T) {
+	var old, new strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&old, "line %d\n", i)
+		switch {
+		case i%7 == 0:
+			fmt.Fprintf(&new, "changed %d\n", i)
+		case i%11 == 0:
+		default:
+			fmt.Fprintf(&new, "line %d\n", i)
+		}
+		if i%13 == 0 {
+			fmt.Fprintf(&new, "added %d\n", i)
+		}
+	}
+
+	got, err := ApplyLineDelta(old.String(), LineDelta(old.String(), new.String()))
+	if err != nil {
+		t.Fatalf("ApplyLineDelta: %v", err)
+	}
+	if got != new.String() {
+		t.Error("rebuilt text differs")
+	}
+}
+
+func TestApplyLineDeltaMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		old   string
+		delta []models.DeltaOp
+	}{
+		{name: "keeps too many", old: "a\n", delta: []models.DeltaOp{{Keep: 2}}},
+		{name: "drops too many", old: "a\n", delta: []models.DeltaOp{{Drop: 2}}},
+		{name: "leaves lines over", old: "a\nb\n", delta: []models.DeltaOp{{Keep: 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ApplyLineDelta(tt.old, tt.delta); err != ErrDeltaMismatch {
+				t.Errorf("got %v, want ErrDeltaMismatch", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiffOp says what happens to a line going from the old text to the new one
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffDelete DiffOp = "delete"
+	DiffInsert DiffOp = "insert"
+)
+
+// DiffLine is one line of a line diff. OldLine and NewLine are 1-based line
+// numbers in each text, zero on the side the line is missing from.
+type DiffLine struct {
+	Op      DiffOp `json:"op"`
+	Text    string `json:"text"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+// DiffHunk is a run of changes with the unchanged lines around them
+type DiffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// Past this many edits DiffLines stops looking for the shortest diff and
+// replaces the rest of the text wholesale, bounding time and memory
+const diffCostLimit = 1000
+
+// SplitLines splits text into lines without their line breaks. A trailing
+// newline does not start another line.
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// DiffLines computes a shortest line diff from a to b with Myers' algorithm
+func DiffLines(a, b []string) []DiffLine {
+	// Common ends are never part of the edit script
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	diff := make([]DiffLine, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		diff = append(diff, DiffLine{Op: DiffEqual, Text: a[i], OldLine: i + 1, NewLine: i + 1})
+	}
+	for _, line := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		if line.OldLine > 0 {
+			line.OldLine += prefix
+		}
+		if line.NewLine > 0 {
+			line.NewLine += prefix
+		}
+		diff = append(diff, line)
+	}
+	for i := suffix; i > 0; i-- {
+		diff = append(diff, DiffLine{Op: DiffEqual, Text: a[len(a)-i], OldLine: len(a) - i + 1, NewLine: len(b) - i + 1})
+	}
+	return diff
+}
+
+// myers finds the edit script by walking the furthest reaching paths of each
+// cost, then backtracks through the saved frontiers
+func myers(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	limit := n + m
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		if d > diffCostLimit {
+			return replaceAll(a, b)
+		}
+		// Frontier before this step, diagonals -d..d
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Backtrack from the end, collecting lines in reverse
+	var reversed []DiffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		frontier := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && frontier[k-1+d] < frontier[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = frontier[prevK+d]
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffLine{Op: DiffEqual, Text: a[x-1], OldLine: x, NewLine: y})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, DiffLine{Op: DiffInsert, Text: b[y-1], NewLine: y})
+			} else {
+				reversed = append(reversed, DiffLine{Op: DiffDelete, Text: a[x-1], OldLine: x})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	diff := make([]DiffLine, len(reversed))
+	for i, line := range reversed {
+		diff[len(reversed)-1-i] = line
+	}
+	return diff
+}
+
+// replaceAll is the diff that deletes every line of a and inserts all of b
+func replaceAll(a, b []string) []DiffLine {
+	diff := make([]DiffLine, 0, len(a)+len(b))
+	for i, line := range a {
+		diff = append(diff, DiffLine{Op: DiffDelete, Text: line, OldLine: i + 1})
+	}
+	for i, line := range b {
+		diff = append(diff, DiffLine{Op: DiffInsert, Text: line, NewLine: i + 1})
+	}
+	return diff
+}
+
+// DiffHunks groups a diff into hunks keeping up to context unchanged lines
+// around each change. An unchanged diff has no hunks.
+func DiffHunks(diff []DiffLine, context int) []DiffHunk {
+	// Old and new line numbers at which each diff line sits
+	oldAt, newAt := make([]int, len(diff)), make([]int, len(diff))
+	oldLine, newLine := 1, 1
+	for i, line := range diff {
+		oldAt[i], newAt[i] = oldLine, newLine
+		if line.Op != DiffInsert {
+			oldLine++
+		}
+		if line.Op != DiffDelete {
+			newLine++
+		}
+	}
+
+	var hunks []DiffHunk
+	for i := 0; i < len(diff); {
+		if diff[i].Op == DiffEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk while the next change is close enough to merge
+		start := max(i-context, 0)
+		end := i
+		for end < len(diff) {
+			if diff[end].Op != DiffEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(diff) && diff[run].Op == DiffEqual {
+				run++
+			}
+			if run == len(diff) || run-end > 2*context {
+				end = min(end+context, len(diff))
+				break
+			}
+			end = run
+		}
+
+		hunk := DiffHunk{OldStart: oldAt[start], NewStart: newAt[start], Lines: diff[start:end]}
+		for _, line := range hunk.Lines {
+			if line.Op != DiffInsert {
+				hunk.OldLines++
+			}
+			if line.Op != DiffDelete {
+				hunk.NewLines++
+			}
+		}
+		// Like diff -u, an empty side starts at the line before it
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+// UnifiedDiff renders hunks in the unified format of diff -u, headed by the
+// names of the old and new texts
+func UnifiedDiff(oldName, newName string, hunks []DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldLines, hunk.NewStart, hunk.NewLines)
+		for _, line := range hunk.Lines {
+			switch line.Op {
+			case DiffEqual:
+				out.WriteByte(' ')
+			case DiffDelete:
+				out.WriteByte('-')
+			case DiffInsert:
+				out.WriteByte('+')
+			}
+			out.WriteString(line.Text)
+			out.WriteByte('\n')
+		}
+	}
+	return out.String()
+}
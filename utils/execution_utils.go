@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"codeCollab-backend/config"
+)
+
+var (
+	// ErrUnsupportedLanguage is returned for languages missing from the registry
+	ErrUnsupportedLanguage = errors.New("unsupported language")
+	// ErrSandboxUnavailable is returned when the server cannot confine programs
+	ErrSandboxUnavailable = errors.New("the sandbox needs a Linux server running as root")
+)
+
+// Where the work directory appears to programs running in a language's rootfs
+const sandboxWorkdir = "/workspace"
+
+// Directories of the work directory where builds see their build cache and
+// where programs and builds keep temporary files
+const (
+	sandboxCacheName = ".codecollab-cache"
+	sandboxTmpName   = ".codecollab-tmp"
+)
+
+// sandboxRun is one run of a program, and of its build, which share a work
+// directory and an account no other run is using
+type sandboxRun struct {
+	dir      string
+	uid      int    // the group has the same ID
+	cacheKey string // whose build cache the build uses, if anyone's
+}
+
+// SandboxLimits bounds what a program may use. Compilers run under the same
+// limits except for wall-clock time, which is CompileTime for them.
+type SandboxLimits struct {
+	WallTime       time.Duration // real time the program may run
+	CPUTime        time.Duration // CPU time the program may use
+	CompileTime    time.Duration // real time the build may take
+	MemoryBytes    int64         // heap and data segment size
+	MaxProcesses   int           // processes and threads
+	MaxOutputBytes int64         // stdout and stderr together
+	MaxFileBytes   int64         // size of any file the program writes
+}
+
+// Output streams and phases reported to RunOptions.OnOutput
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+
+	PhaseCompile = "compile"
+	PhaseRun     = "run"
+)
+
+// RunOptions are the optional parts of a run
+type RunOptions struct {
+	// OnOutput receives output as the program produces it. It is called from
+	// the goroutines copying the pipes, must not block, and must copy data if
+	// it keeps it.
+	OnOutput func(phase, stream string, data []byte)
+	// Stdin is fed to the program, not the compiler. The program sees end of
+	// input when the reader returns io.EOF.
+	Stdin io.Reader
+	// CacheKey names the build cache the build keeps between runs, such as
+	// the ID of the user running it; builds of other keys never see it.
+	// Builds without a key start from an empty cache.
+	CacheKey string
+}
+
+// RunResult is the outcome of running a program
+type RunResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration // wall-clock time
+	CPUTime  time.Duration // user and system time from rusage
+	// CPU time of the build, when it succeeded and the program was run;
+	// a build that failed reports its own in CPUTime
+	CompileCPUTime time.Duration
+	// Peak resident memory from rusage, in bytes
+	MemoryUsed int64
+	TimedOut   bool
+	// Set when the output limit was hit and the program was stopped
+	OutputTruncated bool
+	// Set when the program did not build; Stderr holds the compiler output
+	CompileFailed bool
+	// Errors and warnings located in the sources, from the compiler or from
+	// the program's own error report
+	Diagnostics []Diagnostic
+}
+
+// RunCode runs a single source file, saved under the language's first
+// entrypoint name; see RunProject
+func RunCode(ctx context.Context, language config.LanguageConfig, source string, limits SandboxLimits, opts RunOptions) (RunResult, error) {
+	name := language.Entrypoints[0]
+	return RunProject(ctx, language, []ProjectFile{{Path: name, Content: source}}, name, limits, opts)
+}
+
+// RunProject writes the files to a throwaway directory, builds them if the
+// language needs it and runs the entrypoint in the sandbox
+func RunProject(ctx context.Context, language config.LanguageConfig, files []ProjectFile, entrypoint string, limits SandboxLimits, opts RunOptions) (RunResult, error) {
+	dir, err := os.MkdirTemp("", "codecollab-run-")
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeProject(dir, files); err != nil {
+		return RunResult{}, err
+	}
+	plan, err := planProject(language, dir, files, entrypoint)
+	if err != nil {
+		return RunResult{}, err
+	}
+	run, release, err := newSandboxRun(ctx, dir, opts.CacheKey)
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer release()
+
+	// Paths in error reports are the ones the program saw
+	seenDir := dir
+	if language.Rootfs != "" {
+		seenDir = sandboxWorkdir
+	}
+
+	var compileCPU time.Duration
+	if len(plan.Compile) > 0 {
+		result, err := runSandboxed(ctx, run, plan.Compile, limits, language, true, opts)
+		if err != nil {
+			return result, err
+		}
+		if result.TimedOut || result.ExitCode != 0 {
+			result.CompileFailed = !result.TimedOut
+			result.Diagnostics = ParseDiagnostics(language.Diagnostics, seenDir, result.Stderr+result.Stdout)
+			return result, nil
+		}
+		compileCPU = result.CPUTime
+	}
+
+	result, err := runSandboxed(ctx, run, plan.Run, limits, language, false, opts)
+	result.CompileCPUTime = compileCPU
+	if err == nil && result.ExitCode != 0 && !result.TimedOut {
+		result.Diagnostics = ParseDiagnostics(language.Diagnostics, seenDir, result.Stderr)
+	}
+	return result, err
+}
+
+// runSandboxed runs one command of a run under the limits and collects its
+// output and resource usage
+func runSandboxed(ctx context.Context, run *sandboxRun, args []string, limits SandboxLimits, language config.LanguageConfig, compile bool, opts RunOptions) (RunResult, error) {
+	wallTime, phase := limits.WallTime, PhaseRun
+	if compile {
+		wallTime, phase = limits.CompileTime, PhaseCompile
+	}
+	ctx, cancel := context.WithTimeout(ctx, wallTime)
+	defer cancel()
+
+	output := &cappedOutput{limit: limits.MaxOutputBytes, overflow: cancel}
+	if opts.OnOutput != nil {
+		output.notify = func(stream string, data []byte) { opts.OnOutput(phase, stream, data) }
+	}
+	cmd, done, err := sandboxCommand(ctx, run, args, limits, language, compile)
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer done()
+	cmd.Stdout = output.stream(StreamStdout, &output.stdout)
+	cmd.Stderr = output.stream(StreamStderr, &output.stderr)
+	cmd.WaitDelay = time.Second
+
+	if opts.Stdin != nil && !compile {
+		// Copy by hand: an interactive reader can block long after the
+		// program exits, and exec would wait for it
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return RunResult{}, err
+		}
+		go func() {
+			io.Copy(stdin, opts.Stdin)
+			stdin.Close()
+		}()
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	result := RunResult{
+		Stdout:          string(output.stdout),
+		Stderr:          string(output.stderr),
+		Duration:        time.Since(start),
+		OutputTruncated: output.truncated,
+	}
+	if cmd.ProcessState != nil {
+		result.CPUTime, result.MemoryUsed = processUsage(cmd.ProcessState)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case output.truncated:
+		result.ExitCode = -1
+	case ctx.Err() == context.DeadlineExceeded || cpuLimitHit(cmd.ProcessState, limits):
+		result.TimedOut = true
+		result.ExitCode = -1
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		return result, err
+	}
+	return result, nil
+}
+
+// cappedOutput collects stdout and stderr up to a shared limit and stops the
+// program once it is exceeded
+type cappedOutput struct {
+	sync.Mutex
+	stdout, stderr []byte
+	limit          int64
+	written        int64
+	truncated      bool
+	overflow       func()
+	notify         func(stream string, data []byte)
+}
+
+// stream returns a writer that appends to one of the buffers
+func (o *cappedOutput) stream(name string, buf *[]byte) *outputStream {
+	return &outputStream{output: o, name: name, buf: buf}
+}
+
+type outputStream struct {
+	output *cappedOutput
+	name   string
+	buf    *[]byte
+}
+
+func (s *outputStream) Write(p []byte) (int, error) {
+	o := s.output
+	o.Lock()
+	defer o.Unlock()
+
+	kept := p
+	if room := o.limit - o.written; int64(len(p)) > room {
+		kept = p[:max(room, 0)]
+		if !o.truncated {
+			o.truncated = true
+			o.overflow()
+		}
+	}
+	if len(kept) > 0 {
+		*s.buf = append(*s.buf, kept...)
+		o.written += int64(len(kept))
+		if o.notify != nil {
+			o.notify(s.name, kept)
+		}
+	}
+	// Report success so the copy keeps draining the pipe until the kill
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"codeCollab-backend/config"
+)
+
+// LanguageRegistry holds the languages code can be written and run in
+type LanguageRegistry struct {
+	languages   []config.LanguageConfig
+	byName      map[string]int
+	byExtension map[string]int
+}
+
+// NewLanguageRegistry checks the languages and indexes them by name and
+// file extension. The first language is the default.
+func NewLanguageRegistry(languages []config.LanguageConfig) (*LanguageRegistry, error) {
+	if len(languages) == 0 {
+		return nil, fmt.Errorf("no languages are configured")
+	}
+	r := &LanguageRegistry{
+		languages:   languages,
+		byName:      make(map[string]int, len(languages)),
+		byExtension: make(map[string]int),
+	}
+	for i, language := range languages {
+		switch {
+		case language.Name == "":
+			return nil, fmt.Errorf("language %d has no name", i)
+		case len(language.Run) == 0:
+			return nil, fmt.Errorf("language %s has no run command", language.Name)
+		case len(language.Entrypoints) == 0:
+			return nil, fmt.Errorf("language %s has no entrypoints", language.Name)
+		}
+		if _, ok := r.byName[language.Name]; ok {
+			return nil, fmt.Errorf("language %s is defined twice", language.Name)
+		}
+		for _, project := range language.Projects {
+			if project.Marker == "" || len(project.Run) == 0 {
+				return nil, fmt.Errorf("language %s has a project without marker or run command", language.Name)
+			}
+		}
+		r.byName[language.Name] = i
+
+		for _, extension := range language.Extensions {
+			extension = strings.ToLower(extension)
+			if other, ok := r.byExtension[extension]; ok {
+				return nil, fmt.Errorf("extension %s belongs to both %s and %s", extension, languages[other].Name, language.Name)
+			}
+			r.byExtension[extension] = i
+		}
+	}
+	return r, nil
+}
+
+// Lookup finds a language by name
+func (r *LanguageRegistry) Lookup(name string) (config.LanguageConfig, bool) {
+	i, ok := r.byName[name]
+	if !ok {
+		return config.LanguageConfig{}, false
+	}
+	return r.languages[i], true
+}
+
+// Default returns the language used when none is asked for
+func (r *LanguageRegistry) Default() config.LanguageConfig {
+	return r.languages[0]
+}
+
+// Detect finds the language of a file from its extension
+func (r *LanguageRegistry) Detect(fileName string) (config.LanguageConfig, bool) {
+	i, ok := r.byExtension[strings.ToLower(path.Ext(fileName))]
+	if !ok {
+		return config.LanguageConfig{}, false
+	}
+	return r.languages[i], true
+}
+
+// All lists the languages in the order they were configured
+func (r *LanguageRegistry) All() []config.LanguageConfig {
+	return r.languages
+}
+
+// LanguageLimits applies a language's own limits over the server's
+func LanguageLimits(limits SandboxLimits, language config.LanguageConfig) SandboxLimits {
+	if language.Limits.WallTime > 0 {
+		limits.WallTime = time.Duration(language.Limits.WallTime)
+	}
+	if language.Limits.CPUTime > 0 {
+		limits.CPUTime = time.Duration(language.Limits.CPUTime)
+	}
+	if language.Limits.CompileTime > 0 {
+		limits.CompileTime = time.Duration(language.Limits.CompileTime)
+	}
+	if language.Limits.MemoryMB > 0 {
+		limits.MemoryBytes = int64(language.Limits.MemoryMB) << 20
+	}
+	if language.Limits.MaxProcesses > 0 {
+		limits.MaxProcesses = language.Limits.MaxProcesses
+	}
+	return limits
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+)
+
+// MergeConflict is a stretch of the common ancestor that both sides changed
+// differently. Starts are 1-based line numbers in each text.
+type MergeConflict struct {
+	BaseStart   int      `json:"base_start"`
+	OursStart   int      `json:"ours_start"`
+	TheirsStart int      `json:"theirs_start"`
+	Base        []string `json:"base"`
+	Ours        []string `json:"ours"`
+	Theirs      []string `json:"theirs"`
+}
+
+// lineChange replaces base[start:end] with lines
+type lineChange struct {
+	start, end int
+	lines      []string
+}
+
+// MergeText merges two texts edited from a common base line by line, the way
+// diff3 does. Changes of one side are taken as they are; where both sides
+// changed the same or adjacent lines differently the merge conflicts and
+// only the conflicts are returned.
+func MergeText(base, ours, theirs string) (string, []MergeConflict) {
+	if ours == theirs || theirs == base {
+		return ours, nil
+	}
+	if ours == base {
+		return theirs, nil
+	}
+
+	baseLines := SplitLines(base)
+	oursChanges := lineChanges(baseLines, SplitLines(ours))
+	theirsChanges := lineChanges(baseLines, SplitLines(theirs))
+
+	var merged []string
+	var conflicts []MergeConflict
+	// Lines each side has added or removed before the current position
+	oursShift, theirsShift := 0, 0
+	pos, i, j := 0, 0, 0
+	for i < len(oursChanges) || j < len(theirsChanges) {
+		// Start a cluster at the earliest change and pull in every change of
+		// either side that touches it
+		start := len(baseLines) + 1
+		if i < len(oursChanges) {
+			start = oursChanges[i].start
+		}
+		if j < len(theirsChanges) {
+			start = min(start, theirsChanges[j].start)
+		}
+		end := start
+		firstOurs, firstTheirs := i, j
+		for {
+			grew := false
+			if i < len(oursChanges) && oursChanges[i].start <= end {
+				end = max(end, oursChanges[i].end)
+				i++
+				grew = true
+			}
+			if j < len(theirsChanges) && theirsChanges[j].start <= end {
+				end = max(end, theirsChanges[j].end)
+				j++
+				grew = true
+			}
+			if !grew {
+				break
+			}
+		}
+
+		merged = append(merged, baseLines[pos:start]...)
+		oursSpan := applyChanges(baseLines, start, end, oursChanges[firstOurs:i])
+		theirsSpan := applyChanges(baseLines, start, end, theirsChanges[firstTheirs:j])
+		switch {
+		case firstTheirs == j:
+			merged = append(merged, oursSpan...)
+		case firstOurs == i, slices.Equal(oursSpan, theirsSpan):
+			merged = append(merged, theirsSpan...)
+		default:
+			conflicts = append(conflicts, MergeConflict{
+				BaseStart:   start + 1,
+				OursStart:   start + oursShift + 1,
+				TheirsStart: start + theirsShift + 1,
+				Base:        baseLines[start:end],
+				Ours:        oursSpan,
+				Theirs:      theirsSpan,
+			})
+		}
+		oursShift += len(oursSpan) - (end - start)
+		theirsShift += len(theirsSpan) - (end - start)
+		pos = end
+	}
+	if len(conflicts) > 0 {
+		return "", conflicts
+	}
+	merged = append(merged, baseLines[pos:]...)
+
+	// Keep the final newline unless one side changed whether there is one
+	text := strings.Join(merged, "\n")
+	newline := strings.HasSuffix(ours, "\n")
+	if newline == strings.HasSuffix(base, "\n") {
+		newline = strings.HasSuffix(theirs, "\n")
+	}
+	if newline && len(merged) > 0 {
+		text += "\n"
+	}
+	return text, nil
+}
+
+// lineChanges lists the stretches of base that a line diff to other replaces
+func lineChanges(base, other []string) []lineChange {
+	var changes []lineChange
+	pos := 0
+	var current *lineChange
+	for _, line := range DiffLines(base, other) {
+		if line.Op == DiffEqual {
+			current = nil
+			pos++
+			continue
+		}
+		if current == nil {
+			changes = append(changes, lineChange{start: pos, end: pos})
+			current = &changes[len(changes)-1]
+		}
+		if line.Op == DiffDelete {
+			pos++
+			current.end = pos
+		} else {
+			current.lines = append(current.lines, line.Text)
+		}
+	}
+	return changes
+}
+
+// applyChanges returns base[start:end] with the changes, which lie within
+// it, applied
+func applyChanges(base []string, start, end int, changes []lineChange) []string {
+	span := []string{}
+	pos := start
+	for _, change := range changes {
+		span = append(span, base[pos:change.start]...)
+		span = append(span, change.lines...)
+		pos = change.end
+	}
+	return append(span, base[pos:end]...)
+}
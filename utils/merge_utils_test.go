@@ -0,0 +1,126 @@
+package utils
+
+import "testing"
+
+func TestMergeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		ours     string
+		theirs   string
+		want     string
+		conflict bool
+	}{
+		{
+			name: "nothing changed",
+			base: "a\nb\n", ours: "a\nb\n", theirs: "a\nb\n",
+			want: "a\nb\n",
+		},
+		{
+			name: "only ours changed",
+			base: "a\nb\nc\n", ours: "a\nB\nc\n", theirs: "a\nb\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "only theirs changed",
+			base: "a\nb\nc\n", ours: "a\nb\nc\n", theirs: "a\nb\nC\n",
+			want: "a\nb\nC\n",
+		},
+		{
+			name: "identical changes",
+			base: "a\nb\nc\nd\n", ours: "a\nB\nc\nD\n", theirs: "a\nB\nc\nD\n",
+			want: "a\nB\nc\nD\n",
+		},
+		{
+			name: "identical change among others",
+			base: "a\nb\nc\nd\ne\n", ours: "A\nb\nX\nd\ne\n", theirs: "a\nb\nX\nd\nE\n",
+			want: "A\nb\nX\nd\nE\n",
+		},
+		{
+			name: "changes apart",
+			base: "a\nb\nc\nd\ne\n", ours: "A\nb\nc\nd\ne\n", theirs: "a\nb\nc\nd\nE\n",
+			want: "A\nb\nc\nd\nE\n",
+		},
+		{
+			name: "adjacent edits",
+			base: "a\nb\nc\nd\n", ours: "a\nB\nc\nd\n", theirs: "a\nb\nC\nd\n",
+			conflict: true,
+		},
+		{
+			name: "same line changed differently",
+			base: "a\nb\nc\n", ours: "a\nX\nc\n", theirs: "a\nY\nc\n",
+			conflict: true,
+		},
+		{
+			name: "both insert the same at one point",
+			base: "a\nc\n", ours: "a\nb\nc\n", theirs: "a\nb\nc\n",
+			want: "a\nb\nc\n",
+		},
+		{
+			name: "both insert differently at one point",
+			base: "a\nc\n", ours: "a\nX\nc\n", theirs: "a\nY\nc\n",
+			conflict: true,
+		},
+		{
+			name: "insert and delete apart",
+			base: "a\nb\nc\nd\ne\n", ours: "a\nX\nb\nc\nd\ne\n", theirs: "a\nb\nc\ne\n",
+			want: "a\nX\nb\nc\ne\n",
+		},
+		{
+			name: "delete against edit",
+			base: "a\nb\nc\n", ours: "a\nc\n", theirs: "a\nB\nc\n",
+			conflict: true,
+		},
+		{
+			name: "from empty",
+			base: "", ours: "a\n", theirs: "b\n",
+			conflict: true,
+		},
+		{
+			name: "trailing newline removed by ours",
+			base: "a\nb\nc\n", ours: "a\nb\nc", theirs: "A\nb\nc\n",
+			want: "A\nb\nc",
+		},
+		{
+			name: "trailing newline added by theirs",
+			base: "a\nb\nc", ours: "A\nb\nc", theirs: "a\nb\nc\n",
+			want: "A\nb\nc\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := MergeText(tt.base, tt.ours, tt.theirs)
+			if tt.conflict {
+				if len(conflicts) == 0 {
+					t.Fatalf("got %q without conflicts, want a conflict", got)
+				}
+				return
+			}
+			if len(conflicts) > 0 {
+				t.Fatalf("got conflicts %+v, want %q", conflicts, tt.want)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTextConflictLines(t *testing.T) {
+	base := "a\nb\nc\nd\n"
+	ours := "x\na\nB\nc\nd\n"
+	theirs := "a\nBB\nc\nd\n"
+
+	_, conflicts := MergeText(base, ours, theirs)
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts, want 1", len(conflicts))
+	}
+	got := conflicts[0]
+	if got.BaseStart != 2 || got.OursStart != 3 || got.TheirsStart != 2 {
+		t.Errorf("got starts base %d, ours %d, theirs %d, want 2, 3 and 2", got.BaseStart, got.OursStart, got.TheirsStart)
+	}
+	if len(got.Ours) != 1 || got.Ours[0] != "B" || len(got.Theirs) != 1 || got.Theirs[0] != "BB" {
+		t.Errorf("got ours %q and theirs %q, want [B] and [BB]", got.Ours, got.Theirs)
+	}
+}
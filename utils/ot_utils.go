@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// Errors returned when operations do not line up with a document
+var (
+	ErrOperationLength  = errors.New("operation base length does not match document length")
+	ErrInvalidOperation = errors.New("invalid operation component")
+	ErrIncompatibleOps  = errors.New("operations were not made against the same document")
+)
+
+// OpComponent is a single step of a TextOperation. Exactly one of Retain,
+// Insert or Delete is set
+type OpComponent struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// TextOperation describes an edit as a walk over the whole document: retain
+// skips characters, insert adds text and delete removes characters. Lengths
+// are counted in Unicode code points.
+//
+// On the wire an operation is a JSON array in the ot.js format: a positive
+// number retains, a negative number deletes and a string inserts.
+type TextOperation struct {
+	Ops          []OpComponent
+	BaseLength   int
+	TargetLength int
+}
+
+// Retain skips n characters
+func (o *TextOperation) Retain(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	o.TargetLength += n
+	if l := len(o.Ops); l > 0 && o.Ops[l-1].Retain > 0 {
+		o.Ops[l-1].Retain += n
+		return o
+	}
+	o.Ops = append(o.Ops, OpComponent{Retain: n})
+	return o
+}
+
+// Insert adds text at the current position
+func (o *TextOperation) Insert(s string) *TextOperation {
+	if s == "" {
+		return o
+	}
+	o.TargetLength += utf8.RuneCountInString(s)
+
+	l := len(o.Ops)
+	switch {
+	case l > 0 && o.Ops[l-1].Insert != "":
+		o.Ops[l-1].Insert += s
+	case l > 0 && o.Ops[l-1].Delete > 0:
+		// Keep inserts ahead of deletes so equivalent operations look the same
+		if l > 1 && o.Ops[l-2].Insert != "" {
+			o.Ops[l-2].Insert += s
+			break
+		}
+		o.Ops = append(o.Ops, o.Ops[l-1])
+		o.Ops[l-1] = OpComponent{Insert: s}
+	default:
+		o.Ops = append(o.Ops, OpComponent{Insert: s})
+	}
+	return o
+}
+
+// Delete removes n characters at the current position
+func (o *TextOperation) Delete(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	if l := len(o.Ops); l > 0 && o.Ops[l-1].Delete > 0 {
+		o.Ops[l-1].Delete += n
+		return o
+	}
+	o.Ops = append(o.Ops, OpComponent{Delete: n})
+	return o
+}
+
+// IsNoop reports whether the operation leaves the document unchanged
+func (o TextOperation) IsNoop() bool {
+	return len(o.Ops) == 0 || (len(o.Ops) == 1 && o.Ops[0].Retain > 0)
+}
+
+// MarshalJSON encodes the operation in the ot.js array format
+func (o TextOperation) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, 0, len(o.Ops))
+	for _, op := range o.Ops {
+		switch {
+		case op.Retain > 0:
+			parts = append(parts, op.Retain)
+		case op.Delete > 0:
+			parts = append(parts, -op.Delete)
+		default:
+			parts = append(parts, op.Insert)
+		}
+	}
+	return json.Marshal(parts)
+}
+
+// UnmarshalJSON decodes the ot.js array format
+func (o *TextOperation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+
+	var op TextOperation
+	for _, part := range parts {
+		var text string
+		if err := json.Unmarshal(part, &text); err == nil {
+			if text == "" {
+				return ErrInvalidOperation
+			}
+			op.Insert(text)
+			continue
+		}
+
+		var n int
+		if err := json.Unmarshal(part, &n); err != nil || n == 0 {
+			return ErrInvalidOperation
+		}
+		if n > 0 {
+			op.Retain(n)
+		} else {
+			op.Delete(-n)
+		}
+	}
+
+	*o = op
+	return nil
+}
+
+// Apply runs the operation against a document and returns the new content
+func (o TextOperation) Apply(doc string) (string, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLength {
+		return "", ErrOperationLength
+	}
+
+	result := make([]rune, 0, o.TargetLength)
+	pos := 0
+	for _, op := range o.Ops {
+		switch {
+		case op.Retain > 0:
+			result = append(result, runes[pos:pos+op.Retain]...)
+			pos += op.Retain
+		case op.Delete > 0:
+			pos += op.Delete
+		default:
+			result = append(result, []rune(op.Insert)...)
+		}
+	}
+	return string(result), nil
+}
+
+// DiffOperation builds an operation that turns old into new by replacing
+// what lies between their common prefix and suffix
+func DiffOperation(old, new string) TextOperation {
+	a, b := []rune(old), []rune(new)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op TextOperation
+	op.Retain(prefix)
+	op.Insert(string(b[prefix : len(b)-suffix]))
+	op.Delete(len(a) - prefix - suffix)
+	op.Retain(suffix)
+	return op
+}
+
+// Transform takes two operations made concurrently against the same document
+// and returns a' and b' such that applying a then b' gives the same result as
+// applying b then a'. When both insert at the same position a's text goes first.
+func Transform(a, b TextOperation) (TextOperation, TextOperation, error) {
+	var aPrime, bPrime TextOperation
+	if a.BaseLength != b.BaseLength {
+		return aPrime, bPrime, ErrIncompatibleOps
+	}
+
+	i, j := 0, 0
+	var op1, op2 *OpComponent
+	next := func(ops []OpComponent, idx *int) *OpComponent {
+		if *idx >= len(ops) {
+			return nil
+		}
+		c := ops[*idx]
+		*idx++
+		return &c
+	}
+	op1 = next(a.Ops, &i)
+	op2 = next(b.Ops, &j)
+
+	for op1 != nil || op2 != nil {
+		if op1 != nil && op1.Insert != "" {
+			aPrime.Insert(op1.Insert)
+			bPrime.Retain(utf8.RuneCountInString(op1.Insert))
+			op1 = next(a.Ops, &i)
+			continue
+		}
+		if op2 != nil && op2.Insert != "" {
+			aPrime.Retain(utf8.RuneCountInString(op2.Insert))
+			bPrime.Insert(op2.Insert)
+			op2 = next(b.Ops, &j)
+			continue
+		}
+		if op1 == nil || op2 == nil {
+			return aPrime, bPrime, ErrIncompatibleOps
+		}
+
+		len1 := op1.Retain + op1.Delete
+		len2 := op2.Retain + op2.Delete
+		n := len1
+		if len2 < n {
+			n = len2
+		}
+
+		switch {
+		case op1.Retain > 0 && op2.Retain > 0:
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case op1.Delete > 0 && op2.Retain > 0:
+			aPrime.Delete(n)
+		case op1.Retain > 0 && op2.Delete > 0:
+			bPrime.Delete(n)
+		}
+		// Both deleting the same range needs nothing on either side
+
+		if len1 == n {
+			op1 = next(a.Ops, &i)
+		} else {
+			shrink(op1, n)
+		}
+		if len2 == n {
+			op2 = next(b.Ops, &j)
+		} else {
+			shrink(op2, n)
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// shrink consumes n characters from a retain or delete component
+func shrink(op *OpComponent, n int) {
+	if op.Retain > 0 {
+		op.Retain -= n
+	} else {
+		op.Delete -= n
+	}
+}
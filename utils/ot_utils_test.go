@@ -0,0 +1,78 @@
+package utils
+
+import "testing"
+
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		ours   string
+		theirs string
+		want   string
+	}{
+		{name: "no changes", doc: "abc", ours: "abc", theirs: "abc", want: "abc"},
+		{name: "one side only", doc: "abc", ours: "abXc", theirs: "abc", want: "abXc"},
+		{name: "inserts apart", doc: "abcdef", ours: "Xabcdef", theirs: "abcdefY", want: "XabcdefY"},
+		{name: "inserts at one point", doc: "ab", ours: "aXb", theirs: "aYb", want: "aXYb"},
+		{name: "inserts at the start", doc: "ab", ours: "Xab", theirs: "Yab", want: "XYab"},
+		{name: "inserts at the end", doc: "ab", ours: "abX", theirs: "abY", want: "abXY"},
+		{name: "same delete", doc: "abcdef", ours: "aef", theirs: "aef", want: "aef"},
+		{name: "overlapping deletes", doc: "abcdef", ours: "aef", theirs: "abf", want: "af"},
+		{name: "delete around an insert", doc: "abcdef", ours: "af", theirs: "abcXdef", want: "aXf"},
+		{name: "replace against delete", doc: "abcdef", ours: "aZZf", theirs: "abc", want: "aZZ"},
+		{name: "delete everything", doc: "abc", ours: "", theirs: "aXbc", want: "X"},
+		{name: "empty document", doc: "", ours: "X", theirs: "Y", want: "XY"},
+		{name: "multibyte", doc: "héllo😀 wörld", ours: "héllo😀, wörld", theirs: "hällo😀 wörld", want: "hällo😀, wörld"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := DiffOperation(tt.doc, tt.ours)
+			b := DiffOperation(tt.doc, tt.theirs)
+
+			aPrime, bPrime, err := Transform(a, b)
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+
+			afterA, err := a.Apply(tt.doc)
+			if err != nil {
+				t.Fatalf("applying a: %v", err)
+			}
+			viaA, err := bPrime.Apply(afterA)
+			if err != nil {
+				t.Fatalf("applying b': %v", err)
+			}
+			afterB, err := b.Apply(tt.doc)
+			if err != nil {
+				t.Fatalf("applying b: %v", err)
+			}
+			viaB, err := aPrime.Apply(afterB)
+			if err != nil {
+				t.Fatalf("applying a': %v", err)
+			}
+
+			if viaA != viaB {
+				t.Fatalf("diverged: a then b' gives %q, b then a' gives %q", viaA, viaB)
+			}
+			if viaA != tt.want {
+				t.Errorf("got %q, want %q", viaA, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformRejectsDifferentBases(t *testing.T) {
+	a := DiffOperation("abc", "abcd")
+	b := DiffOperation("ab", "abX")
+	if _, _, err := Transform(a, b); err != ErrIncompatibleOps {
+		t.Fatalf("got %v, want ErrIncompatibleOps", err)
+	}
+}
+
+func TestApplyRejectsWrongLength(t *testing.T) {
+	op := DiffOperation("abc", "abXc")
+	if _, err := op.Apply("ab"); err != ErrOperationLength {
+		t.Fatalf("got %v, want ErrOperationLength", err)
+	}
+}
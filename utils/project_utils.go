@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"codeCollab-backend/config"
+)
+
+// ErrInvalidProjectPath is returned for file names that would land outside
+// the project directory
+var ErrInvalidProjectPath = errors.New("invalid project file path")
+
+// ProjectFile is one source file of a project, at a slash-separated path
+// relative to the project root
+type ProjectFile struct {
+	Path    string
+	Content string
+}
+
+// Diagnostic is an error or warning located in a project file
+type Diagnostic struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// projectPlan is how a project is built and started
+type projectPlan struct {
+	Compile []string
+	Run     []string
+}
+
+// Name given to binaries the runner builds itself
+const programBinary = "program.out"
+
+// CleanProjectPath normalizes a file name into a project path, rejecting
+// absolute paths and ones that climb out of the project
+func CleanProjectPath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidProjectPath, name)
+	}
+	return cleaned, nil
+}
+
+// writeProject materializes the files under dir
+func writeProject(dir string, files []ProjectFile) error {
+	for _, file := range files {
+		cleaned, err := CleanProjectPath(file.Path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(cleaned))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, []byte(file.Content), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planProject picks the build and run commands for a project from its
+// language. The entrypoint is the file that starts the program; an empty one
+// means the first of the language's usual entrypoints the project has.
+func planProject(language config.LanguageConfig, dir string, files []ProjectFile, entrypoint string) (projectPlan, error) {
+	paths := make(map[string]string, len(files))
+	for _, file := range files {
+		cleaned, _ := CleanProjectPath(file.Path)
+		paths[cleaned] = file.Content
+	}
+
+	entry := ""
+	if entrypoint != "" {
+		cleaned, err := CleanProjectPath(entrypoint)
+		if err != nil {
+			return projectPlan{}, err
+		}
+		entry = cleaned
+	} else {
+		entry = language.Entrypoints[0]
+		for _, candidate := range language.Entrypoints {
+			if _, ok := paths[candidate]; ok {
+				entry = candidate
+				break
+			}
+		}
+	}
+
+	for name, content := range language.SetupFiles {
+		if _, ok := paths[name]; ok {
+			continue
+		}
+		if err := writeProject(dir, []ProjectFile{{Path: name, Content: content}}); err != nil {
+			return projectPlan{}, err
+		}
+	}
+
+	entryDir := path.Dir(entry)
+	if entryDir != "." {
+		entryDir = "./" + entryDir
+	}
+	values := []string{
+		"{entry}", entry,
+		"{entry_dir}", entryDir,
+		"{entry_module}", strings.ReplaceAll(strings.TrimSuffix(entry, path.Ext(entry)), "/", "."),
+		"{binary}", programBinary,
+	}
+
+	plan := projectPlan{Compile: language.Compile, Run: language.Run}
+	for _, project := range language.Projects {
+		manifest, ok := paths[project.Marker]
+		if !ok {
+			continue
+		}
+		plan = projectPlan{Compile: project.Compile, Run: project.Run}
+		if name := manifestPackageName(manifest); name != "" {
+			values = append(values, "{package_name}", name)
+		} else if strings.Contains(strings.Join(append(project.Compile, project.Run...), " "), "{package_name}") {
+			return projectPlan{}, fmt.Errorf("%s has no package name", project.Marker)
+		}
+		break
+	}
+
+	var sources []string
+	for p := range paths {
+		for _, extension := range language.Extensions {
+			if strings.EqualFold(path.Ext(p), extension) {
+				sources = append(sources, p)
+				break
+			}
+		}
+	}
+	sort.Strings(sources)
+
+	replacer := strings.NewReplacer(values...)
+	expand := func(args []string) []string {
+		var expanded []string
+		for _, arg := range args {
+			if arg == "{sources}" {
+				expanded = append(expanded, sources...)
+				continue
+			}
+			expanded = append(expanded, replacer.Replace(arg))
+		}
+		return expanded
+	}
+	return projectPlan{Compile: expand(plan.Compile), Run: expand(plan.Run)}, nil
+}
+
+var manifestPackageLine = regexp.MustCompile(`(?m)^\s*name\s*=\s*"([^"]+)"`)
+
+// manifestPackageName reads the name from the [package] section of a
+// manifest such as Cargo.toml
+func manifestPackageName(manifest string) string {
+	section := manifest
+	if start := strings.Index(manifest, "[package]"); start >= 0 {
+		section = manifest[start:]
+		if end := strings.Index(section[1:], "\n["); end >= 0 {
+			section = section[:end+1]
+		}
+	}
+	if match := manifestPackageLine.FindStringSubmatch(section); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+var (
+	goDiagnostic   = regexp.MustCompile(`(?m)^(?:\./)?([^\s:#]+\.go):(\d+):(\d+): (.+)$`)
+	gccDiagnostic  = regexp.MustCompile(`(?m)^(?:\./)?([^\s:]+):(\d+):(\d+): (error|warning|fatal error): (.+)$`)
+	goPanic        = regexp.MustCompile(`(?m)^panic: .*$`)
+	goPanicFrame   = regexp.MustCompile(`(?m)^\t(\S+\.go):(\d+)`)
+	javaDiagnostic = regexp.MustCompile(`(?m)^(.+?\.java):(\d+): (error|warning): (.+)$`)
+	rustDiagnostic = regexp.MustCompile(`(?m)^(error|warning)(?:\[\w+\])?: (.+)\n\s*--> ([^:\n]+):(\d+):(\d+)`)
+	pythonFrame    = regexp.MustCompile(`File "([^"]+)", line (\d+)`)
+	nodeLocation   = regexp.MustCompile(`(\S+?\.[cm]?js):(\d+)(?::(\d+))?`)
+	nodeError      = regexp.MustCompile(`(?m)^\w*Error\b.*$`)
+)
+
+// ParseDiagnostics extracts file and line information from compiler output
+// or from an interpreter's error report, in one of the formats a language
+// can name. Paths are made relative to dir.
+func ParseDiagnostics(format, dir, output string) []Diagnostic {
+	// Frames outside the work directory belong to the runtime
+	inProject := func(p string) bool {
+		return !filepath.IsAbs(p) || strings.HasPrefix(p, dir+string(filepath.Separator))
+	}
+	relative := func(p string) string {
+		p = strings.TrimPrefix(p, dir+string(filepath.Separator))
+		return strings.TrimPrefix(filepath.ToSlash(p), "./")
+	}
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+
+	var diagnostics []Diagnostic
+	switch format {
+	case "go":
+		for _, m := range goDiagnostic.FindAllStringSubmatch(output, -1) {
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(m[1]), Line: atoi(m[2]), Column: atoi(m[3]), Severity: "error", Message: m[4]})
+		}
+		// A panic lists the innermost frame first
+		if message := goPanic.FindString(output); len(diagnostics) == 0 && message != "" {
+			for _, m := range goPanicFrame.FindAllStringSubmatch(output, -1) {
+				if inProject(m[1]) {
+					diagnostics = append(diagnostics, Diagnostic{Path: relative(m[1]), Line: atoi(m[2]), Severity: "error", Message: message})
+					break
+				}
+			}
+		}
+
+	case "gcc":
+		for _, m := range gccDiagnostic.FindAllStringSubmatch(output, -1) {
+			if !inProject(m[1]) {
+				continue
+			}
+			severity := m[4]
+			if severity == "fatal error" {
+				severity = "error"
+			}
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(m[1]), Line: atoi(m[2]), Column: atoi(m[3]), Severity: severity, Message: m[5]})
+		}
+
+	case "java":
+		for _, m := range javaDiagnostic.FindAllStringSubmatch(output, -1) {
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(m[1]), Line: atoi(m[2]), Severity: m[3], Message: m[4]})
+		}
+
+	case "rust":
+		for _, m := range rustDiagnostic.FindAllStringSubmatch(output, -1) {
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(m[3]), Line: atoi(m[4]), Column: atoi(m[5]), Severity: m[1], Message: m[2]})
+		}
+
+	case "python":
+		// The innermost frame inside the project and the exception line
+		var last []string
+		for _, m := range pythonFrame.FindAllStringSubmatch(output, -1) {
+			if inProject(m[1]) {
+				last = m
+			}
+		}
+		if last != nil {
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(last[1]), Line: atoi(last[2]), Severity: "error", Message: lastLine(output)})
+		}
+
+	case "javascript":
+		for _, m := range nodeLocation.FindAllStringSubmatch(output, -1) {
+			if !inProject(m[1]) {
+				continue
+			}
+			message := nodeError.FindString(output)
+			if message == "" {
+				message = lastLine(output)
+			}
+			diagnostics = append(diagnostics, Diagnostic{Path: relative(m[1]), Line: atoi(m[2]), Column: atoi(m[3]), Severity: "error", Message: message})
+			break
+		}
+	}
+	return diagnostics
+}
+
+// lastLine returns the last non-empty line of some output
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,507 @@
+//go:build linux
+
+package utils
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"codeCollab-backend/config"
+)
+
+// sandboxInitArg marks a re-execution of the server binary that only applies
+// rlimits and then execs the sandboxed command
+const sandboxInitArg = "__sandbox-init"
+
+// Each run gets an account of its own from a range no one else uses, so
+// runs cannot signal each other or share a process limit; its group has the
+// same ID
+const (
+	sandboxUIDBase  = 1 << 30
+	sandboxUIDCount = 256
+)
+
+// sandboxUIDs holds the accounts no run is using
+var sandboxUIDs = func() chan int {
+	uids := make(chan int, sandboxUIDCount)
+	for i := 0; i < sandboxUIDCount; i++ {
+		uids <- sandboxUIDBase + i
+	}
+	return uids
+}()
+
+// Compilers need more room than most programs; they never get less than this
+const (
+	compileMemoryFloor  = 2 << 30
+	compileProcessFloor = 512
+	compileFileFloor    = 256 << 20
+)
+
+// IsSandboxInit reports whether the process was started to set up a sandbox
+func IsSandboxInit() bool {
+	return len(os.Args) > 1 && os.Args[1] == sandboxInitArg
+}
+
+// SandboxInit sets up the filesystem and applies the limits passed by
+// sandboxCommand, drops to the run's account and replaces the process with
+// the command. It never returns.
+//
+// Arguments: cpu seconds, data bytes, processes, file bytes, account, build
+// cache ("-" for none), rootfs ("-" for none), then the command.
+func SandboxInit() {
+	args := os.Args[2:]
+	if len(args) < 8 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing arguments")
+		os.Exit(127)
+	}
+	uid, err := strconv.Atoi(args[4])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox: invalid account:", args[4])
+		os.Exit(127)
+	}
+
+	if err := mountCache(args[5]); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox: build cache:", err)
+		os.Exit(127)
+	}
+	if rootfs := args[6]; rootfs != "-" {
+		if err := enterRootfs(rootfs, args[3]); err != nil {
+			fmt.Fprintln(os.Stderr, "sandbox: rootfs:", err)
+			os.Exit(127)
+		}
+	} else if err := confineHost(); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox: filesystem:", err)
+		os.Exit(127)
+	}
+
+	resources := []int{syscall.RLIMIT_CPU, syscall.RLIMIT_DATA, rlimitNproc, syscall.RLIMIT_FSIZE}
+	for i, resource := range resources {
+		value, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sandbox: invalid limit:", args[i])
+			os.Exit(127)
+		}
+		limit := &syscall.Rlimit{Cur: value, Max: value}
+		if resource == syscall.RLIMIT_CPU {
+			// SIGXCPU at the limit, SIGKILL a second later if it is ignored
+			limit.Max = value + 1
+		}
+		if err := syscall.Setrlimit(resource, limit); err != nil {
+			fmt.Fprintln(os.Stderr, "sandbox: setrlimit:", err)
+			os.Exit(127)
+		}
+	}
+
+	if err := dropPrivileges(uid, uid); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox: drop privileges:", err)
+		os.Exit(127)
+	}
+
+	command := args[7:]
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox:", err)
+		os.Exit(127)
+	}
+	err = syscall.Exec(path, command, os.Environ())
+	fmt.Fprintln(os.Stderr, "sandbox: exec:", err)
+	os.Exit(127)
+}
+
+// mountCache keeps the mounts made for the sandbox from propagating back to
+// the server, and mounts the build cache, unless it is "-", in the work
+// directory, which is the current one. It runs in the private mount
+// namespace sandboxCommand creates.
+func mountCache(cache string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if cache == "-" {
+		return nil
+	}
+	workdir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return syscall.Mount(cache, filepath.Join(workdir, sandboxCacheName), "", syscall.MS_BIND, "")
+}
+
+// enterRootfs mounts the work directory, which is the current one, at
+// /workspace inside rootfs and makes rootfs the root. Everything else in
+// rootfs is read-only, and /tmp, if it has one, an empty tmpfs of at most
+// tmpSize bytes.
+func enterRootfs(rootfs, tmpSize string) error {
+	workdir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// Runs share rootfs, so nothing may be left in it for the next one
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %w", rootfs, err)
+	}
+	if err := remountReadOnly(rootfs); err != nil {
+		return err
+	}
+	target := filepath.Join(rootfs, sandboxWorkdir)
+	if err := syscall.Mount(workdir, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %w", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(rootfs, "tmp")); err == nil && info.IsDir() {
+		if err := syscall.Mount("tmpfs", filepath.Join(rootfs, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size="+tmpSize); err != nil {
+			return fmt.Errorf("mounting /tmp: %w", err)
+		}
+	}
+	// A fresh /proc shows only the sandbox's own processes
+	if info, err := os.Stat(filepath.Join(rootfs, "proc")); err == nil && info.IsDir() {
+		if err := syscall.Mount("proc", filepath.Join(rootfs, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mounting /proc: %w", err)
+		}
+	}
+	if err := syscall.Chroot(rootfs); err != nil {
+		return err
+	}
+	return os.Chdir(sandboxWorkdir)
+}
+
+// confineHost leaves the server's filesystem visible, for the toolchains,
+// but read-only except for the work directory, which is the current one,
+// and the build cache mounted in it.
+func confineHost() error {
+	workdir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// A mount of its own keeps the work directory out of the remounts
+	if err := syscall.Mount(workdir, workdir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %w", workdir, err)
+	}
+	writable := map[string]bool{workdir: true, filepath.Join(workdir, sandboxCacheName): true}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if writable[mount] {
+			continue
+		}
+		err := remountReadOnly(mount)
+		// Mounts under one that was mounted over cannot be reached
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+	}
+
+	// A fresh /proc shows only the sandbox's own processes
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+	// The current directory still refers to the mount below the new one
+	return os.Chdir(workdir)
+}
+
+// remountReadOnly makes a bind mount read-only
+func remountReadOnly(mount string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mount, &stat); err != nil {
+		return fmt.Errorf("reading %s: %w", mount, err)
+	}
+	// The mount's other flags, such as nosuid, have to be kept
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for st, ms := range mountFlags {
+		if stat.Flags&st != 0 {
+			flags |= ms
+		}
+	}
+	if err := syscall.Mount("", mount, "", flags, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %w", mount, err)
+	}
+	return nil
+}
+
+// mountFlags maps the statfs flags a bind remount must repeat to their mount
+// flags
+var mountFlags = map[int64]uintptr{
+	0x2:    syscall.MS_NOSUID,
+	0x4:    syscall.MS_NODEV,
+	0x8:    syscall.MS_NOEXEC,
+	0x400:  syscall.MS_NOATIME,
+	0x800:  syscall.MS_NODIRATIME,
+	0x1000: syscall.MS_RELATIME,
+}
+
+// mountPoints lists where filesystems are mounted in the current namespace
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		// Spaces and other special characters are escaped in octal
+		mount, err := strconv.Unquote(`"` + strings.ReplaceAll(fields[4], `"`, `\"`) + `"`)
+		if err != nil {
+			mount = fields[4]
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// dropPrivileges switches to the given account with no supplementary groups
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// RLIMIT_NPROC, which the syscall package does not name
+const rlimitNproc = 0x6
+
+// newSandboxRun takes an account for a run in dir. The build cache of
+// cacheKey, if not empty, is kept for that key's builds only. Setting the
+// sandbox up needs root, so other servers run nothing.
+func newSandboxRun(ctx context.Context, dir, cacheKey string) (*sandboxRun, func(), error) {
+	if os.Getuid() != 0 {
+		return nil, nil, ErrSandboxUnavailable
+	}
+	if strings.ContainsFunc(cacheKey, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_')
+	}) {
+		return nil, nil, fmt.Errorf("invalid build cache key %q", cacheKey)
+	}
+	// Mount points of the build cache and the run's own temp directory
+	for _, name := range []string{sandboxCacheName, sandboxTmpName} {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return nil, nil, err
+		}
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	select {
+	case uid := <-sandboxUIDs:
+		return &sandboxRun{dir: dir, uid: uid, cacheKey: cacheKey}, func() { sandboxUIDs <- uid }, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// sandboxCommand prepares a command that runs in its own mount, network,
+// PID, IPC and UTS namespaces under rlimits, as the run's account. It sees
+// the language's rootfs if it has one, or else the server's filesystem
+// read-only. Only the work directory and, for builds, the build cache are
+// writable. The returned function must be called once the command is done.
+func sandboxCommand(ctx context.Context, run *sandboxRun, args []string, limits SandboxLimits, language config.LanguageConfig, compile bool) (*exec.Cmd, func(), error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cpuSeconds := uint64((limits.CPUTime + time.Second - 1) / time.Second)
+	memory, processes, fileSize := limits.MemoryBytes, limits.MaxProcesses, limits.MaxFileBytes
+	if compile {
+		cpuSeconds = uint64((limits.CompileTime + time.Second - 1) / time.Second)
+		memory = max(memory, compileMemoryFloor)
+		processes = max(processes, compileProcessFloor)
+		fileSize = max(fileSize, compileFileFloor)
+	}
+
+	// The command drops to the run's account after the limits are set, so
+	// the server binary only has to be executable by its own account
+	if err := chownTree(run.dir, run.uid, run.uid); err != nil {
+		return nil, nil, err
+	}
+	cache, done := "-", func() {}
+	if compile && run.cacheKey != "" {
+		if cache, done, err = lockBuildCache(run.cacheKey, run.uid); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	wrapped := append([]string{
+		sandboxInitArg,
+		strconv.FormatUint(cpuSeconds, 10),
+		strconv.FormatInt(memory, 10),
+		strconv.Itoa(processes),
+		strconv.FormatInt(fileSize, 10),
+		strconv.Itoa(run.uid),
+		cache,
+		cmp.Or(language.Rootfs, "-"),
+	}, args...)
+
+	cmd := exec.CommandContext(ctx, self, wrapped...)
+	cmd.Dir = run.dir
+	cmd.Env = sandboxEnv(run.dir, language, compile)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	return cmd, done, nil
+}
+
+// One build at a time uses each build cache
+var (
+	buildCachesMu sync.Mutex
+	buildCaches   = make(map[string]*sync.Mutex)
+)
+
+// lockBuildCache returns the build cache of a key, created if needed and
+// handed to the given account, and the function that unlocks it again.
+// Caches live in a directory only root can enter; builds reach their own
+// through a mount.
+func lockBuildCache(key string, uid int) (string, func(), error) {
+	base := filepath.Join(os.TempDir(), "codecollab-build-cache")
+	if err := os.MkdirAll(base, 0o700); err != nil {
+		return "", nil, err
+	}
+	// Anyone may create files in the temp directory, so the cache must not
+	// be a link planted there
+	info, err := os.Lstat(base)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.IsDir() {
+		return "", nil, fmt.Errorf("%s is not a directory", base)
+	}
+	if err := os.Lchown(base, 0, 0); err != nil {
+		return "", nil, err
+	}
+	if err := os.Chmod(base, 0o700); err != nil {
+		return "", nil, err
+	}
+
+	buildCachesMu.Lock()
+	mu, ok := buildCaches[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		buildCaches[key] = mu
+	}
+	buildCachesMu.Unlock()
+	mu.Lock()
+
+	cache := filepath.Join(base, key)
+	if err := os.Mkdir(cache, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+		mu.Unlock()
+		return "", nil, err
+	}
+	// Everything in the cache belongs to the account that owns it, as only
+	// that account has built in it since it was handed over
+	info, err = os.Lstat(cache)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", cache)
+	}
+	if err == nil && info.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+		err = chownTree(cache, uid, uid)
+	}
+	if err != nil {
+		mu.Unlock()
+		return "", nil, err
+	}
+	return cache, mu.Unlock, nil
+}
+
+// sandboxEnv builds a minimal environment so server secrets never reach the
+// program or get baked into a build. The language adds its own variables.
+func sandboxEnv(dir string, language config.LanguageConfig, compile bool) []string {
+	home, _ := os.UserHomeDir()
+	path := os.Getenv("PATH")
+	if language.Rootfs != "" {
+		dir = sandboxWorkdir
+		path = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+
+	vars := map[string]string{
+		"PATH": path,
+		"HOME": dir,
+		// The go tool ignores a go.mod in the temp directory itself, so it
+		// is not the work directory
+		"TMPDIR": filepath.Join(dir, sandboxTmpName),
+		"LANG":   "C.UTF-8",
+	}
+	extra := language.RunEnv
+	if compile {
+		extra = language.CompileEnv
+	}
+	placeholders := strings.NewReplacer("{workdir}", dir, "{home}", home, "{cache}", filepath.Join(dir, sandboxCacheName))
+	for name, value := range extra {
+		vars[name] = placeholders.Replace(value)
+	}
+	if compile {
+		for _, name := range language.InheritEnv {
+			if value := os.Getenv(name); value != "" {
+				vars[name] = value
+			}
+		}
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// chownTree hands a directory over to a run's account
+func chownTree(dir string, uid, gid int) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// processUsage reads CPU time and peak resident memory from rusage
+func processUsage(state *os.ProcessState) (time.Duration, int64) {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return state.UserTime() + state.SystemTime(), 0
+	}
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	// ru_maxrss is in kilobytes on Linux
+	return cpu, usage.Maxrss * 1024
+}
+
+// cpuLimitHit reports whether the kernel stopped the program for using up
+// its CPU time
+func cpuLimitHit(state *os.ProcessState, limits SandboxLimits) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	if status.Signal() == syscall.SIGXCPU {
+		return true
+	}
+	cpu, _ := processUsage(state)
+	return status.Signal() == syscall.SIGKILL && cpu >= limits.CPUTime
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"codeCollab-backend/config"
+)
+
+// IsSandboxInit reports whether the process was started to set up a sandbox;
+// only Linux re-executes the server for that
+func IsSandboxInit() bool {
+	return false
+}
+
+// SandboxInit is never called outside Linux
+func SandboxInit() {}
+
+// newSandboxRun refuses to run anything: programs can only be confined on
+// Linux
+func newSandboxRun(ctx context.Context, dir, cacheKey string) (*sandboxRun, func(), error) {
+	return nil, nil, ErrSandboxUnavailable
+}
+
+// sandboxCommand is never reached, as newSandboxRun fails first
+func sandboxCommand(ctx context.Context, run *sandboxRun, args []string, limits SandboxLimits, language config.LanguageConfig, compile bool) (*exec.Cmd, func(), error) {
+	return nil, nil, ErrSandboxUnavailable
+}
+
+// processUsage reads CPU time; peak memory is not portable
+func processUsage(state *os.ProcessState) (time.Duration, int64) {
+	return state.UserTime() + state.SystemTime(), 0
+}
+
+// cpuLimitHit is always false without a CPU rlimit
+func cpuLimitHit(state *os.ProcessState, limits SandboxLimits) bool {
+	return false
+}
@@ -47,8 +47,38 @@ func SetAuthCookies(c *gin.Context, accessToken, refreshToken string) {
 // Secret key used to sign tokens (replace with your secret key)
 var jwtSecret = []byte("123456")
 
+// Token type claim carried by WebSocket tickets, which are not access tokens
+const ticketTokenType = "ws_ticket"
+
 // ParseToken validates a JWT and extracts the user ID
 func ParseToken(tokenString string) (string, error) {
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	// A ticket only opens a socket; it is never an access token
+	if typ, _ := claims["typ"].(string); typ == ticketTokenType {
+		return "", errors.New("invalid token")
+	}
+	return subject(claims)
+}
+
+// ParseTicket validates a WebSocket ticket and extracts the user ID
+func ParseTicket(ticketString string) (string, error) {
+	claims, err := parseClaims(ticketString)
+	if err != nil {
+		return "", err
+	}
+
+	if typ, _ := claims["typ"].(string); typ != ticketTokenType {
+		return "", errors.New("invalid ticket")
+	}
+	return subject(claims)
+}
+
+// parseClaims checks the signature and expiry of a JWT and returns its claims
+func parseClaims(tokenString string) (jwt.MapClaims, error) {
 	// Parse the token
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Validate the algorithm
@@ -59,17 +89,32 @@ func ParseToken(tokenString string) (string, error) {
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Extract the claims
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// Assuming the user ID is stored in the "sub" field
-		if userID, ok := claims["sub"].(string); ok {
-			return userID, nil
-		}
-		return "", errors.New("user ID not found in token")
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
 	}
+	return claims, nil
+}
+
+// subject extracts the user ID, which is stored in the "sub" field
+func subject(claims jwt.MapClaims) (string, error) {
+	if userID, ok := claims["sub"].(string); ok {
+		return userID, nil
+	}
+	return "", errors.New("user ID not found in token")
+}
+
+// GenerateTicket creates a short-lived token that lets a browser open a
+// WebSocket when it cannot attach the access token cookie to the handshake
+func GenerateTicket(userID string) (string, error) {
+	ticket := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID,
+		"typ": ticketTokenType,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
 
-	return "", errors.New("invalid token")
+	return ticket.SignedString(jwtSecret)
 }
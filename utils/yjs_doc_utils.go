@@ -0,0 +1,1102 @@
+package utils
+
+import (
+	"cmp"
+	"errors"
+	"math/rand"
+	"slices"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Content refs of the structs in a Yjs update
+const (
+	yjsContentGC      = 0
+	yjsContentDeleted = 1
+	yjsContentJSON    = 2
+	yjsContentBinary  = 3
+	yjsContentString  = 4
+	yjsContentEmbed   = 5
+	yjsContentFormat  = 6
+	yjsContentType    = 7
+	yjsContentAny     = 8
+	yjsContentDoc     = 9
+	yjsContentSkip    = 10
+)
+
+// Type refs of shared types that carry a node name
+const (
+	yjsXMLElement = 3
+	yjsXMLHook    = 5
+)
+
+// Clocks are JavaScript numbers on the client, so they stay below 2^53
+const yjsMaxClock = 1 << 53
+
+// How many structs and delete ranges may wait for ones they depend on
+const yjsMaxPending = 10000
+
+var (
+	// ErrYjsMalformed is returned for updates that cannot be decoded
+	ErrYjsMalformed = errors.New("yjs update is malformed")
+	// ErrYjsTooManyPending is returned for an update that would leave more
+	// structs waiting for missing ones than a document holds
+	ErrYjsTooManyPending = errors.New("yjs update depends on too many missing structs")
+)
+
+// YjsID identifies one character or element inserted by a Yjs client
+type YjsID struct {
+	Client uint64
+	Clock  uint64
+}
+
+// yjsItem is a run of content inserted by one client, or of garbage
+// collected clocks when gc is set
+type yjsItem struct {
+	id     YjsID
+	length uint64
+	gc     bool
+
+	origin      *YjsID
+	rightOrigin *YjsID
+	// Where an item written without origins lives: a root type by name or
+	// the item holding a nested type
+	parentName *string
+	parentID   *YjsID
+	parentSub  *string
+
+	ref   byte
+	text  []uint16 // string content, in UTF-16 code units like Yjs counts it
+	parts [][]byte // JSON and Any content, one encoded element each
+	raw   []byte   // any other content, which is never split
+
+	deleted     bool
+	parent      *yjsType
+	left, right *yjsItem
+	typ         *yjsType // the type created by type content
+}
+
+// yjsType is a shared type: a list of items and, for maps, the last item
+// set for each key
+type yjsType struct {
+	name    string   // root types only
+	item    *yjsItem // nested types only
+	start   *yjsItem
+	entries map[string]*yjsItem
+}
+
+// yjsRange is a range of deleted clocks of one client
+type yjsRange struct {
+	client, clock, length uint64
+}
+
+// YjsDocument merges Yjs updates the way a Yjs client does, so the server
+// can read the text of a document, compact its history into one update and
+// make edits of its own. Only as much of Yjs is implemented as that needs:
+// every kind of content is kept and passed on, but only text is read.
+type YjsDocument struct {
+	clients map[uint64][]*yjsItem
+	roots   map[string]*yjsType
+
+	// Structs and deletes waiting for ones they depend on
+	pending        []*yjsItem
+	pendingDeletes []yjsRange
+
+	clientID uint64 // used for edits made by the server
+}
+
+// NewYjsDocument creates an empty document
+func NewYjsDocument() *YjsDocument {
+	return &YjsDocument{
+		clients: make(map[uint64][]*yjsItem),
+		roots:   make(map[string]*yjsType),
+	}
+}
+
+// ApplyUpdate merges an update into the document. Parts that depend on
+// updates not seen yet are held until those arrive, up to a limit; past it,
+// what the update left waiting is dropped and ErrYjsTooManyPending returned.
+func (d *YjsDocument) ApplyUpdate(update []byte) error {
+	// Decoded content refers to the update, which the caller may reuse
+	items, deletes, err := decodeYjsUpdate(slices.Clone(update))
+	if err != nil {
+		return err
+	}
+
+	previousDeletes := slices.Clone(d.pendingDeletes)
+	d.pending = append(d.pending, items...)
+	d.pendingDeletes = append(d.pendingDeletes, deletes...)
+	d.integratePending()
+	if len(d.pending)+len(d.pendingDeletes) <= yjsMaxPending {
+		return nil
+	}
+
+	added := make(map[*yjsItem]bool, len(items))
+	for _, item := range items {
+		added[item] = true
+	}
+	d.pending = slices.DeleteFunc(d.pending, func(item *yjsItem) bool { return added[item] })
+	// Deleting twice does no harm, so the earlier deletes are simply tried again
+	d.pendingDeletes = previousDeletes
+	d.integratePending()
+	return ErrYjsTooManyPending
+}
+
+// PendingUpdate encodes the structs and deletes that still wait for others,
+// or returns nil when none do. It must be kept along with the document's
+// state to rebuild it later.
+func (d *YjsDocument) PendingUpdate() []byte {
+	if len(d.pending) == 0 && len(d.pendingDeletes) == 0 {
+		return nil
+	}
+
+	byClient := make(map[uint64][]*yjsItem)
+	for _, item := range d.pending {
+		byClient[item.id.Client] = append(byClient[item.id.Client], item)
+	}
+	clients := make([]uint64, 0, len(byClient))
+	for client := range byClient {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+
+	var e YjsEncoder
+	e.WriteVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		items := byClient[client]
+		slices.SortFunc(items, func(a, b *yjsItem) int {
+			return cmp.Compare(a.id.Clock, b.id.Clock)
+		})
+
+		// Gaps between the structs are written as skips, and structs that
+		// came more than once only once
+		var structs yjsEncoderStructs
+		clock := items[0].id.Clock
+		for _, item := range items {
+			if item.id.Clock+item.length <= clock {
+				continue
+			}
+			if item.id.Clock > clock {
+				structs.add(&yjsItem{id: YjsID{client, clock}, length: item.id.Clock - clock, gc: true, ref: yjsContentSkip}, 0)
+				clock = item.id.Clock
+			}
+			structs.add(item, clock-item.id.Clock)
+			clock = item.id.Clock + item.length
+		}
+		e.WriteVarUint(uint64(len(structs.items)))
+		e.WriteVarUint(client)
+		e.WriteVarUint(items[0].id.Clock)
+		for i, item := range structs.items {
+			item.write(&e, structs.offsets[i])
+		}
+	}
+	d.writeDeleteSet(&e, d.pendingDeletes)
+	return e.Bytes()
+}
+
+// yjsEncoderStructs collects structs to write with the offset to start at
+type yjsEncoderStructs struct {
+	items   []*yjsItem
+	offsets []uint64
+}
+
+func (s *yjsEncoderStructs) add(item *yjsItem, offset uint64) {
+	s.items = append(s.items, item)
+	s.offsets = append(s.offsets, offset)
+}
+
+// Text reads the content of a root Y.Text
+func (d *YjsDocument) Text(name string) string {
+	typ, ok := d.roots[name]
+	if !ok {
+		return ""
+	}
+	var units []uint16
+	for item := typ.start; item != nil; item = item.right {
+		if !item.deleted && item.ref == yjsContentString {
+			units = append(units, item.text...)
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// StateVector encodes the next clock of every client the document has seen
+func (d *YjsDocument) StateVector() []byte {
+	var e YjsEncoder
+	clients := d.sortedClients()
+	e.WriteVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.WriteVarUint(client)
+		e.WriteVarUint(d.state(client))
+	}
+	return e.Bytes()
+}
+
+// DecodeYjsStateVector reads a state vector sent in sync step 1
+func DecodeYjsStateVector(stateVector []byte) (map[uint64]uint64, error) {
+	dec := NewYjsDecoder(stateVector)
+	count, err := dec.ReadVarUint()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(dec.remaining())/2 {
+		return nil, ErrYjsMalformed
+	}
+	sv := make(map[uint64]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		client, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if sv[client], err = dec.ReadVarUint(); err != nil {
+			return nil, err
+		}
+	}
+	return sv, nil
+}
+
+// EncodeUpdate encodes everything the document has that a peer with the
+// given state vector lacks, with every delete; a nil state vector encodes
+// the whole document
+func (d *YjsDocument) EncodeUpdate(sv map[uint64]uint64) []byte {
+	var e YjsEncoder
+	var clients []uint64
+	for _, client := range d.sortedClients() {
+		if d.state(client) > sv[client] {
+			clients = append(clients, client)
+		}
+	}
+
+	e.WriteVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		structs := d.clients[client]
+		i := d.findIndex(client, sv[client])
+		offset := sv[client] - structs[i].id.Clock
+		e.WriteVarUint(uint64(len(structs) - i))
+		e.WriteVarUint(client)
+		e.WriteVarUint(sv[client])
+		for _, item := range structs[i:] {
+			item.write(&e, offset)
+			offset = 0
+		}
+	}
+	d.writeDeleteSet(&e, d.deleteSet())
+	return e.Bytes()
+}
+
+// ReplaceText edits a root Y.Text to read text, as a client would, and
+// returns the update that makes the same edit on other peers, or nil when
+// the text already reads so
+func (d *YjsDocument) ReplaceText(name, text string) []byte {
+	typ := d.root(name)
+	var old []uint16
+	var chars []YjsID
+	for item := typ.start; item != nil; item = item.right {
+		if item.deleted || item.ref != yjsContentString {
+			continue
+		}
+		old = append(old, item.text...)
+		for i := range item.text {
+			chars = append(chars, YjsID{item.id.Client, item.id.Clock + uint64(i)})
+		}
+	}
+	units := utf16.Encode([]rune(text))
+
+	prefix := 0
+	for prefix < len(old) && prefix < len(units) && old[prefix] == units[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(units)-prefix && old[len(old)-1-suffix] == units[len(units)-1-suffix] {
+		suffix++
+	}
+	inserted := units[prefix : len(units)-suffix]
+	removed := chars[prefix : len(chars)-suffix]
+	if len(inserted) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	var structs []*yjsItem
+	if len(inserted) > 0 {
+		if d.clientID == 0 {
+			for d.clientID == 0 || len(d.clients[d.clientID]) > 0 {
+				d.clientID = uint64(rand.Uint32())
+			}
+		}
+		item := &yjsItem{
+			id:     YjsID{d.clientID, d.state(d.clientID)},
+			length: uint64(len(inserted)),
+			ref:    yjsContentString,
+			text:   slices.Clone(inserted),
+		}
+		// Insert after the character before the change, in front of whatever
+		// follows it in the list
+		var right *yjsItem
+		if prefix > 0 {
+			left := d.cleanEnd(chars[prefix-1])
+			item.origin = &YjsID{left.id.Client, left.id.Clock + left.length - 1}
+			right = left.right
+		} else {
+			right = typ.start
+		}
+		if right != nil {
+			id := right.id
+			item.rightOrigin = &id
+		}
+		if item.origin == nil && item.rightOrigin == nil {
+			item.parentName = &typ.name
+		}
+		d.integrate(item)
+		structs = append(structs, item)
+	}
+
+	var deletes []yjsRange
+	for _, id := range removed {
+		if last := len(deletes) - 1; last >= 0 && deletes[last].client == id.Client && deletes[last].clock+deletes[last].length == id.Clock {
+			deletes[last].length++
+			continue
+		}
+		deletes = append(deletes, yjsRange{id.Client, id.Clock, 1})
+	}
+	for _, r := range deletes {
+		d.applyDelete(r)
+	}
+
+	var e YjsEncoder
+	e.WriteVarUint(uint64(len(structs)))
+	for _, item := range structs {
+		e.WriteVarUint(1)
+		e.WriteVarUint(item.id.Client)
+		e.WriteVarUint(item.id.Clock)
+		item.write(&e, 0)
+	}
+	d.writeDeleteSet(&e, deletes)
+	return e.Bytes()
+}
+
+// integratePending integrates every waiting struct whose dependencies are
+// there, and applies the deletes that can be, until nothing more can be
+func (d *YjsDocument) integratePending() {
+	for progress := true; progress; {
+		progress = false
+		var waiting []*yjsItem
+		for _, item := range d.pending {
+			state := d.state(item.id.Client)
+			switch {
+			case item.id.Clock+item.length <= state:
+				// Already known
+			case item.id.Clock > state || d.missing(item):
+				waiting = append(waiting, item)
+			default:
+				if offset := state - item.id.Clock; offset > 0 {
+					item = item.splitOff(offset)
+				}
+				d.integrate(item)
+				progress = true
+			}
+		}
+		d.pending = waiting
+
+		var deletes []yjsRange
+		for _, r := range d.pendingDeletes {
+			if rest, ok := d.applyDelete(r); !ok {
+				deletes = append(deletes, rest)
+			}
+		}
+		d.pendingDeletes = deletes
+	}
+}
+
+// missing reports whether an item refers to a struct the document lacks
+func (d *YjsDocument) missing(item *yjsItem) bool {
+	for _, id := range []*YjsID{item.origin, item.rightOrigin, item.parentID} {
+		if id != nil && d.state(id.Client) <= id.Clock {
+			return true
+		}
+	}
+	return false
+}
+
+// integrate places a struct whose dependencies are all there, following the
+// YATA rules Yjs uses so every peer ends up with the same order
+func (d *YjsDocument) integrate(item *yjsItem) {
+	if item.gc {
+		d.clients[item.id.Client] = append(d.clients[item.id.Client], item)
+		return
+	}
+
+	var left, right *yjsItem
+	if item.origin != nil {
+		left = d.cleanEnd(*item.origin)
+	}
+	if item.rightOrigin != nil {
+		right = d.cleanStart(*item.rightOrigin)
+	}
+
+	// An item next to collected content or in a type that is gone becomes
+	// garbage itself
+	var parent *yjsType
+	switch {
+	case (left != nil && left.gc) || (right != nil && right.gc):
+	case item.origin == nil && item.rightOrigin == nil:
+		if item.parentName != nil {
+			parent = d.root(*item.parentName)
+		} else if owner := d.find(*item.parentID); owner != nil && !owner.gc {
+			parent = owner.typ
+		}
+	default:
+		if left != nil {
+			parent, item.parentSub = left.parent, left.parentSub
+		}
+		if right != nil {
+			parent, item.parentSub = right.parent, right.parentSub
+		}
+	}
+	if parent == nil {
+		item.collect()
+		d.clients[item.id.Client] = append(d.clients[item.id.Client], item)
+		return
+	}
+	item.parent = parent
+
+	// Find the place among items inserted concurrently at the same spot
+	if (left != nil && left.right != right) || (left == nil && (right == nil || right.left != nil)) {
+		var o *yjsItem
+		switch {
+		case left != nil:
+			o = left.right
+		case item.parentSub != nil:
+			o = parent.entries[*item.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		default:
+			o = parent.start
+		}
+		conflicting := make(map[*yjsItem]bool)
+		before := make(map[*yjsItem]bool)
+		for o != nil && o != right {
+			before[o] = true
+			conflicting[o] = true
+			if sameYjsID(item.origin, o.origin) {
+				if o.id.Client < item.id.Client {
+					left = o
+					clear(conflicting)
+				} else if sameYjsID(item.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if originItem := d.findOrigin(o); originItem != nil && before[originItem] {
+				if !conflicting[originItem] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+	}
+
+	if left != nil {
+		right = left.right
+		left.right = item
+	} else if item.parentSub != nil {
+		right = parent.entries[*item.parentSub]
+		for right != nil && right.left != nil {
+			right = right.left
+		}
+	} else {
+		right = parent.start
+		parent.start = item
+	}
+	item.left, item.right = left, right
+	if right != nil {
+		right.left = item
+	} else if item.parentSub != nil {
+		// The last item of a key is its value; the one before is overwritten
+		parent.entries[*item.parentSub] = item
+		if left != nil {
+			d.delete(left)
+		}
+	}
+
+	if item.ref == yjsContentType {
+		item.typ = &yjsType{item: item, entries: make(map[string]*yjsItem)}
+	}
+	d.clients[item.id.Client] = append(d.clients[item.id.Client], item)
+
+	if (parent.item != nil && parent.item.deleted) || (item.parentSub != nil && item.right != nil) {
+		d.delete(item)
+	}
+}
+
+// findOrigin returns the item holding the origin of another, if it has one
+func (d *YjsDocument) findOrigin(item *yjsItem) *yjsItem {
+	if item.origin == nil {
+		return nil
+	}
+	return d.find(*item.origin)
+}
+
+// applyDelete deletes a range of clocks, splitting items at its ends. It
+// returns the part beyond what the document has, if any.
+func (d *YjsDocument) applyDelete(r yjsRange) (yjsRange, bool) {
+	state := d.state(r.client)
+	end := r.clock + r.length
+	if r.clock < state {
+		for clock := r.clock; clock < min(end, state); {
+			item := d.cleanStart(YjsID{r.client, clock})
+			if !item.gc && item.id.Clock+item.length > end {
+				d.split(item, end-item.id.Clock)
+			}
+			d.delete(item)
+			clock = item.id.Clock + item.length
+		}
+	}
+	if end <= state {
+		return yjsRange{}, true
+	}
+	start := max(r.clock, state)
+	return yjsRange{r.client, start, end - start}, false
+}
+
+// delete marks an item deleted, along with the content of the type it holds
+func (d *YjsDocument) delete(item *yjsItem) {
+	if item.deleted || item.gc {
+		return
+	}
+	item.deleted = true
+	if item.typ == nil {
+		return
+	}
+	for child := item.typ.start; child != nil; child = child.right {
+		d.delete(child)
+	}
+	for _, child := range item.typ.entries {
+		d.delete(child)
+	}
+}
+
+// root returns a root type, creating it on first use
+func (d *YjsDocument) root(name string) *yjsType {
+	typ, ok := d.roots[name]
+	if !ok {
+		typ = &yjsType{name: name, entries: make(map[string]*yjsItem)}
+		d.roots[name] = typ
+	}
+	return typ
+}
+
+// state returns the next clock expected from a client
+func (d *YjsDocument) state(client uint64) uint64 {
+	structs := d.clients[client]
+	if len(structs) == 0 {
+		return 0
+	}
+	last := structs[len(structs)-1]
+	return last.id.Clock + last.length
+}
+
+// findIndex returns the index of the struct of a client holding a clock,
+// which must be below the client's state
+func (d *YjsDocument) findIndex(client, clock uint64) int {
+	structs := d.clients[client]
+	i, _ := slices.BinarySearchFunc(structs, clock, func(item *yjsItem, clock uint64) int {
+		switch {
+		case item.id.Clock+item.length <= clock:
+			return -1
+		case item.id.Clock > clock:
+			return 1
+		}
+		return 0
+	})
+	return i
+}
+
+// find returns the struct holding an ID, or nil when there is none
+func (d *YjsDocument) find(id YjsID) *yjsItem {
+	if id.Clock >= d.state(id.Client) {
+		return nil
+	}
+	return d.clients[id.Client][d.findIndex(id.Client, id.Clock)]
+}
+
+// cleanStart returns the item starting at an ID, splitting the one holding it
+func (d *YjsDocument) cleanStart(id YjsID) *yjsItem {
+	item := d.find(id)
+	if item.gc || item.id.Clock == id.Clock {
+		return item
+	}
+	return d.split(item, id.Clock-item.id.Clock)
+}
+
+// cleanEnd returns the item ending at an ID, splitting the one holding it
+func (d *YjsDocument) cleanEnd(id YjsID) *yjsItem {
+	item := d.find(id)
+	if !item.gc && id.Clock != item.id.Clock+item.length-1 {
+		d.split(item, id.Clock-item.id.Clock+1)
+	}
+	return item
+}
+
+// split cuts an integrated item in two and returns the second part
+func (d *YjsDocument) split(item *yjsItem, diff uint64) *yjsItem {
+	right := item.splitOff(diff)
+	right.parent = item.parent
+	right.deleted = item.deleted
+	right.left = item
+	right.right = item.right
+	if item.right != nil {
+		item.right.left = right
+	} else if item.parentSub != nil && item.parent.entries[*item.parentSub] == item {
+		item.parent.entries[*item.parentSub] = right
+	}
+	item.right = right
+
+	i := d.findIndex(item.id.Client, item.id.Clock)
+	d.clients[item.id.Client] = slices.Insert(d.clients[item.id.Client], i+1, right)
+	return right
+}
+
+// splitOff shortens an item to its first diff clocks and returns the rest
+// as a new item that follows it
+func (item *yjsItem) splitOff(diff uint64) *yjsItem {
+	right := &yjsItem{
+		id:          YjsID{item.id.Client, item.id.Clock + diff},
+		length:      item.length - diff,
+		gc:          item.gc,
+		origin:      &YjsID{item.id.Client, item.id.Clock + diff - 1},
+		rightOrigin: item.rightOrigin,
+		parentSub:   item.parentSub,
+		ref:         item.ref,
+		deleted:     item.deleted,
+	}
+	if item.gc {
+		right.origin = nil
+	}
+	switch item.ref {
+	case yjsContentString:
+		right.text = item.text[diff:]
+		item.text = item.text[:diff:diff]
+		// Yjs replaces both halves of a surrogate pair it cuts through
+		if utf16.IsSurrogate(rune(item.text[diff-1])) && item.text[diff-1] < 0xdc00 {
+			item.text[diff-1] = utf8.RuneError
+			right.text[0] = utf8.RuneError
+		}
+	case yjsContentJSON, yjsContentAny:
+		right.parts = item.parts[diff:]
+		item.parts = item.parts[:diff:diff]
+	}
+	item.length = diff
+	return right
+}
+
+// collect turns an item into garbage, keeping only its clocks
+func (item *yjsItem) collect() {
+	*item = yjsItem{id: item.id, length: item.length, gc: true}
+}
+
+// write encodes a struct from offset clocks into it
+func (item *yjsItem) write(e *YjsEncoder, offset uint64) {
+	if item.gc {
+		e.buf = append(e.buf, item.ref)
+		e.WriteVarUint(item.length - offset)
+		return
+	}
+
+	origin := item.origin
+	if offset > 0 {
+		origin = &YjsID{item.id.Client, item.id.Clock + offset - 1}
+	}
+	info := item.ref
+	if origin != nil {
+		info |= 0x80
+	}
+	if item.rightOrigin != nil {
+		info |= 0x40
+	}
+	if item.parentSub != nil {
+		info |= 0x20
+	}
+	e.buf = append(e.buf, info)
+	if origin != nil {
+		e.WriteVarUint(origin.Client)
+		e.WriteVarUint(origin.Clock)
+	}
+	if item.rightOrigin != nil {
+		e.WriteVarUint(item.rightOrigin.Client)
+		e.WriteVarUint(item.rightOrigin.Clock)
+	}
+	if origin == nil && item.rightOrigin == nil {
+		// Items not integrated yet still have the parent they came with
+		parentName, parentID := item.parentName, item.parentID
+		if item.parent != nil {
+			parentName, parentID = &item.parent.name, nil
+			if item.parent.item != nil {
+				parentName, parentID = nil, &item.parent.item.id
+			}
+		}
+		if parentName != nil {
+			e.WriteVarUint(1)
+			e.WriteVarString(*parentName)
+		} else {
+			e.WriteVarUint(0)
+			e.WriteVarUint(parentID.Client)
+			e.WriteVarUint(parentID.Clock)
+		}
+		if item.parentSub != nil {
+			e.WriteVarString(*item.parentSub)
+		}
+	}
+
+	switch item.ref {
+	case yjsContentDeleted:
+		e.WriteVarUint(item.length - offset)
+	case yjsContentString:
+		e.WriteVarString(string(utf16.Decode(item.text[offset:])))
+	case yjsContentJSON, yjsContentAny:
+		e.WriteVarUint(uint64(len(item.parts)) - offset)
+		for _, part := range item.parts[offset:] {
+			e.buf = append(e.buf, part...)
+		}
+	default:
+		e.buf = append(e.buf, item.raw...)
+	}
+}
+
+// deleteSet lists the deleted ranges of the document
+func (d *YjsDocument) deleteSet() []yjsRange {
+	var deletes []yjsRange
+	for _, client := range d.sortedClients() {
+		for _, item := range d.clients[client] {
+			if !item.deleted && !item.gc {
+				continue
+			}
+			if last := len(deletes) - 1; last >= 0 && deletes[last].client == client && deletes[last].clock+deletes[last].length == item.id.Clock {
+				deletes[last].length += item.length
+				continue
+			}
+			deletes = append(deletes, yjsRange{client, item.id.Clock, item.length})
+		}
+	}
+	return deletes
+}
+
+// writeDeleteSet encodes deleted ranges, which are grouped by client
+func (d *YjsDocument) writeDeleteSet(e *YjsEncoder, deletes []yjsRange) {
+	byClient := make(map[uint64][]yjsRange)
+	var clients []uint64
+	for _, r := range deletes {
+		if _, ok := byClient[r.client]; !ok {
+			clients = append(clients, r.client)
+		}
+		byClient[r.client] = append(byClient[r.client], r)
+	}
+	e.WriteVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.WriteVarUint(client)
+		e.WriteVarUint(uint64(len(byClient[client])))
+		for _, r := range byClient[client] {
+			e.WriteVarUint(r.clock)
+			e.WriteVarUint(r.length)
+		}
+	}
+}
+
+// sortedClients lists the clients with structs, highest first as Yjs does
+func (d *YjsDocument) sortedClients() []uint64 {
+	clients := make([]uint64, 0, len(d.clients))
+	for client, structs := range d.clients {
+		if len(structs) > 0 {
+			clients = append(clients, client)
+		}
+	}
+	slices.Sort(clients)
+	slices.Reverse(clients)
+	return clients
+}
+
+func sameYjsID(a, b *YjsID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// decodeYjsUpdate reads the structs and the delete set of an update
+func decodeYjsUpdate(update []byte) ([]*yjsItem, []yjsRange, error) {
+	dec := NewYjsDecoder(update)
+	clientCount, err := dec.ReadVarUint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if clientCount > uint64(dec.remaining()) {
+		return nil, nil, ErrYjsMalformed
+	}
+
+	var items []*yjsItem
+	for i := uint64(0); i < clientCount; i++ {
+		structCount, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		if structCount > uint64(dec.remaining()) {
+			return nil, nil, ErrYjsMalformed
+		}
+		client, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		clock, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for j := uint64(0); j < structCount; j++ {
+			item, err := dec.readStruct(YjsID{client, clock})
+			if err != nil {
+				return nil, nil, err
+			}
+			if item.length == 0 || item.length > yjsMaxClock-clock {
+				return nil, nil, ErrYjsMalformed
+			}
+			clock += item.length
+			if item.ref != yjsContentSkip {
+				items = append(items, item)
+			}
+		}
+	}
+
+	deleteCount, err := dec.ReadVarUint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if deleteCount > uint64(dec.remaining()) {
+		return nil, nil, ErrYjsMalformed
+	}
+	var deletes []yjsRange
+	for i := uint64(0); i < deleteCount; i++ {
+		client, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		rangeCount, err := dec.ReadVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rangeCount > uint64(dec.remaining())/2 {
+			return nil, nil, ErrYjsMalformed
+		}
+		for j := uint64(0); j < rangeCount; j++ {
+			clock, err := dec.ReadVarUint()
+			if err != nil {
+				return nil, nil, err
+			}
+			length, err := dec.ReadVarUint()
+			if err != nil {
+				return nil, nil, err
+			}
+			if length > 0 && clock < yjsMaxClock && length <= yjsMaxClock-clock {
+				deletes = append(deletes, yjsRange{client, clock, length})
+			}
+		}
+	}
+	return items, deletes, nil
+}
+
+// readStruct reads one struct of an update
+func (d *YjsDecoder) readStruct(id YjsID) (*yjsItem, error) {
+	info, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	item := &yjsItem{id: id, ref: info & 0x1f}
+
+	switch item.ref {
+	case yjsContentGC, yjsContentSkip:
+		item.gc = true
+		item.length, err = d.ReadVarUint()
+		return item, err
+	}
+
+	if info&0x80 != 0 {
+		if item.origin, err = d.readID(); err != nil {
+			return nil, err
+		}
+	}
+	if info&0x40 != 0 {
+		if item.rightOrigin, err = d.readID(); err != nil {
+			return nil, err
+		}
+	}
+	if info&0xc0 == 0 {
+		isRoot, err := d.ReadVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if isRoot == 1 {
+			name, err := d.ReadVarString()
+			if err != nil {
+				return nil, err
+			}
+			item.parentName = &name
+		} else if item.parentID, err = d.readID(); err != nil {
+			return nil, err
+		}
+		if info&0x20 != 0 {
+			sub, err := d.ReadVarString()
+			if err != nil {
+				return nil, err
+			}
+			item.parentSub = &sub
+		}
+	}
+
+	item.length = 1
+	start := d.pos
+	switch item.ref {
+	case yjsContentDeleted:
+		item.deleted = true
+		item.length, err = d.ReadVarUint()
+	case yjsContentString:
+		var s string
+		if s, err = d.ReadVarString(); err == nil {
+			item.text = utf16.Encode([]rune(s))
+			item.length = uint64(len(item.text))
+		}
+	case yjsContentJSON, yjsContentAny:
+		var count uint64
+		if count, err = d.ReadVarUint(); err != nil {
+			return nil, err
+		}
+		if count > uint64(d.remaining()) {
+			return nil, ErrYjsMalformed
+		}
+		for i := uint64(0); i < count && err == nil; i++ {
+			part := d.pos
+			if item.ref == yjsContentJSON {
+				_, err = d.ReadVarBytes()
+			} else {
+				err = d.skipAny(0)
+			}
+			item.parts = append(item.parts, d.buf[part:d.pos])
+		}
+		item.length = count
+	case yjsContentBinary, yjsContentEmbed:
+		_, err = d.ReadVarBytes()
+	case yjsContentFormat:
+		if _, err = d.ReadVarBytes(); err == nil {
+			_, err = d.ReadVarBytes()
+		}
+	case yjsContentType:
+		var typeRef uint64
+		if typeRef, err = d.ReadVarUint(); err == nil && (typeRef == yjsXMLElement || typeRef == yjsXMLHook) {
+			_, err = d.ReadVarBytes()
+		}
+	case yjsContentDoc:
+		if _, err = d.ReadVarBytes(); err == nil {
+			err = d.skipAny(0)
+		}
+	default:
+		return nil, ErrYjsMalformed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.parts == nil {
+		item.raw = d.buf[start:d.pos]
+	}
+	return item, nil
+}
+
+// readID reads a client and clock
+func (d *YjsDecoder) readID() (*YjsID, error) {
+	client, err := d.ReadVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.ReadVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &YjsID{client, clock}, nil
+}
+
+// readByte reads a single byte
+func (d *YjsDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, ErrYjsMessageTruncated
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+// remaining returns how many bytes are left to read
+func (d *YjsDecoder) remaining() int {
+	return len(d.buf) - d.pos
+}
+
+// skip moves past n bytes
+func (d *YjsDecoder) skip(n int) error {
+	if d.remaining() < n {
+		return ErrYjsMessageTruncated
+	}
+	d.pos += n
+	return nil
+}
+
+// skipAny moves past a value in the lib0 "any" encoding
+func (d *YjsDecoder) skipAny(depth int) error {
+	if depth > 64 {
+		return ErrYjsMalformed
+	}
+	kind, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // integer
+		for {
+			b, err := d.readByte()
+			if err != nil || b&0x80 == 0 {
+				return err
+			}
+		}
+	case 124: // float32
+		return d.skip(4)
+	case 123, 122: // float64, bigint
+		return d.skip(8)
+	case 119, 116: // string, Uint8Array
+		_, err := d.ReadVarBytes()
+		return err
+	case 118: // object
+		count, err := d.ReadVarUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := d.ReadVarBytes(); err != nil {
+				return err
+			}
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 117: // array
+		count, err := d.ReadVarUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrYjsMalformed
+}
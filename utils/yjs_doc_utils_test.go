@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Updates as y.js encodes them with encodeStateAsUpdate and in the update
+// events of a Y.Doc, for edits to the root Y.Text "t"
+var (
+	// Client 1 inserts "ac"
+	yjsInsertAC = []byte{1, 1, 1, 0, 4, 1, 1, 't', 2, 'a', 'c', 0}
+	// Client 1 then appends "d" after "c" at clock 2
+	yjsAppendD = []byte{1, 1, 1, 2, 0x84, 1, 1, 1, 'd', 0}
+	// Clients 2 and 3 each insert between "a" and "c" without seeing the other
+	yjsInsertX = []byte{1, 1, 2, 0, 0xc4, 1, 0, 1, 1, 1, 'X', 0}
+	yjsInsertY = []byte{1, 1, 3, 0, 0xc4, 1, 0, 1, 1, 1, 'Y', 0}
+	// Client 1 deletes "c", its clock 1; a delete set and no structs
+	yjsDeleteC = []byte{0, 1, 1, 1, 1, 1}
+)
+
+func applyYjsUpdates(t *testing.T, updates ...[]byte) *YjsDocument {
+	t.Helper()
+	doc := NewYjsDocument()
+	for i, update := range updates {
+		if err := doc.ApplyUpdate(update); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+	return doc
+}
+
+func TestYjsApplyUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates [][]byte
+		want    string
+	}{
+		{name: "insert", updates: [][]byte{yjsInsertAC}, want: "ac"},
+		{name: "insert after own", updates: [][]byte{yjsInsertAC, yjsAppendD}, want: "acd"},
+		{name: "concurrent inserts", updates: [][]byte{yjsInsertAC, yjsInsertX, yjsInsertY}, want: "aXYc"},
+		{name: "concurrent inserts in the other order", updates: [][]byte{yjsInsertAC, yjsInsertY, yjsInsertX}, want: "aXYc"},
+		{name: "concurrent inserts before their origins", updates: [][]byte{yjsInsertY, yjsInsertX, yjsInsertAC}, want: "aXYc"},
+		{name: "struct before the one it follows", updates: [][]byte{yjsAppendD, yjsInsertAC}, want: "acd"},
+		{name: "delete", updates: [][]byte{yjsInsertAC, yjsDeleteC}, want: "a"},
+		{name: "delete before the deleted struct", updates: [][]byte{yjsDeleteC, yjsInsertAC}, want: "a"},
+		{name: "delete around an insert", updates: [][]byte{yjsInsertAC, yjsInsertX, yjsDeleteC}, want: "aX"},
+		{name: "same update twice", updates: [][]byte{yjsInsertAC, yjsInsertX, yjsInsertX}, want: "aXc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := applyYjsUpdates(t, tt.updates...)
+			if got := doc.Text("t"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if pending := doc.PendingUpdate(); pending != nil {
+				t.Errorf("structs still pending: %v", pending)
+			}
+		})
+	}
+}
+
+func TestYjsPendingUntilDependencyArrives(t *testing.T) {
+	doc := applyYjsUpdates(t, yjsAppendD, yjsDeleteC)
+	if got := doc.Text("t"); got != "" {
+		t.Fatalf("got %q before the first insert arrived, want nothing", got)
+	}
+
+	// What waits is kept in a form that rebuilds the same document
+	restored := applyYjsUpdates(t, doc.PendingUpdate(), yjsInsertAC)
+	if got := restored.Text("t"); got != "ad" {
+		t.Errorf("restored document reads %q, want %q", got, "ad")
+	}
+
+	if err := doc.ApplyUpdate(yjsInsertAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.Text("t"); got != "ad" {
+		t.Errorf("got %q, want %q", got, "ad")
+	}
+	if pending := doc.PendingUpdate(); pending != nil {
+		t.Errorf("structs still pending: %v", pending)
+	}
+}
+
+func TestYjsTooManyPending(t *testing.T) {
+	// Client 5 sends a run of structs after a clock 0 it never sends
+	var e YjsEncoder
+	e.WriteVarUint(1)
+	e.WriteVarUint(yjsMaxPending + 1)
+	e.WriteVarUint(5)
+	e.WriteVarUint(1)
+	for clock := uint64(1); clock <= yjsMaxPending+1; clock++ {
+		e.buf = append(e.buf, 0x84)
+		e.WriteVarUint(5)
+		e.WriteVarUint(clock - 1)
+		e.WriteVarString("x")
+	}
+	e.WriteVarUint(0)
+
+	doc := applyYjsUpdates(t, yjsAppendD)
+	if err := doc.ApplyUpdate(e.Bytes()); !errors.Is(err, ErrYjsTooManyPending) {
+		t.Fatalf("got %v, want ErrYjsTooManyPending", err)
+	}
+
+	// Only what the rejected update left waiting is dropped
+	if err := doc.ApplyUpdate(yjsInsertAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.Text("t"); got != "acd" {
+		t.Errorf("got %q, want %q", got, "acd")
+	}
+	if pending := doc.PendingUpdate(); pending != nil {
+		t.Errorf("structs still pending: %v", pending)
+	}
+}
+
+func TestYjsMalformedUpdates(t *testing.T) {
+	for _, update := range [][]byte{yjsInsertAC, yjsAppendD, yjsInsertX, yjsDeleteC} {
+		for n := 0; n < len(update); n++ {
+			doc := NewYjsDocument()
+			if err := doc.ApplyUpdate(update[:n]); err == nil {
+				t.Errorf("%v cut to %d bytes was accepted", update, n)
+			}
+			if got := doc.Text("t"); got != "" {
+				t.Errorf("%v cut to %d bytes left %q", update, n, got)
+			}
+		}
+	}
+
+	// Anything else must be rejected or applied, never panic
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		update := make([]byte, r.Intn(32))
+		r.Read(update)
+		doc := applyYjsUpdates(t, yjsInsertAC)
+		_ = doc.ApplyUpdate(update)
+		_ = doc.Text("t")
+		_ = doc.EncodeUpdate(nil)
+	}
+}
+
+func TestYjsEncodeUpdate(t *testing.T) {
+	doc := applyYjsUpdates(t, yjsInsertAC, yjsInsertX, yjsInsertY, yjsDeleteC)
+
+	whole := applyYjsUpdates(t, doc.EncodeUpdate(nil))
+	if got := whole.Text("t"); got != "aXY" {
+		t.Errorf("whole document reads %q, want %q", got, "aXY")
+	}
+
+	// A peer that has the first insert only gets the rest
+	peer := applyYjsUpdates(t, yjsInsertAC)
+	sv, err := DecodeYjsStateVector(peer.StateVector())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.ApplyUpdate(doc.EncodeUpdate(sv)); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.Text("t"); got != "aXY" {
+		t.Errorf("peer reads %q, want %q", got, "aXY")
+	}
+}
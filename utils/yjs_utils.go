@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"errors"
+)
+
+// y-websocket message types
+const (
+	YjsMessageSync           = 0
+	YjsMessageAwareness      = 1
+	YjsMessageAuth           = 2
+	YjsMessageQueryAwareness = 3
+)
+
+// y-protocols sync message types
+const (
+	YjsSyncStep1  = 0
+	YjsSyncStep2  = 1
+	YjsSyncUpdate = 2
+)
+
+var (
+	// YjsEmptyUpdate is an encoded update that carries no structs and no deletes
+	YjsEmptyUpdate = []byte{0, 0}
+	// YjsEmptyStateVector asks the peer for everything it has
+	YjsEmptyStateVector = []byte{0}
+)
+
+// ErrYjsMessageTruncated is returned when a binary message ends early
+var ErrYjsMessageTruncated = errors.New("yjs message is truncated")
+
+// YjsEncoder writes values in the lib0 encoding used by Yjs
+type YjsEncoder struct {
+	buf []byte
+}
+
+// WriteVarUint writes an unsigned integer as a 7-bit varint
+func (e *YjsEncoder) WriteVarUint(n uint64) {
+	for n > 0x7f {
+		e.buf = append(e.buf, byte(n&0x7f)|0x80)
+		n >>= 7
+	}
+	e.buf = append(e.buf, byte(n))
+}
+
+// WriteVarBytes writes a length-prefixed byte slice
+func (e *YjsEncoder) WriteVarBytes(b []byte) {
+	e.WriteVarUint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// WriteVarString writes a length-prefixed UTF-8 string
+func (e *YjsEncoder) WriteVarString(s string) {
+	e.WriteVarBytes([]byte(s))
+}
+
+// Bytes returns the encoded message
+func (e *YjsEncoder) Bytes() []byte {
+	return e.buf
+}
+
+// YjsDecoder reads values in the lib0 encoding used by Yjs
+type YjsDecoder struct {
+	buf []byte
+	pos int
+}
+
+// NewYjsDecoder starts reading at the beginning of a message
+func NewYjsDecoder(b []byte) *YjsDecoder {
+	return &YjsDecoder{buf: b}
+}
+
+// ReadVarUint reads a 7-bit varint
+func (d *YjsDecoder) ReadVarUint() (uint64, error) {
+	var n uint64
+	var shift uint
+	for {
+		if d.pos >= len(d.buf) || shift > 63 {
+			return 0, ErrYjsMessageTruncated
+		}
+		b := d.buf[d.pos]
+		d.pos++
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, nil
+		}
+		shift += 7
+	}
+}
+
+// ReadVarBytes reads a length-prefixed byte slice
+func (d *YjsDecoder) ReadVarBytes() ([]byte, error) {
+	n, err := d.ReadVarUint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)-d.pos) < n {
+		return nil, ErrYjsMessageTruncated
+	}
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// ReadVarString reads a length-prefixed UTF-8 string
+func (d *YjsDecoder) ReadVarString() (string, error) {
+	b, err := d.ReadVarBytes()
+	return string(b), err
+}
+
+// EncodeYjsSyncMessage builds a sync protocol message around a state vector
+// or an update
+func EncodeYjsSyncMessage(syncType uint64, payload []byte) []byte {
+	var e YjsEncoder
+	e.WriteVarUint(YjsMessageSync)
+	e.WriteVarUint(syncType)
+	e.WriteVarBytes(payload)
+	return e.Bytes()
+}
+
+// AwarenessState is one client's entry in an awareness update. State is the
+// raw JSON the client published, or "null" once it has gone away.
+type AwarenessState struct {
+	ClientID uint64
+	Clock    uint64
+	State    string
+}
+
+// DecodeAwarenessUpdate parses the payload of an awareness message
+func DecodeAwarenessUpdate(update []byte) ([]AwarenessState, error) {
+	d := NewYjsDecoder(update)
+	count, err := d.ReadVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every entry takes at least three bytes, so a larger count cannot be
+	// honest and is not trusted to size anything
+	if count > uint64(len(update)-d.pos)/3 {
+		return nil, ErrYjsMessageTruncated
+	}
+
+	var states []AwarenessState
+	for i := uint64(0); i < count; i++ {
+		var s AwarenessState
+		if s.ClientID, err = d.ReadVarUint(); err != nil {
+			return nil, err
+		}
+		if s.Clock, err = d.ReadVarUint(); err != nil {
+			return nil, err
+		}
+		if s.State, err = d.ReadVarString(); err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// EncodeAwarenessMessage builds a complete awareness message for the given states
+func EncodeAwarenessMessage(states []AwarenessState) []byte {
+	var update YjsEncoder
+	update.WriteVarUint(uint64(len(states)))
+	for _, s := range states {
+		update.WriteVarUint(s.ClientID)
+		update.WriteVarUint(s.Clock)
+		update.WriteVarString(s.State)
+	}
+
+	var e YjsEncoder
+	e.WriteVarUint(YjsMessageAwareness)
+	e.WriteVarBytes(update.Bytes())
+	return e.Bytes()
+}